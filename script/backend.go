@@ -0,0 +1,255 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	QueryBackendBeanQuery = "bean-query"
+	QueryBackendMemory    = "memory"
+)
+
+// QueryBackend 账本查询后端：执行 BQL、打印交易原文、读取价格、校验账本
+type QueryBackend interface {
+	// List 执行 BQL，返回 CSV 格式的结果，首行为列名
+	List(ledgerConfig *Config, bql string) (string, error)
+	// Print 返回交易在源文件中的原文
+	Print(ledgerConfig *Config, transactionId string) (string, error)
+	// Prices 返回价格文件中的所有价格
+	Prices(ledgerConfig *Config) ([]CommodityPrice, error)
+	// Check 校验账本，返回错误信息列表
+	Check(ledgerConfig *Config) ([]string, error)
+}
+
+// 默认（未配置）使用内存后端，遇到不支持的语法时回退到 bean-query，校验账本时优先使用 bean-check。
+// 配置为 memory 时只使用原生解析器，校验账本不运行插件，校验项也少于 bean-check
+var queryBackends = map[string]QueryBackend{
+	"":                    &MemoryBackend{Fallback: &BeanQueryBackend{}, FallbackCheck: true},
+	QueryBackendMemory:    &MemoryBackend{},
+	QueryBackendBeanQuery: &BeanQueryBackend{},
+}
+
+// RegisterQueryBackend 注册查询后端，账本配置 queryBackend 为 name 时使用
+func RegisterQueryBackend(name string, backend QueryBackend) {
+	queryBackends[name] = backend
+	// 更换后端后已缓存的结果不再可信
+	resetQueryCaches()
+}
+
+// GetQueryBackend 获取账本配置的查询后端，未知的名称使用默认后端
+func GetQueryBackend(ledgerConfig *Config) QueryBackend {
+	backend, ok := queryBackends[ledgerConfig.QueryBackend]
+	if !ok {
+		LogError(ledgerConfig.Mail, "Unknown query backend "+ledgerConfig.QueryBackend+", use default backend")
+		return queryBackends[""]
+	}
+	return backend
+}
+
+// BeanQueryBackend 调用 beancount 命令行工具的查询后端
+type BeanQueryBackend struct{}
+
+func (b *BeanQueryBackend) List(ledgerConfig *Config, bql string) (string, error) {
+	return b.query(ledgerConfig, "-f", "csv", GetLedgerIndexFilePath(ledgerConfig.DataPath), bql)
+}
+
+func (b *BeanQueryBackend) Print(ledgerConfig *Config, transactionId string) (string, error) {
+	bql, err := buildPrintBQL(transactionId)
+	if err != nil {
+		return "", err
+	}
+	output, err := b.query(ledgerConfig, GetLedgerIndexFilePath(ledgerConfig.DataPath), bql)
+	if err != nil {
+		return "", err
+	}
+	return ConvertGBKToUTF8(output)
+}
+
+func (b *BeanQueryBackend) query(ledgerConfig *Config, args ...string) (string, error) {
+	output, err := RunBeanCommand(ledgerConfig, nil, "bean-query", args...)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+func (b *BeanQueryBackend) Prices(ledgerConfig *Config) ([]CommodityPrice, error) {
+	beanFilePath := GetLedgerPriceFilePath(ledgerConfig.DataPath)
+	var (
+		command       string
+		useBeanReport = checkCommandExists(ledgerConfig, "bean-report")
+	)
+	// `bean-report` had been deprecated since https://github.com/beancount/beancount/commit/a7c4f14f083de63e8d4e5a8d3664209daf95e1ec,
+	// we use `bean-query` instead. Here we add a check to use `bean-report` if `bean-query` is not installed for better compatibility.
+	if useBeanReport {
+		command = fmt.Sprintf("bean-report %s all_prices", beanFilePath)
+	} else {
+		// 'price' column works as a column placeholder to be consistent with the output of `bean-report`.
+		command = fmt.Sprintf(`bean-query %s "SELECT date, 'price', currency, price FROM account ~ 'Assets' WHERE price is not NULL"`, beanFilePath)
+	}
+	LogInfo(ledgerConfig.Mail, command)
+	re := regexp.MustCompile(`"([^"]*)"|(\S+)`)
+	cmds := re.FindAllString(command, -1)
+	output, err := RunBeanCommand(ledgerConfig, nil, cmds[0], cmds[1:]...)
+	if errors.Is(err, ErrQueryTimeout) {
+		return nil, err
+	}
+	outputStr := string(output)
+	lines := strings.Split(outputStr, "\n")
+	LogInfo(ledgerConfig.Mail, outputStr)
+	// Remove the first two lines of the output since they are the header and separator with BQL output.
+	if !useBeanReport && len(lines) > 2 {
+		lines = lines[2:]
+	}
+	return newCommodityPriceListFromString(lines), nil
+}
+
+func (b *BeanQueryBackend) Check(ledgerConfig *Config) ([]string, error) {
+	var stderr bytes.Buffer
+	_, err := RunBeanCommand(ledgerConfig, &stderr, "bean-check", GetLedgerIndexFilePath(ledgerConfig.DataPath))
+	result := make([]string, 0)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		for _, e := range strings.Split(stderr.String(), "\r\n") {
+			if e == "" {
+				continue
+			}
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// MemoryBackend 使用原生解析器在进程内加载账本的查询后端
+type MemoryBackend struct {
+	// Files 不为空时从该文件系统加载账本（路径相对账本根目录），用于测试和无数据目录的部署
+	Files fs.FS
+	// Fallback 内存后端执行失败（如不支持的语法）时使用的后端
+	Fallback QueryBackend
+	// FallbackCheck 为 true 时校验账本优先使用 Fallback（bean-check 运行插件，校验更完整），Fallback 不可用时使用原生校验
+	FallbackCheck bool
+}
+
+func (b *MemoryBackend) load(ledgerConfig *Config, filePath string) (*Ledger, error) {
+	if b.Files == nil {
+		return LoadLedger(filePath)
+	}
+	rel := strings.TrimPrefix(filePath, ledgerConfig.DataPath+"/")
+	return loadLedger(rel, func(path string) ([]byte, error) {
+		return fs.ReadFile(b.Files, filepath.ToSlash(path))
+	}, func(pattern string) ([]string, error) {
+		return fs.Glob(b.Files, filepath.ToSlash(pattern))
+	})
+}
+
+// loadIndex 加载整个账本，从数据目录加载时使用缓存的解析结果
+func (b *MemoryBackend) loadIndex(ledgerConfig *Config) (*Ledger, error) {
+	if b.Files == nil {
+		return LoadCachedLedger(ledgerConfig)
+	}
+	return b.load(ledgerConfig, GetLedgerIndexFilePath(ledgerConfig.DataPath))
+}
+
+func (b *MemoryBackend) fallback(ledgerConfig *Config, err error) bool {
+	if b.Fallback == nil {
+		return false
+	}
+	LogInfo(ledgerConfig.Mail, "Memory backend failed, fallback: "+err.Error())
+	return true
+}
+
+// bqlIdRegexp 查询中引用了交易 id
+var bqlIdRegexp = regexp.MustCompile(`(?i)\bid\b`)
+
+// 交易 id 由各后端分别计算，同一账本的 id 必须来自同一个后端：
+// 账本无法在内存中加载时所有查询都使用回退后端；可以加载时只有不涉及 id 的查询在执行失败后回退
+func (b *MemoryBackend) List(ledgerConfig *Config, bql string) (string, error) {
+	ledger, err := b.loadIndex(ledgerConfig)
+	if err != nil {
+		if b.fallback(ledgerConfig, err) {
+			return b.Fallback.List(ledgerConfig, bql)
+		}
+		return "", err
+	}
+	output, err := ledger.QueryCSV(bql)
+	if err == nil {
+		return output, nil
+	}
+	if !bqlIdRegexp.MatchString(bql) && b.fallback(ledgerConfig, err) {
+		return b.Fallback.List(ledgerConfig, bql)
+	}
+	return "", err
+}
+
+func (b *MemoryBackend) Print(ledgerConfig *Config, transactionId string) (string, error) {
+	bql, err := buildPrintBQL(transactionId)
+	if err != nil {
+		return "", err
+	}
+	ledger, err := b.loadIndex(ledgerConfig)
+	if err != nil {
+		if b.fallback(ledgerConfig, err) {
+			return b.Fallback.Print(ledgerConfig, transactionId)
+		}
+		return "", err
+	}
+	// id 是内存后端计算的，回退后端中不存在
+	return ledger.QueryText(bql)
+}
+
+func (b *MemoryBackend) Prices(ledgerConfig *Config) ([]CommodityPrice, error) {
+	ledger, err := b.load(ledgerConfig, GetLedgerPriceFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		if b.fallback(ledgerConfig, err) {
+			return b.Fallback.Prices(ledgerConfig)
+		}
+		return nil, err
+	}
+	prices := make([]CommodityPrice, 0)
+	for _, entry := range ledger.Prices() {
+		prices = append(prices, CommodityPrice{
+			Date:      entry.Date,
+			Commodity: entry.Currency,
+			Value:     entry.Amount.Number.String(),
+			Currency:  entry.Amount.Currency,
+		})
+	}
+	return prices, nil
+}
+
+func (b *MemoryBackend) Check(ledgerConfig *Config) ([]string, error) {
+	if b.FallbackCheck && b.Fallback != nil {
+		result, err := b.Fallback.Check(ledgerConfig)
+		if err == nil || errors.Is(err, ErrQueryTimeout) {
+			return result, err
+		}
+		LogInfo(ledgerConfig.Mail, "Fallback check failed, use native check: "+err.Error())
+	}
+	result := make([]string, 0)
+	ledger, err := b.loadIndex(ledgerConfig)
+	if err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) && !parseErr.Unsupported {
+			// 语法错误属于校验结果
+			return append(result, parseErr.Error()), nil
+		}
+		if b.fallback(ledgerConfig, err) {
+			return b.Fallback.Check(ledgerConfig)
+		}
+		return nil, err
+	}
+	for _, e := range ledger.Errors {
+		result = append(result, e.Error())
+	}
+	return result, nil
+}
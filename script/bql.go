@@ -1,44 +1,146 @@
 package script
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
 	"reflect"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
 )
 
 type QueryParams struct {
-	From        bool   `bql:"From"`
-	FromYear    int    `bql:"year ="`
-	FromMonth   int    `bql:"month ="`
-	Where       bool   `bql:"where"`
-	ID          string `bql:"id ="`
-	IDList      string `bql:"id in"`
-	Currency    string `bql:"currency ="`
-	Year        int    `bql:"year ="`
-	Month       int    `bql:"month ="`
-	Tag         string `bql:"in tags"`
-	Account     string `bql:"account ="`
-	AccountLike string `bql:"account ~"`
-	GroupBy     string `bql:"group by"`
-	OrderBy     string `bql:"order by"`
-	Limit       int    `bql:"limit"`
-	Path        string
+	From      bool
+	FromYear  int
+	FromMonth int
+	// Where 已不再使用，存在查询条件时自动添加 WHERE
+	Where bool
+	// ID 交易 id，uuid 格式时按交易元数据中的 uuid 查询
+	ID string
+	// IDList 不为 nil 时只查询列表中的交易，空列表不匹配任何交易
+	IDList   []string
+	Currency string
+	Year     int
+	Month    int
+	Tag      string
+	Account  string
+	// Accounts 多个账户之间为 OR 关系
+	Accounts    []string
+	AccountLike string
+	// StartDate、EndDate 日期范围（包含两端），零值表示不限制
+	StartDate time.Time
+	EndDate   time.Time
+	// MinAmount、MaxAmount 过账金额范围（包含两端），nil 表示不限制
+	MinAmount *decimal.Decimal
+	MaxAmount *decimal.Decimal
+	// Payee、Narration 按子串匹配，不区分大小写
+	Payee     string
+	Narration string
+	Flag      string // 交易标记，! 为待确认的交易
+	GroupBy   string
+	OrderBy   string
+	Limit     int
+	Path      string
 }
 
+// TransactionIdCondition 按交易 id 查询的条件。内容相同的交易 id（内容的 hash）相同，
+// uuid 格式时按元数据中的 uuid 查询，只匹配一笔交易
+func TransactionIdCondition(transactionId string) BQLCondition {
+	if IsUUID(transactionId) {
+		return EntryMetaEq(TransactionUUIDKey, transactionId)
+	}
+	return Eq("id", transactionId)
+}
+
+// Condition 查询参数对应的 WHERE 条件
+func (queryParams *QueryParams) Condition() BQLCondition {
+	conditions := make([]BQLCondition, 0)
+	if queryParams.ID != "" {
+		conditions = append(conditions, TransactionIdCondition(queryParams.ID))
+	}
+	if queryParams.IDList != nil {
+		conditions = append(conditions, In("id", queryParams.IDList))
+	}
+	if queryParams.Currency != "" {
+		conditions = append(conditions, Eq("currency", queryParams.Currency))
+	}
+	if queryParams.Year != 0 {
+		conditions = append(conditions, Eq("year", queryParams.Year))
+	}
+	if queryParams.Month != 0 {
+		conditions = append(conditions, Eq("month", queryParams.Month))
+	}
+	if queryParams.Tag != "" {
+		conditions = append(conditions, Contains("tags", strings.TrimSpace(queryParams.Tag)))
+	}
+	if queryParams.Account != "" {
+		conditions = append(conditions, Eq("account", queryParams.Account))
+	}
+	if len(queryParams.Accounts) > 0 {
+		conditions = append(conditions, In("account", queryParams.Accounts))
+	}
+	if queryParams.AccountLike != "" {
+		conditions = append(conditions, HasPrefix("account", queryParams.AccountLike))
+	}
+	if !queryParams.StartDate.IsZero() {
+		conditions = append(conditions, Compare("date", ">=", queryParams.StartDate))
+	}
+	if !queryParams.EndDate.IsZero() {
+		conditions = append(conditions, Compare("date", "<=", queryParams.EndDate))
+	}
+	if queryParams.MinAmount != nil {
+		conditions = append(conditions, Compare("number", ">=", *queryParams.MinAmount))
+	}
+	if queryParams.MaxAmount != nil {
+		conditions = append(conditions, Compare("number", "<=", *queryParams.MaxAmount))
+	}
+	if queryParams.Payee != "" {
+		conditions = append(conditions, HasSubstring("payee", queryParams.Payee))
+	}
+	if queryParams.Narration != "" {
+		conditions = append(conditions, HasSubstring("narration", queryParams.Narration))
+	}
+	if queryParams.Flag != "" {
+		conditions = append(conditions, Eq("flag", queryParams.Flag))
+	}
+	return And(conditions...)
+}
+
+func (queryParams *QueryParams) fromCondition() BQLCondition {
+	conditions := make([]BQLCondition, 0)
+	if queryParams.FromYear != 0 {
+		conditions = append(conditions, Eq("year", queryParams.FromYear))
+	}
+	if queryParams.FromMonth != 0 {
+		conditions = append(conditions, Eq("month", queryParams.FromMonth))
+	}
+	return And(conditions...)
+}
+
+// GetQueryParams 解析通用查询参数，忽略格式错误的参数
 func GetQueryParams(c *gin.Context) QueryParams {
+	queryParams, _ := ParseQueryParams(c)
+	return queryParams
+}
+
+// ParseQueryParams 解析通用查询参数，参数格式错误时返回错误（已解析的参数仍然有效）
+func ParseQueryParams(c *gin.Context) (QueryParams, error) {
 	var queryParams QueryParams
 	var hasWhere bool
+	var errs []string
 	if c.Query("year") != "" {
 		val, err := strconv.Atoi(c.Query("year"))
 		if err == nil {
 			queryParams.Year = val
 			hasWhere = true
+		} else {
+			errs = append(errs, "invalid year "+c.Query("year"))
 		}
 	}
 	if c.Query("month") != "" {
@@ -46,6 +148,8 @@ func GetQueryParams(c *gin.Context) QueryParams {
 		if err == nil {
 			queryParams.Month = val
 			hasWhere = true
+		} else {
+			errs = append(errs, "invalid month "+c.Query("month"))
 		}
 	}
 	if c.Query("tag") != "" {
@@ -56,20 +160,82 @@ func GetQueryParams(c *gin.Context) QueryParams {
 		queryParams.AccountLike = c.Query("type")
 		hasWhere = true
 	}
-	if c.Query("account") != "" {
-		queryParams.Account = c.Query("account")
-		queryParams.Limit = 100
+	// account 可以传多次，多个账户之间为 OR 关系
+	accounts := make([]string, 0)
+	for _, account := range c.QueryArray("account") {
+		if account != "" {
+			accounts = append(accounts, account)
+		}
+	}
+	if len(accounts) == 1 {
+		queryParams.Account = accounts[0]
+		hasWhere = true
+	} else if len(accounts) > 1 {
+		queryParams.Accounts = accounts
 		hasWhere = true
 	}
 	if c.Query("id") != "" {
 		queryParams.ID = c.Query("id")
 		hasWhere = true
 	}
+	for name, date := range map[string]*time.Time{"from": &queryParams.StartDate, "to": &queryParams.EndDate} {
+		if c.Query(name) == "" {
+			continue
+		}
+		val, err := time.Parse("2006-01-02", c.Query(name))
+		if err == nil {
+			*date = val
+			hasWhere = true
+		} else {
+			errs = append(errs, "invalid "+name+" date "+c.Query(name))
+		}
+	}
+	for name, amount := range map[string]**decimal.Decimal{"minAmount": &queryParams.MinAmount, "maxAmount": &queryParams.MaxAmount} {
+		if c.Query(name) == "" {
+			continue
+		}
+		val, err := decimal.NewFromString(c.Query(name))
+		if err == nil {
+			*amount = &val
+			hasWhere = true
+		} else {
+			errs = append(errs, "invalid "+name+" "+c.Query(name))
+		}
+	}
+	if c.Query("payee") != "" {
+		queryParams.Payee = c.Query("payee")
+		hasWhere = true
+	}
+	if c.Query("narration") != "" {
+		queryParams.Narration = c.Query("narration")
+		hasWhere = true
+	}
+	if c.Query("flag") != "" {
+		if err := CheckFlag(c.Query("flag")); err == nil {
+			queryParams.Flag = c.Query("flag")
+			hasWhere = true
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+	// pending=true 只查询待确认的交易
+	if c.Query("pending") == "true" {
+		queryParams.Flag = FlagPending
+		hasWhere = true
+	}
+	if c.Query("currency") != "" {
+		queryParams.Currency = c.Query("currency")
+		hasWhere = true
+	}
 	queryParams.Where = hasWhere
 	if c.Query("path") != "" {
 		queryParams.Path = c.Query("path")
 	}
-	return queryParams
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return queryParams, errors.New(strings.Join(errs, "; "))
+	}
+	return queryParams, nil
 }
 
 //func BQLQueryOne(ledgerConfig *Config, queryParams *QueryParams, queryResultPtr interface{}) error {
@@ -86,21 +252,21 @@ func GetQueryParams(c *gin.Context) QueryParams {
 //}
 
 func BQLPrint(ledgerConfig *Config, transactionId string) (string, error) {
-	// PRINT FROM id = 'xxx'
-	output, err := queryByBQL(ledgerConfig, "PRINT FROM id = '"+transactionId+"'")
-	if err != nil {
-		return "", err
-	}
-	utf8, err := ConvertGBKToUTF8(output)
-	if err != nil {
-		return "", err
-	}
-	return utf8, nil
+	return GetQueryBackend(ledgerConfig).Print(ledgerConfig, transactionId)
 }
 
 func BQLQueryList(ledgerConfig *Config, queryParams *QueryParams, queryResultPtr interface{}) error {
 	assertQueryResultIsPointer(queryResultPtr)
-	output, err := bqlRawQuery(ledgerConfig, "", queryParams, queryResultPtr)
+	return BQLQueryListByCustomSelect(ledgerConfig, newBQLQueryFromResult(queryResultPtr), queryParams, queryResultPtr)
+}
+
+func BQLQueryListByCustomSelect(ledgerConfig *Config, query *BQLQuery, queryParams *QueryParams, queryResultPtr interface{}) error {
+	assertQueryResultIsPointer(queryResultPtr)
+	bql, err := query.WithParams(queryParams).Build()
+	if err != nil {
+		return err
+	}
+	output, err := queryByBQL(ledgerConfig, bql)
 	if err != nil {
 		return err
 	}
@@ -111,119 +277,87 @@ func BQLQueryList(ledgerConfig *Config, queryParams *QueryParams, queryResultPtr
 	return nil
 }
 
-func BQLQueryListByCustomSelect(ledgerConfig *Config, selectBql string, queryParams *QueryParams, queryResultPtr interface{}) error {
+// BQLQueryListWithMeta 查询结果的同时读取每行的元数据（过账的元数据优先，其次为交易的元数据）
+func BQLQueryListWithMeta(ledgerConfig *Config, queryParams *QueryParams, queryResultPtr interface{}, metaKeys []string) ([]map[string]string, error) {
 	assertQueryResultIsPointer(queryResultPtr)
-	output, err := bqlRawQuery(ledgerConfig, selectBql, queryParams, queryResultPtr)
+	query := newBQLQueryFromResult(queryResultPtr)
+	for i, key := range metaKeys {
+		if err := CheckMetaKey(key); err != nil {
+			return nil, err
+		}
+		query.SelectAs(fmt.Sprintf("meta_%d", i), "any_meta(?)", key)
+	}
+	bql, err := query.WithParams(queryParams).Build()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = parseResult(output, queryResultPtr, false)
+	output, err := queryByBQL(ledgerConfig, bql)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if err = parseResult(output, queryResultPtr, false); err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]string, 0)
+	if len(records) == 0 {
+		return result, nil
+	}
+	columns := make(map[int]string)
+	for i, column := range records[0] {
+		for j, key := range metaKeys {
+			if strings.TrimSpace(column) == fmt.Sprintf("meta_%d", j) {
+				columns[i] = key
+			}
+		}
+	}
+	for _, record := range records[1:] {
+		meta := make(map[string]string)
+		for i, key := range columns {
+			if v := strings.TrimSpace(record[i]); v != "" {
+				meta[key] = v
+			}
+		}
+		result = append(result, meta)
+	}
+	return result, nil
 }
 
 func BeanReportAllPrices(ledgerConfig *Config) []CommodityPrice {
-	beanFilePath := GetLedgerPriceFilePath(ledgerConfig.DataPath)
-	var (
-		command       string
-		useBeanReport = checkCommandExists("bean-report")
-	)
-	// `bean-report` had been deprecated since https://github.com/beancount/beancount/commit/a7c4f14f083de63e8d4e5a8d3664209daf95e1ec,
-	// we use `bean-query` instead. Here we add a check to use `bean-report` if `bean-query` is not installed for better compatibility.
-	if useBeanReport {
-		command = fmt.Sprintf("bean-report %s all_prices", beanFilePath)
-	} else {
-		// 'price' column works as a column placeholder to be consistent with the output of `bean-report`.
-		command = fmt.Sprintf(`bean-query %s "SELECT date, 'price', currency, price FROM account ~ 'Assets' WHERE price is not NULL"`, beanFilePath)
-	}
-	LogInfo(ledgerConfig.Mail, command)
-	re := regexp.MustCompile(`"([^"]*)"|(\S+)`)
-	cmds := re.FindAllString(command, -1)
-	cmd := exec.Command(cmds[0], cmds[1:]...)
-	output, _ := cmd.Output()
-	outputStr := string(output)
-	lines := strings.Split(outputStr, "\n")
-	LogInfo(ledgerConfig.Mail, outputStr)
-	// Remove the first two lines of the output since they are the header and separator with BQL output.
-	if !useBeanReport && len(lines) > 2 {
-		lines = lines[2:]
-	}
-	return newCommodityPriceListFromString(lines)
+	prices, err := GetQueryBackend(ledgerConfig).Prices(ledgerConfig)
+	if err != nil {
+		LogError(ledgerConfig.Mail, "Failed to query prices, "+err.Error())
+		return make([]CommodityPrice, 0)
+	}
+	return prices
 }
 
-func bqlRawQuery(ledgerConfig *Config, selectBql string, queryParamsPtr *QueryParams, queryResultPtr interface{}) (string, error) {
-	var bql string
-	if selectBql == "" {
-		bql = "select"
-		queryResultPtrType := reflect.TypeOf(queryResultPtr)
-		queryResultType := queryResultPtrType.Elem()
-
-		if queryResultType.Kind() == reflect.Slice {
-			queryResultType = queryResultType.Elem()
-		}
-
-		for i := 0; i < queryResultType.NumField(); i++ {
-			typeField := queryResultType.Field(i)
-			// 字段的 tag 不带 bql 的不进行拼接
-			b := typeField.Tag.Get("bql")
-			if b != "" {
-				if strings.Contains(b, "distinct") {
-					b = strings.ReplaceAll(b, "distinct", "")
-					bql = fmt.Sprintf("%s distinct '\\', %s, ", bql, b)
-				} else {
-					bql = fmt.Sprintf("%s '\\', %s, ", bql, typeField.Tag.Get("bql"))
-				}
-			}
-		}
-		bql += " '\\'"
-	} else {
-		bql = selectBql
+// newBQLQueryFromResult 根据结果结构体字段的 bql tag 生成查询列
+func newBQLQueryFromResult(queryResultPtr interface{}) *BQLQuery {
+	query := NewBQLQuery()
+	queryResultType := reflect.TypeOf(queryResultPtr).Elem()
+	if queryResultType.Kind() == reflect.Slice {
+		queryResultType = queryResultType.Elem()
 	}
-
-	// 查询条件不为空时，拼接查询条件
-	if queryParamsPtr != nil {
-		queryParamsType := reflect.TypeOf(queryParamsPtr).Elem()
-		queryParamsValue := reflect.ValueOf(queryParamsPtr).Elem()
-		for i := 0; i < queryParamsType.NumField(); i++ {
-			typeField := queryParamsType.Field(i)
-			valueField := queryParamsValue.Field(i)
-			switch valueField.Kind() {
-			case reflect.String:
-				val := valueField.String()
-				if val != "" {
-					if typeField.Name == "OrderBy" || typeField.Name == "GroupBy" {
-						// 去除上一个条件后缀的 AND 关键字
-						bql = strings.Trim(bql, " AND")
-						bql = fmt.Sprintf("%s %s %s", bql, typeField.Tag.Get("bql"), val)
-					} else if typeField.Name == "Tag" {
-						bql = fmt.Sprintf("%s '%s' %s", bql, strings.Trim(val, " "), typeField.Tag.Get("bql"))
-					} else {
-						bql = fmt.Sprintf("%s %s '%s' AND", bql, typeField.Tag.Get("bql"), val)
-					}
-				}
-			case reflect.Int:
-				val := valueField.Int()
-				if val != 0 {
-					bql = fmt.Sprintf("%s %s %d AND", bql, typeField.Tag.Get("bql"), val)
-				}
-			case reflect.Bool:
-				val := valueField.Bool()
-				// where 前的 from 可能会带有 and
-				if typeField.Name == "Where" {
-					bql = strings.Trim(bql, " AND")
-				}
-				if val {
-					bql = fmt.Sprintf("%s %s ", bql, typeField.Tag.Get("bql"))
-				}
-			}
+	for i := 0; i < queryResultType.NumField(); i++ {
+		// 字段的 tag 不带 bql 的不进行拼接
+		b := queryResultType.Field(i).Tag.Get("bql")
+		if b == "" {
+			continue
 		}
-		bql = strings.TrimRight(bql, " AND")
+		if strings.HasPrefix(b, "distinct ") {
+			query.Distinct()
+			b = strings.TrimPrefix(b, "distinct ")
+		}
+		query.Select(b)
 	}
-	return queryByBQL(ledgerConfig, bql)
+	return query
 }
 
+// parseResult 解析 CSV 格式的查询结果，按列名映射到结构体字段的 bql tag
 func parseResult(output string, queryResultPtr interface{}, selectOne bool) error {
 	queryResultPtrType := reflect.TypeOf(queryResultPtr)
 	queryResultType := queryResultPtrType.Elem()
@@ -232,49 +366,61 @@ func parseResult(output string, queryResultPtr interface{}, selectOne bool) erro
 		queryResultType = queryResultType.Elem()
 	}
 
-	lines := strings.Split(output, "\n")[2:]
-	if selectOne && len(lines) >= 3 {
-		lines = lines[2:3]
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		return err
 	}
 
 	l := make([]map[string]interface{}, 0)
-	for _, line := range lines {
-		if line != "" {
-			values := strings.Split(line, "\\")
-			// 去除 '\' 分割带来的空字符串
-			values = values[1 : len(values)-1]
+	if len(records) > 0 {
+		// 列名 -> 字段
+		columnFields := make(map[string]reflect.StructField)
+		for i := 0; i < queryResultType.NumField(); i++ {
+			field := queryResultType.Field(i)
+			b := field.Tag.Get("bql")
+			if b != "" {
+				columnFields[bqlColumnAlias(strings.TrimPrefix(b, "distinct "))] = field
+			}
+		}
+		header := records[0]
+		for _, record := range records[1:] {
 			temp := make(map[string]interface{})
-			for i, val := range values {
-				field := queryResultType.Field(i)
+			for i, val := range record {
+				field, ok := columnFields[strings.TrimSpace(header[i])]
+				if !ok {
+					continue
+				}
 				jsonName := field.Tag.Get("json")
 				if jsonName == "" {
 					jsonName = field.Name
 				}
+				v := strings.TrimSpace(val)
 				switch field.Type.Kind() {
-				case reflect.Int, reflect.Int32:
-					i, err := strconv.Atoi(strings.Trim(val, " "))
+				case reflect.Int, reflect.Int32, reflect.Int64:
+					if v == "" {
+						continue
+					}
+					n, err := strconv.Atoi(v)
 					if err != nil {
-						panic(err)
+						return fmt.Errorf("invalid integer value '%s' in column %s", v, header[i])
 					}
-					temp[jsonName] = i
+					temp[jsonName] = n
 				// decimal
 				case reflect.String, reflect.Struct:
-					v := strings.Trim(val, " ")
 					if v != "" {
 						temp[jsonName] = v
 					}
 				case reflect.Array, reflect.Slice:
 					// 去除空格
-					strArray := strings.Split(val, ",")
 					notBlanks := make([]string, 0)
-					for _, s := range strArray {
-						if strings.Trim(s, " ") != "" {
-							notBlanks = append(notBlanks, s)
+					for _, s := range strings.Split(v, ",") {
+						if strings.TrimSpace(s) != "" {
+							notBlanks = append(notBlanks, strings.TrimSpace(s))
 						}
 					}
 					temp[jsonName] = notBlanks
 				default:
-					panic("Unsupported field type")
+					return fmt.Errorf("unsupported field type %s of %s", field.Type.Kind(), field.Name)
 				}
 			}
 			l = append(l, temp)
@@ -282,8 +428,10 @@ func parseResult(output string, queryResultPtr interface{}, selectOne bool) erro
 	}
 
 	var jsonBytes []byte
-	var err error
 	if selectOne {
+		if len(l) == 0 {
+			return errors.New("no result found")
+		}
 		jsonBytes, err = json.Marshal(l[0])
 	} else {
 		jsonBytes, err = json.Marshal(l)
@@ -299,14 +447,10 @@ func parseResult(output string, queryResultPtr interface{}, selectOne bool) erro
 }
 
 func queryByBQL(ledgerConfig *Config, bql string) (string, error) {
-	beanFilePath := ledgerConfig.DataPath + "/index.bean"
 	LogInfo(ledgerConfig.Mail, bql)
-	cmd := exec.Command("bean-query", beanFilePath, bql)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", err
-	}
-	return string(output), nil
+	return cachedQuery(ledgerConfig, bql, func() (string, error) {
+		return GetQueryBackend(ledgerConfig).List(ledgerConfig, bql)
+	})
 }
 
 func assertQueryResultIsPointer(queryResult interface{}) {
@@ -0,0 +1,507 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// BQL 构造器：查询中的值全部经过转义后再拼接，列名和排序表达式只允许简单的标识符
+
+var ErrInvalidBQLValue = errors.New("invalid bql value")
+
+var (
+	bqlColumnRegexp     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\([A-Za-z0-9_, ']*\))?$`)
+	bqlIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	bqlOrderByRegexp    = regexp.MustCompile(`^[A-Za-z0-9_(), ]+$`)
+	bqlAliasRegexp      = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+	bqlParamRegexp      = regexp.MustCompile(`^:([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// bqlColumnAlias 查询列的别名，也是结果中的列名：标识符保持不变，表达式中的非标识符字符替换为 _，如 year(date) -> year_date
+func bqlColumnAlias(expr string) string {
+	return strings.Trim(bqlAliasRegexp.ReplaceAllString(expr, "_"), "_")
+}
+
+// quoteBQLString BQL 字符串不支持转义：优先使用单引号，值包含单引号时使用双引号，两种引号都包含时无法表示
+func quoteBQLString(value string) (string, error) {
+	if !strings.Contains(value, "'") {
+		return "'" + value + "'", nil
+	}
+	if !strings.Contains(value, "\"") {
+		return "\"" + value + "\"", nil
+	}
+	return "", fmt.Errorf("%w: %s contains both single and double quotes", ErrInvalidBQLValue, value)
+}
+
+func formatBQLValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return quoteBQLString(v)
+	case int:
+		return fmt.Sprintf("%d", v), nil
+	case int32:
+		return fmt.Sprintf("%d", v), nil
+	case int64:
+		return fmt.Sprintf("%d", v), nil
+	case decimal.Decimal:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case time.Time:
+		return v.Format("2006-01-02"), nil
+	}
+	return "", fmt.Errorf("%w: unsupported type %T", ErrInvalidBQLValue, value)
+}
+
+func checkBQLColumn(column string) error {
+	if !bqlColumnRegexp.MatchString(column) {
+		return fmt.Errorf("%w: column %s", ErrInvalidBQLValue, column)
+	}
+	return nil
+}
+
+// BQLCondition 查询条件
+type BQLCondition interface {
+	renderBQL(nested bool) (string, error)
+}
+
+type bqlCompareCondition struct {
+	column string
+	op     string
+	value  interface{}
+}
+
+func (c bqlCompareCondition) renderBQL(bool) (string, error) {
+	if err := checkBQLColumn(c.column); err != nil {
+		return "", err
+	}
+	value, err := formatBQLValue(c.value)
+	if err != nil {
+		return "", err
+	}
+	return c.column + " " + c.op + " " + value, nil
+}
+
+// Eq column = value
+func Eq(column string, value interface{}) BQLCondition {
+	return bqlCompareCondition{column: column, op: "=", value: value}
+}
+
+// Compare column op value，op 仅支持比较运算符
+func Compare(column string, op string, value interface{}) BQLCondition {
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return bqlCompareCondition{column: column, op: op, value: value}
+	}
+	return bqlInvalidCondition{err: fmt.Errorf("%w: operator %s", ErrInvalidBQLValue, op)}
+}
+
+// Match column ~ pattern，pattern 按正则表达式匹配
+func Match(column string, pattern string) BQLCondition {
+	return bqlCompareCondition{column: column, op: "~", value: pattern}
+}
+
+// HasPrefix 以 prefix 开头，prefix 中的正则元字符会被转义
+func HasPrefix(column string, prefix string) BQLCondition {
+	return bqlCompareCondition{column: column, op: "~", value: "^" + regexp.QuoteMeta(prefix)}
+}
+
+// HasSubstring 包含子串（不区分大小写），子串中的正则元字符会被转义
+func HasSubstring(column string, substring string) BQLCondition {
+	return bqlCompareCondition{column: column, op: "~", value: regexp.QuoteMeta(substring)}
+}
+
+type bqlEntryMetaCondition struct {
+	key   string
+	value interface{}
+}
+
+func (c bqlEntryMetaCondition) renderBQL(bool) (string, error) {
+	key, err := quoteBQLString(c.key)
+	if err != nil {
+		return "", err
+	}
+	value, err := formatBQLValue(c.value)
+	if err != nil {
+		return "", err
+	}
+	return "entry_meta(" + key + ") = " + value, nil
+}
+
+// EntryMetaEq 交易元数据 key 的值等于 value，key 作为字符串转义
+func EntryMetaEq(key string, value interface{}) BQLCondition {
+	return bqlEntryMetaCondition{key: key, value: value}
+}
+
+type bqlInCondition struct {
+	column string
+	values []string
+}
+
+func (c bqlInCondition) renderBQL(bool) (string, error) {
+	if err := checkBQLColumn(c.column); err != nil {
+		return "", err
+	}
+	if len(c.values) == 0 {
+		return "FALSE", nil
+	}
+	quoted := make([]string, 0, len(c.values))
+	for _, v := range c.values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	// bean-query 不支持列表字面量，使用完整匹配的正则表达式代替
+	value, err := quoteBQLString("^(" + strings.Join(quoted, "|") + ")$")
+	if err != nil {
+		return "", err
+	}
+	return c.column + " ~ " + value, nil
+}
+
+// In column 的值属于 values，values 为空时不匹配任何记录
+func In(column string, values []string) BQLCondition {
+	return bqlInCondition{column: column, values: values}
+}
+
+type bqlContainsCondition struct {
+	column string
+	value  string
+}
+
+func (c bqlContainsCondition) renderBQL(bool) (string, error) {
+	if err := checkBQLColumn(c.column); err != nil {
+		return "", err
+	}
+	value, err := quoteBQLString(c.value)
+	if err != nil {
+		return "", err
+	}
+	return value + " IN " + c.column, nil
+}
+
+// Contains 集合类型的列（tags、links）包含 value
+func Contains(column string, value string) BQLCondition {
+	return bqlContainsCondition{column: column, value: value}
+}
+
+type bqlLogicCondition struct {
+	op         string
+	conditions []BQLCondition
+}
+
+func (c bqlLogicCondition) renderBQL(nested bool) (string, error) {
+	parts := make([]string, 0, len(c.conditions))
+	for _, cond := range c.conditions {
+		if cond == nil {
+			continue
+		}
+		// 相同运算符的嵌套条件无需加括号
+		child, ok := cond.(bqlLogicCondition)
+		s, err := cond.renderBQL(!ok || child.op != c.op)
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	s := strings.Join(parts, " "+c.op+" ")
+	if nested && len(parts) > 1 {
+		s = "(" + s + ")"
+	}
+	return s, nil
+}
+
+// And 所有条件同时满足，nil 条件会被忽略
+func And(conditions ...BQLCondition) BQLCondition {
+	return bqlLogicCondition{op: "AND", conditions: conditions}
+}
+
+// Or 任一条件满足，nil 条件会被忽略
+func Or(conditions ...BQLCondition) BQLCondition {
+	return bqlLogicCondition{op: "OR", conditions: conditions}
+}
+
+type bqlNotCondition struct {
+	condition BQLCondition
+}
+
+func (c bqlNotCondition) renderBQL(bool) (string, error) {
+	s, err := c.condition.renderBQL(true)
+	if err != nil || s == "" {
+		return s, err
+	}
+	return "NOT " + s, nil
+}
+
+// Not 条件取反
+func Not(condition BQLCondition) BQLCondition {
+	return bqlNotCondition{condition: condition}
+}
+
+type bqlInvalidCondition struct {
+	err error
+}
+
+func (c bqlInvalidCondition) renderBQL(bool) (string, error) {
+	return "", c.err
+}
+
+type bqlSelectTarget struct {
+	expr  string
+	alias string
+}
+
+// BQLQuery SELECT 语句构造器，每个查询列都带有别名，查询结果按列名映射到结构体的 bql tag
+type BQLQuery struct {
+	distinct bool
+	targets  []bqlSelectTarget
+	from     []BQLCondition
+	where    []BQLCondition
+	groupBy  []string
+	orderBy  []string
+	limit    int
+	err      error
+}
+
+func NewBQLQuery() *BQLQuery {
+	return &BQLQuery{}
+}
+
+func (q *BQLQuery) Distinct() *BQLQuery {
+	q.distinct = true
+	return q
+}
+
+// Select 添加一个查询列，列名为 expr 对应的别名（见 bqlColumnAlias）
+func (q *BQLQuery) Select(expr string, args ...interface{}) *BQLQuery {
+	return q.SelectAs(bqlColumnAlias(expr), expr, args...)
+}
+
+// SelectAs 添加一个名为 alias 的查询列，表达式中的 ? 依次替换为转义后的 args
+func (q *BQLQuery) SelectAs(alias string, expr string, args ...interface{}) *BQLQuery {
+	if !bqlIdentifierRegexp.MatchString(alias) {
+		q.setError(fmt.Errorf("%w: alias %s", ErrInvalidBQLValue, alias))
+		return q
+	}
+	parts := strings.Split(expr, "?")
+	if len(parts)-1 != len(args) {
+		q.setError(fmt.Errorf("%w: %d placeholders in %s, got %d args", ErrInvalidBQLValue, len(parts)-1, expr, len(args)))
+		return q
+	}
+	var sb strings.Builder
+	for i, part := range parts {
+		sb.WriteString(part)
+		if i < len(args) {
+			value, err := formatBQLValue(args[i])
+			if err != nil {
+				q.setError(err)
+				return q
+			}
+			sb.WriteString(value)
+		}
+	}
+	q.targets = append(q.targets, bqlSelectTarget{expr: sb.String(), alias: alias})
+	return q
+}
+
+func (q *BQLQuery) From(conditions ...BQLCondition) *BQLQuery {
+	q.from = append(q.from, conditions...)
+	return q
+}
+
+// Where 添加查询条件，多次调用的条件之间为 AND 关系
+func (q *BQLQuery) Where(conditions ...BQLCondition) *BQLQuery {
+	q.where = append(q.where, conditions...)
+	return q
+}
+
+func (q *BQLQuery) GroupBy(exprs ...string) *BQLQuery {
+	q.groupBy = append(q.groupBy, q.checkOrderBy(exprs)...)
+	return q
+}
+
+// OrderBy 排序表达式，如 "date desc"
+func (q *BQLQuery) OrderBy(exprs ...string) *BQLQuery {
+	q.orderBy = append(q.orderBy, q.checkOrderBy(exprs)...)
+	return q
+}
+
+func (q *BQLQuery) Limit(limit int) *BQLQuery {
+	q.limit = limit
+	return q
+}
+
+// WithParams 合并通用查询参数
+func (q *BQLQuery) WithParams(queryParams *QueryParams) *BQLQuery {
+	if queryParams == nil {
+		return q
+	}
+	if queryParams.From {
+		q.From(queryParams.fromCondition())
+	}
+	q.Where(queryParams.Condition())
+	if queryParams.GroupBy != "" {
+		q.GroupBy(queryParams.GroupBy)
+	}
+	if queryParams.OrderBy != "" {
+		q.OrderBy(queryParams.OrderBy)
+	}
+	if queryParams.Limit > 0 {
+		q.Limit(queryParams.Limit)
+	}
+	return q
+}
+
+func (q *BQLQuery) checkOrderBy(exprs []string) []string {
+	for _, expr := range exprs {
+		if !bqlOrderByRegexp.MatchString(expr) {
+			q.setError(fmt.Errorf("%w: expression %s", ErrInvalidBQLValue, expr))
+		}
+	}
+	return exprs
+}
+
+func (q *BQLQuery) setError(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *BQLQuery) Build() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	if len(q.targets) == 0 {
+		return "", fmt.Errorf("%w: no select targets", ErrInvalidBQLValue)
+	}
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	if q.distinct {
+		sb.WriteString("DISTINCT ")
+	}
+	targets := make([]string, 0, len(q.targets))
+	for _, target := range q.targets {
+		targets = append(targets, target.expr+" AS "+target.alias)
+	}
+	sb.WriteString(strings.Join(targets, ", "))
+	from, err := And(q.from...).renderBQL(false)
+	if err != nil {
+		return "", err
+	}
+	if from != "" {
+		sb.WriteString(" FROM " + from)
+	}
+	where, err := And(q.where...).renderBQL(false)
+	if err != nil {
+		return "", err
+	}
+	if where != "" {
+		sb.WriteString(" WHERE " + where)
+	}
+	if len(q.groupBy) > 0 {
+		sb.WriteString(" GROUP BY " + strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		sb.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.limit > 0 {
+		sb.WriteString(fmt.Sprintf(" LIMIT %d", q.limit))
+	}
+	return sb.String(), nil
+}
+
+// buildPrintBQL PRINT FROM id = 'xxx'
+func buildPrintBQL(transactionId string) (string, error) {
+	cond, err := Eq("id", transactionId).renderBQL(false)
+	if err != nil {
+		return "", err
+	}
+	return "PRINT FROM " + cond, nil
+}
+
+// BQLParams 返回 BQL 中引号外的 :name 参数名，按首次出现的顺序
+func BQLParams(bql string) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	_, _ = bindBQLParams(bql, func(name string) (string, error) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return "", nil
+	})
+	return names
+}
+
+// BindBQLParams 将引号外的 :name 替换为转义后的参数值，JSON 数字按整数或小数处理
+func BindBQLParams(bql string, params map[string]interface{}) (string, error) {
+	return bindBQLParams(bql, func(name string) (string, error) {
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("%w: missing parameter %s", ErrInvalidBQLValue, name)
+		}
+		switch v := value.(type) {
+		case float64:
+			if v == float64(int64(v)) {
+				value = int64(v)
+			} else {
+				value = decimal.NewFromFloat(v)
+			}
+		case json.Number:
+			d, err := decimal.NewFromString(v.String())
+			if err != nil {
+				return "", fmt.Errorf("%w: parameter %s", ErrInvalidBQLValue, name)
+			}
+			value = d
+		}
+		return formatBQLValue(value)
+	})
+}
+
+func bindBQLParams(bql string, bind func(name string) (string, error)) (string, error) {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(bql); i++ {
+		ch := bql[i]
+		if quote != 0 {
+			if ch == quote {
+				quote = 0
+			}
+			sb.WriteByte(ch)
+			continue
+		}
+		if ch == '\'' || ch == '"' {
+			quote = ch
+		}
+		// 前一个字符为标识符时不是参数，如 Assets:Bank
+		if ch == ':' && (i == 0 || !isBQLIdentChar(bql[i-1])) {
+			if match := bqlParamRegexp.FindStringSubmatch(bql[i:]); match != nil {
+				value, err := bind(match[1])
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString(value)
+				i += len(match[0]) - 1
+				continue
+			}
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String(), nil
+}
+
+func isBQLIdentChar(ch byte) bool {
+	return ch == '_' || isDigit(ch) || (ch|0x20 >= 'a' && ch|0x20 <= 'z')
+}
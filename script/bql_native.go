@@ -0,0 +1,1721 @@
+package script
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// 原生 BQL 引擎：在内存账本上执行 bean-query 语法的一个子集，不支持的语法返回 ErrUnsupportedSyntax
+
+type bqlToken struct {
+	Kind string
+	Text string
+	Pos  int
+}
+
+var bqlDateRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+
+func lexBQL(text string) ([]bqlToken, error) {
+	tokens := make([]bqlToken, 0)
+	i := 0
+	for i < len(text) {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(text[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, bqlToken{Kind: "string", Text: text[i+1 : i+1+end], Pos: i})
+			i += end + 2
+		case isDigit(ch):
+			if m := bqlDateRegexp.FindString(text[i:]); m != "" {
+				tokens = append(tokens, bqlToken{Kind: "date", Text: m, Pos: i})
+				i += len(m)
+				continue
+			}
+			j := i
+			for j < len(text) && (isDigit(text[j]) || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, bqlToken{Kind: "number", Text: text[i:j], Pos: i})
+			i = j
+		case ch == '_' || (ch|0x20 >= 'a' && ch|0x20 <= 'z'):
+			j := i
+			for j < len(text) && (text[j] == '_' || isDigit(text[j]) || (text[j]|0x20 >= 'a' && text[j]|0x20 <= 'z')) {
+				j++
+			}
+			tokens = append(tokens, bqlToken{Kind: "ident", Text: text[i:j], Pos: i})
+			i = j
+		default:
+			op := string(ch)
+			if i+1 < len(text) {
+				two := text[i : i+2]
+				if two == "!=" || two == "<=" || two == ">=" || two == "!~" {
+					op = two
+				}
+			}
+			if !strings.Contains("(),*=<>~+-/;!", string(ch)) {
+				return nil, fmt.Errorf("unexpected character '%c' at %d", ch, i)
+			}
+			tokens = append(tokens, bqlToken{Kind: "op", Text: op, Pos: i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, bqlToken{Kind: "eof", Pos: len(text)})
+	return tokens, nil
+}
+
+type bqlExpr struct {
+	Op    string
+	Name  string
+	Value interface{}
+	Args  []*bqlExpr
+}
+
+type bqlTarget struct {
+	Expr *bqlExpr
+	Name string
+}
+
+type bqlOrder struct {
+	Expr *bqlExpr
+	Desc bool
+}
+
+type bqlStatement struct {
+	Kind     string
+	Distinct bool
+	Targets  []bqlTarget
+	From     *bqlExpr
+	Where    *bqlExpr
+	GroupBy  []*bqlExpr
+	Having   *bqlExpr
+	OrderBy  []bqlOrder
+	Limit    int
+}
+
+type bqlParser struct {
+	tokens []bqlToken
+	pos    int
+}
+
+func parseBQL(text string) (*bqlStatement, error) {
+	tokens, err := lexBQL(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &bqlParser{tokens: tokens}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptOp(";")
+	if t := p.peek(); t.Kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s' at %d", t.Text, t.Pos)
+	}
+	return stmt, nil
+}
+
+func (p *bqlParser) peek() bqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *bqlParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.Kind == "ident" && strings.EqualFold(t.Text, keyword)
+}
+
+func (p *bqlParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *bqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		t := p.peek()
+		return fmt.Errorf("expected %s at %d", strings.ToUpper(keyword), t.Pos)
+	}
+	return nil
+}
+
+func (p *bqlParser) acceptOp(op string) bool {
+	t := p.peek()
+	if t.Kind == "op" && t.Text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *bqlParser) parseStatement() (*bqlStatement, error) {
+	stmt := &bqlStatement{Limit: -1}
+	switch {
+	case p.acceptKeyword("select"):
+		stmt.Kind = "select"
+	case p.acceptKeyword("print"):
+		stmt.Kind = "print"
+		if p.acceptKeyword("from") {
+			from, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.From = from
+		}
+		return stmt, nil
+	case p.acceptKeyword("balances"):
+		return p.parseBalances(stmt)
+	case p.acceptKeyword("journal"):
+		return p.parseJournal(stmt)
+	default:
+		return nil, fmt.Errorf("%w: statement '%s'", ErrUnsupportedSyntax, p.peek().Text)
+	}
+	stmt.Distinct = p.acceptKeyword("distinct")
+	if p.acceptOp("*") {
+		for _, name := range []string{"date", "flag", "payee", "narration", "account", "position"} {
+			stmt.Targets = append(stmt.Targets, bqlTarget{Expr: &bqlExpr{Op: "column", Name: name}, Name: name})
+		}
+	} else {
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			target := bqlTarget{Expr: expr}
+			if p.acceptKeyword("as") {
+				t := p.peek()
+				if t.Kind != "ident" {
+					return nil, fmt.Errorf("expected alias at %d", t.Pos)
+				}
+				p.pos++
+				target.Name = t.Text
+			} else {
+				target.Name = expr.columnName()
+			}
+			stmt.Targets = append(stmt.Targets, target)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if err := p.parseFromWhere(stmt); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("group") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, expr)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+		if p.acceptKeyword("having") {
+			having, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Having = having
+		}
+	}
+	if p.acceptKeyword("order") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			order := bqlOrder{Expr: expr}
+			if p.acceptKeyword("desc") {
+				order.Desc = true
+			} else {
+				p.acceptKeyword("asc")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, order)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if p.isKeyword("pivot") {
+		return nil, fmt.Errorf("%w: PIVOT BY", ErrUnsupportedSyntax)
+	}
+	if p.acceptKeyword("limit") {
+		t := p.peek()
+		if t.Kind != "number" {
+			return nil, fmt.Errorf("expected number at %d", t.Pos)
+		}
+		p.pos++
+		limit, err := strconv.Atoi(t.Text)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Limit = limit
+	}
+	return stmt, nil
+}
+
+func (p *bqlParser) parseFromWhere(stmt *bqlStatement) error {
+	if p.acceptKeyword("from") {
+		if p.isKeyword("open") || p.isKeyword("close") || p.isKeyword("clear") {
+			return fmt.Errorf("%w: FROM %s", ErrUnsupportedSyntax, strings.ToUpper(p.peek().Text))
+		}
+		from, err := p.parseExpr()
+		if err != nil {
+			return err
+		}
+		stmt.From = from
+	}
+	if p.acceptKeyword("where") {
+		where, err := p.parseExpr()
+		if err != nil {
+			return err
+		}
+		stmt.Where = where
+	}
+	return nil
+}
+
+// parseBalances BALANCES [FROM ...] [WHERE ...]，等价于按账户汇总 position
+func (p *bqlParser) parseBalances(stmt *bqlStatement) (*bqlStatement, error) {
+	stmt.Kind = "select"
+	if p.isKeyword("at") {
+		return nil, fmt.Errorf("%w: BALANCES AT", ErrUnsupportedSyntax)
+	}
+	account := &bqlExpr{Op: "column", Name: "account"}
+	sum := &bqlExpr{Op: "call", Name: "sum", Args: []*bqlExpr{{Op: "column", Name: "position"}}}
+	stmt.Targets = []bqlTarget{{Expr: account, Name: "account"}, {Expr: sum, Name: sum.columnName()}}
+	stmt.GroupBy = []*bqlExpr{account}
+	stmt.OrderBy = []bqlOrder{{Expr: account}}
+	if err := p.parseFromWhere(stmt); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseJournal JOURNAL ['account regexp'] [FROM ...]，输出账户的流水和余额
+func (p *bqlParser) parseJournal(stmt *bqlStatement) (*bqlStatement, error) {
+	stmt.Kind = "select"
+	for _, name := range []string{"date", "flag", "description", "position", "balance"} {
+		stmt.Targets = append(stmt.Targets, bqlTarget{Expr: &bqlExpr{Op: "column", Name: name}, Name: name})
+	}
+	if t := p.peek(); t.Kind == "string" {
+		p.pos++
+		stmt.Where = &bqlExpr{Op: "~", Args: []*bqlExpr{{Op: "column", Name: "account"}, {Op: "literal", Value: t.Text}}}
+	}
+	if p.isKeyword("at") {
+		return nil, fmt.Errorf("%w: JOURNAL AT", ErrUnsupportedSyntax)
+	}
+	if p.acceptKeyword("from") {
+		from, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.From = from
+	}
+	return stmt, nil
+}
+
+func (p *bqlParser) parseExpr() (*bqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &bqlExpr{Op: "or", Args: []*bqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *bqlParser) parseAnd() (*bqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &bqlExpr{Op: "and", Args: []*bqlExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *bqlParser) parseNot() (*bqlExpr, error) {
+	if p.acceptKeyword("not") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &bqlExpr{Op: "not", Args: []*bqlExpr{expr}}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *bqlParser) parseComparison() (*bqlExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.Kind == "op" {
+		switch t.Text {
+		case "=", "!=", "<", "<=", ">", ">=", "~", "!~":
+			p.pos++
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &bqlExpr{Op: t.Text, Args: []*bqlExpr{left, right}}, nil
+		}
+	}
+	if p.acceptKeyword("in") {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &bqlExpr{Op: "in", Args: []*bqlExpr{left, right}}, nil
+	}
+	if p.isKeyword("not") && p.pos+1 < len(p.tokens) && strings.EqualFold(p.tokens[p.pos+1].Text, "in") {
+		p.pos += 2
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &bqlExpr{Op: "not", Args: []*bqlExpr{{Op: "in", Args: []*bqlExpr{left, right}}}}, nil
+	}
+	if p.acceptKeyword("is") {
+		negate := p.acceptKeyword("not")
+		if err := p.expectKeyword("null"); err != nil {
+			return nil, err
+		}
+		expr := &bqlExpr{Op: "isnull", Args: []*bqlExpr{left}}
+		if negate {
+			expr = &bqlExpr{Op: "not", Args: []*bqlExpr{expr}}
+		}
+		return expr, nil
+	}
+	return left, nil
+}
+
+func (p *bqlParser) parseAdditive() (*bqlExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.Kind != "op" || (t.Text != "+" && t.Text != "-") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &bqlExpr{Op: t.Text, Args: []*bqlExpr{left, right}}
+	}
+}
+
+func (p *bqlParser) parseMultiplicative() (*bqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.Kind != "op" || (t.Text != "*" && t.Text != "/") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &bqlExpr{Op: t.Text, Args: []*bqlExpr{left, right}}
+	}
+}
+
+func (p *bqlParser) parseUnary() (*bqlExpr, error) {
+	if p.acceptOp("-") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &bqlExpr{Op: "call", Name: "neg", Args: []*bqlExpr{expr}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *bqlParser) parsePrimary() (*bqlExpr, error) {
+	t := p.peek()
+	switch t.Kind {
+	case "string":
+		p.pos++
+		return &bqlExpr{Op: "literal", Value: t.Text}, nil
+	case "date":
+		p.pos++
+		return &bqlExpr{Op: "literal", Value: bqlDate(t.Text)}, nil
+	case "number":
+		p.pos++
+		if !strings.Contains(t.Text, ".") {
+			n, err := strconv.ParseInt(t.Text, 10, 64)
+			if err == nil {
+				return &bqlExpr{Op: "literal", Value: n}, nil
+			}
+		}
+		d, err := decimal.NewFromString(t.Text)
+		if err != nil {
+			return nil, err
+		}
+		return &bqlExpr{Op: "literal", Value: d}, nil
+	case "op":
+		if p.acceptOp("(") {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.acceptOp(")") {
+				return nil, fmt.Errorf("expected ')' at %d", p.peek().Pos)
+			}
+			return expr, nil
+		}
+	case "ident":
+		p.pos++
+		switch strings.ToLower(t.Text) {
+		case "true":
+			return &bqlExpr{Op: "literal", Value: true}, nil
+		case "false":
+			return &bqlExpr{Op: "literal", Value: false}, nil
+		case "null":
+			return &bqlExpr{Op: "literal", Value: nil}, nil
+		}
+		if p.acceptOp("(") {
+			call := &bqlExpr{Op: "call", Name: strings.ToLower(t.Text)}
+			if !p.acceptOp(")") {
+				for {
+					if p.acceptOp("*") {
+						call.Args = append(call.Args, &bqlExpr{Op: "literal", Value: int64(1)})
+					} else {
+						arg, err := p.parseExpr()
+						if err != nil {
+							return nil, err
+						}
+						call.Args = append(call.Args, arg)
+					}
+					if p.acceptOp(")") {
+						break
+					}
+					if !p.acceptOp(",") {
+						return nil, fmt.Errorf("expected ',' at %d", p.peek().Pos)
+					}
+				}
+			}
+			return call, nil
+		}
+		return &bqlExpr{Op: "column", Name: strings.ToLower(t.Text)}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s' at %d", t.Text, t.Pos)
+}
+
+// columnName 未指定别名时的列名，与 bean-query 的命名方式类似
+func (e *bqlExpr) columnName() string {
+	switch e.Op {
+	case "column":
+		return e.Name
+	case "call":
+		parts := []string{e.Name}
+		for _, arg := range e.Args {
+			if name := arg.columnName(); name != "" {
+				parts = append(parts, name)
+			}
+		}
+		return strings.Join(parts, "_")
+	case "literal":
+		return ""
+	}
+	parts := make([]string, 0)
+	for _, arg := range e.Args {
+		if name := arg.columnName(); name != "" {
+			parts = append(parts, name)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+var bqlAggregates = map[string]bool{"sum": true, "count": true, "first": true, "last": true, "min": true, "max": true}
+
+func (e *bqlExpr) isAggregate() bool {
+	if e.Op == "call" && bqlAggregates[e.Name] {
+		return true
+	}
+	for _, arg := range e.Args {
+		if arg.isAggregate() {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *bqlExpr) collectAggregates(result []*bqlExpr) []*bqlExpr {
+	if e.Op == "call" && bqlAggregates[e.Name] {
+		return append(result, e)
+	}
+	for _, arg := range e.Args {
+		result = arg.collectAggregates(result)
+	}
+	return result
+}
+
+func (e *bqlExpr) references(column string) bool {
+	if e.Op == "column" && e.Name == column {
+		return true
+	}
+	for _, arg := range e.Args {
+		if arg.references(column) {
+			return true
+		}
+	}
+	return false
+}
+
+type bqlDate string
+
+type bqlRow struct {
+	entry   *Entry
+	posting *Posting
+	balance *Inventory
+}
+
+type bqlContext struct {
+	ledger     *Ledger
+	row        *bqlRow
+	aggregates map[*bqlExpr]interface{}
+}
+
+// bqlResult 查询结果表
+type bqlResult struct {
+	Columns []string
+	Rows    [][]interface{}
+	// PRINT 语句的结果，每行是一条指令文本
+	print bool
+}
+
+// queryLedger 在内存账本上执行 BQL
+func queryLedger(ledger *Ledger, bql string) (*bqlResult, error) {
+	stmt, err := parseBQL(bql)
+	if err != nil {
+		if !strings.Contains(err.Error(), ErrUnsupportedSyntax.Error()) {
+			err = fmt.Errorf("%w: %s", ErrUnsupportedSyntax, err.Error())
+		}
+		return nil, err
+	}
+	if stmt.Kind == "print" {
+		return ledger.executePrint(stmt)
+	}
+	return ledger.executeSelect(stmt)
+}
+
+func (l *Ledger) executePrint(stmt *bqlStatement) (*bqlResult, error) {
+	result := &bqlResult{Columns: []string{"entry"}, print: true}
+	for _, entry := range l.Entries {
+		if stmt.From != nil {
+			ctx := &bqlContext{ledger: l, row: &bqlRow{entry: entry}}
+			ok, err := ctx.truthy(stmt.From)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		result.Rows = append(result.Rows, []interface{}{l.formatEntry(entry)})
+	}
+	return result, nil
+}
+
+// formatEntry 输出指令文本，源文件中存在的指令直接使用原文
+func (l *Ledger) formatEntry(entry *Entry) string {
+	if !entry.synthetic && entry.RawText != "" {
+		return entry.RawText
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s \"%s\"", entry.Date, entry.Flag, entry.Narration))
+	for _, posting := range entry.Postings {
+		sb.WriteString(fmt.Sprintf("\n  %s  %s", posting.Account, l.renderValue(Amount{Number: *posting.Number, Currency: posting.Currency})))
+	}
+	return sb.String()
+}
+
+type bqlResultRow struct {
+	values []interface{}
+	keys   []interface{}
+}
+
+func (l *Ledger) executeSelect(stmt *bqlStatement) (*bqlResult, error) {
+	needBalance := false
+	aggregated := len(stmt.GroupBy) > 0
+	for _, target := range stmt.Targets {
+		if target.Expr.references("balance") {
+			needBalance = true
+		}
+		if target.Expr.isAggregate() {
+			aggregated = true
+		}
+	}
+	for _, order := range stmt.OrderBy {
+		if order.Expr.references("balance") {
+			needBalance = true
+		}
+	}
+
+	// 逐条过账筛选
+	rows := make([]*bqlRow, 0)
+	balance := &Inventory{}
+	for _, entry := range l.Entries {
+		if entry.Type != "txn" {
+			continue
+		}
+		if stmt.From != nil {
+			ctx := &bqlContext{ledger: l, row: &bqlRow{entry: entry}}
+			ok, err := ctx.truthy(stmt.From)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		for i := range entry.Postings {
+			posting := &entry.Postings[i]
+			if posting.Number == nil {
+				continue
+			}
+			row := &bqlRow{entry: entry, posting: posting}
+			if stmt.Where != nil {
+				ctx := &bqlContext{ledger: l, row: row}
+				ok, err := ctx.truthy(stmt.Where)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			if needBalance {
+				balance.Add(Position{Units: Amount{Number: *posting.Number, Currency: posting.Currency}, Cost: posting.Cost})
+				row.balance = balance.Clone()
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	var resultRows []bqlResultRow
+	var err error
+	if aggregated {
+		resultRows, err = l.aggregateRows(stmt, rows)
+	} else {
+		resultRows = make([]bqlResultRow, 0, len(rows))
+		for _, row := range rows {
+			ctx := &bqlContext{ledger: l, row: row}
+			resultRow, e := ctx.evalResultRow(stmt)
+			if e != nil {
+				return nil, e
+			}
+			resultRows = append(resultRows, resultRow)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stmt.OrderBy) > 0 {
+		sort.SliceStable(resultRows, func(i, j int) bool {
+			for k, order := range stmt.OrderBy {
+				c := compareBQLValues(resultRows[i].keys[k], resultRows[j].keys[k])
+				if c == 0 {
+					continue
+				}
+				if order.Desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+
+	result := &bqlResult{Columns: make([]string, 0, len(stmt.Targets))}
+	for _, target := range stmt.Targets {
+		result.Columns = append(result.Columns, target.Name)
+	}
+	seen := make(map[string]bool)
+	for _, row := range resultRows {
+		if stmt.Distinct {
+			key := l.renderRowKey(row.values)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		if stmt.Limit >= 0 && len(result.Rows) >= stmt.Limit {
+			break
+		}
+		result.Rows = append(result.Rows, row.values)
+	}
+	return result, nil
+}
+
+func (l *Ledger) renderRowKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = l.renderValue(v)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (ctx *bqlContext) evalResultRow(stmt *bqlStatement) (bqlResultRow, error) {
+	row := bqlResultRow{values: make([]interface{}, len(stmt.Targets))}
+	for i, target := range stmt.Targets {
+		v, err := ctx.eval(target.Expr)
+		if err != nil {
+			return row, err
+		}
+		row.values[i] = v
+	}
+	for _, order := range stmt.OrderBy {
+		if idx := stmt.targetIndex(order.Expr); idx >= 0 {
+			row.keys = append(row.keys, row.values[idx])
+			continue
+		}
+		v, err := ctx.eval(order.Expr)
+		if err != nil {
+			return row, err
+		}
+		row.keys = append(row.keys, v)
+	}
+	return row, nil
+}
+
+// targetIndex 查找 GROUP BY/ORDER BY 引用的目标列（别名、列序号）
+func (stmt *bqlStatement) targetIndex(expr *bqlExpr) int {
+	if expr.Op == "literal" {
+		if n, ok := expr.Value.(int64); ok && n >= 1 && int(n) <= len(stmt.Targets) {
+			return int(n) - 1
+		}
+	}
+	if expr.Op == "column" {
+		for i, target := range stmt.Targets {
+			if strings.EqualFold(target.Name, expr.Name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (l *Ledger) aggregateRows(stmt *bqlStatement, rows []*bqlRow) ([]bqlResultRow, error) {
+	groupExprs := make([]*bqlExpr, 0)
+	if len(stmt.GroupBy) > 0 {
+		for _, expr := range stmt.GroupBy {
+			if idx := stmt.targetIndex(expr); idx >= 0 {
+				expr = stmt.Targets[idx].Expr
+			}
+			groupExprs = append(groupExprs, expr)
+		}
+	} else {
+		for _, target := range stmt.Targets {
+			if !target.Expr.isAggregate() {
+				groupExprs = append(groupExprs, target.Expr)
+			}
+		}
+	}
+	aggregates := make([]*bqlExpr, 0)
+	for _, target := range stmt.Targets {
+		aggregates = target.Expr.collectAggregates(aggregates)
+	}
+	for _, order := range stmt.OrderBy {
+		aggregates = order.Expr.collectAggregates(aggregates)
+	}
+	if stmt.Having != nil {
+		aggregates = stmt.Having.collectAggregates(aggregates)
+	}
+
+	type group struct {
+		rows []*bqlRow
+	}
+	groups := make(map[string]*group)
+	order := make([]string, 0)
+	for _, row := range rows {
+		ctx := &bqlContext{ledger: l, row: row}
+		keyValues := make([]interface{}, len(groupExprs))
+		for i, expr := range groupExprs {
+			v, err := ctx.eval(expr)
+			if err != nil {
+				return nil, err
+			}
+			keyValues[i] = v
+		}
+		key := l.renderRowKey(keyValues)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.rows = append(g.rows, row)
+	}
+	// 无分组列且没有数据时，聚合结果为一行空值
+	if len(groupExprs) == 0 && len(rows) == 0 {
+		return []bqlResultRow{}, nil
+	}
+
+	result := make([]bqlResultRow, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		values := make(map[*bqlExpr]interface{})
+		for _, agg := range aggregates {
+			v, err := l.evalAggregate(agg, g.rows)
+			if err != nil {
+				return nil, err
+			}
+			values[agg] = v
+		}
+		ctx := &bqlContext{ledger: l, row: g.rows[0], aggregates: values}
+		if stmt.Having != nil {
+			ok, err := ctx.truthy(stmt.Having)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		resultRow, err := ctx.evalResultRow(stmt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, resultRow)
+	}
+	return result, nil
+}
+
+func (l *Ledger) evalAggregate(agg *bqlExpr, rows []*bqlRow) (interface{}, error) {
+	if len(agg.Args) != 1 {
+		return nil, fmt.Errorf("%s() takes exactly one argument", agg.Name)
+	}
+	if agg.Name == "count" {
+		return int64(len(rows)), nil
+	}
+	var acc interface{}
+	for i, row := range rows {
+		ctx := &bqlContext{ledger: l, row: row}
+		v, err := ctx.eval(agg.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch agg.Name {
+		case "first":
+			if i == 0 {
+				acc = v
+			}
+		case "last":
+			acc = v
+		case "min":
+			if v != nil && (acc == nil || compareBQLValues(v, acc) < 0) {
+				acc = v
+			}
+		case "max":
+			if v != nil && (acc == nil || compareBQLValues(v, acc) > 0) {
+				acc = v
+			}
+		case "sum":
+			acc, err = sumBQLValues(acc, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return acc, nil
+}
+
+func sumBQLValues(acc interface{}, v interface{}) (interface{}, error) {
+	if v == nil {
+		return acc, nil
+	}
+	switch value := v.(type) {
+	case int64:
+		if acc == nil {
+			return value, nil
+		}
+		if a, ok := acc.(int64); ok {
+			return a + value, nil
+		}
+		return toDecimal(acc).Add(decimal.NewFromInt(value)), nil
+	case decimal.Decimal:
+		if acc == nil {
+			return value, nil
+		}
+		return toDecimal(acc).Add(value), nil
+	case Amount, Position, *Inventory:
+		inv, ok := acc.(*Inventory)
+		if !ok {
+			inv = &Inventory{}
+		}
+		switch x := value.(type) {
+		case Amount:
+			inv.Add(Position{Units: x})
+		case Position:
+			inv.Add(x)
+		case *Inventory:
+			inv.AddInventory(x)
+		}
+		return inv, nil
+	}
+	return nil, fmt.Errorf("%w: sum() of %T", ErrUnsupportedSyntax, v)
+}
+
+func toDecimal(v interface{}) decimal.Decimal {
+	switch value := v.(type) {
+	case int64:
+		return decimal.NewFromInt(value)
+	case decimal.Decimal:
+		return value
+	}
+	return decimal.Zero
+}
+
+func (ctx *bqlContext) truthy(expr *bqlExpr) (bool, error) {
+	v, err := ctx.eval(expr)
+	if err != nil {
+		return false, err
+	}
+	return isTruthy(v), nil
+}
+
+func isTruthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case int64:
+		return value != 0
+	case decimal.Decimal:
+		return !value.IsZero()
+	case []string:
+		return len(value) > 0
+	}
+	return true
+}
+
+func (ctx *bqlContext) eval(expr *bqlExpr) (interface{}, error) {
+	switch expr.Op {
+	case "literal":
+		return expr.Value, nil
+	case "column":
+		return ctx.column(expr.Name)
+	case "call":
+		if bqlAggregates[expr.Name] {
+			v, ok := ctx.aggregates[expr]
+			if !ok {
+				return nil, fmt.Errorf("aggregate %s() is not allowed here", expr.Name)
+			}
+			return v, nil
+		}
+		args := make([]interface{}, len(expr.Args))
+		for i, arg := range expr.Args {
+			v, err := ctx.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		return ctx.call(expr.Name, args)
+	case "and":
+		left, err := ctx.truthy(expr.Args[0])
+		if err != nil || !left {
+			return false, err
+		}
+		return ctx.truthy(expr.Args[1])
+	case "or":
+		left, err := ctx.truthy(expr.Args[0])
+		if err != nil || left {
+			return left, err
+		}
+		return ctx.truthy(expr.Args[1])
+	case "not":
+		v, err := ctx.truthy(expr.Args[0])
+		return !v, err
+	case "isnull":
+		v, err := ctx.eval(expr.Args[0])
+		return v == nil, err
+	}
+	left, err := ctx.eval(expr.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := ctx.eval(expr.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	switch expr.Op {
+	case "=":
+		return left != nil && right != nil && compareBQLValues(left, right) == 0, nil
+	case "!=":
+		return left != nil && right != nil && compareBQLValues(left, right) != 0, nil
+	case "<":
+		return left != nil && right != nil && compareBQLValues(left, right) < 0, nil
+	case "<=":
+		return left != nil && right != nil && compareBQLValues(left, right) <= 0, nil
+	case ">":
+		return left != nil && right != nil && compareBQLValues(left, right) > 0, nil
+	case ">=":
+		return left != nil && right != nil && compareBQLValues(left, right) >= 0, nil
+	case "~", "!~":
+		pattern, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid regular expression %v", right)
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: regular expression %s", ErrUnsupportedSyntax, pattern)
+		}
+		matched := left != nil && re.MatchString(bqlValueString(left))
+		if expr.Op == "!~" {
+			return !matched, nil
+		}
+		return matched, nil
+	case "in":
+		switch container := right.(type) {
+		case []string:
+			for _, s := range container {
+				if s == bqlValueString(left) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case string:
+			return left != nil && strings.Contains(container, bqlValueString(left)), nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("%w: IN %T", ErrUnsupportedSyntax, right)
+	case "+", "-", "*", "/":
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return arithmeticBQLValues(expr.Op, left, right)
+	}
+	return nil, fmt.Errorf("%w: operator %s", ErrUnsupportedSyntax, expr.Op)
+}
+
+func arithmeticBQLValues(op string, left interface{}, right interface{}) (interface{}, error) {
+	l, lok := left.(int64)
+	r, rok := right.(int64)
+	if lok && rok && op != "/" {
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		}
+	}
+	if a, ok := left.(Amount); ok {
+		n := toDecimal(right)
+		switch op {
+		case "*":
+			return Amount{Number: a.Number.Mul(n), Currency: a.Currency}, nil
+		case "/":
+			if n.IsZero() {
+				return nil, nil
+			}
+			return Amount{Number: a.Number.DivRound(n, 16), Currency: a.Currency}, nil
+		}
+		return nil, fmt.Errorf("%w: amount %s", ErrUnsupportedSyntax, op)
+	}
+	a, b := toDecimal(left), toDecimal(right)
+	switch op {
+	case "+":
+		return a.Add(b), nil
+	case "-":
+		return a.Sub(b), nil
+	case "*":
+		return a.Mul(b), nil
+	}
+	if b.IsZero() {
+		return nil, nil
+	}
+	return a.DivRound(b, 16), nil
+}
+
+func (ctx *bqlContext) column(name string) (interface{}, error) {
+	row := ctx.row
+	entry := row.entry
+	switch name {
+	case "id":
+		return entry.Id, nil
+	case "type":
+		return entryTypeName(entry.Type), nil
+	case "filename":
+		return entry.FilePath, nil
+	case "lineno":
+		return int64(entry.StartLineNo), nil
+	case "location":
+		return entry.Location(), nil
+	case "date":
+		return bqlDate(entry.Date), nil
+	case "year", "month", "day":
+		return dateComponent(bqlDate(entry.Date), name), nil
+	case "flag":
+		return entry.Flag, nil
+	case "payee":
+		return entry.Payee, nil
+	case "narration":
+		return entry.Narration, nil
+	case "description":
+		return strings.Trim(entry.Payee+" | "+entry.Narration, " |"), nil
+	case "tags":
+		return sortedSet(entry.Tags), nil
+	case "links":
+		return sortedSet(entry.Links), nil
+	}
+	posting := row.posting
+	if posting == nil {
+		return nil, fmt.Errorf("%w: column '%s' in entry context", ErrUnsupportedSyntax, name)
+	}
+	switch name {
+	case "posting_flag":
+		return posting.Flag, nil
+	case "account":
+		return posting.Account, nil
+	case "other_accounts":
+		others := make([]string, 0)
+		for _, p := range entry.Postings {
+			if p.Account != posting.Account {
+				others = appendUnique(others, p.Account)
+			}
+		}
+		return sortedSet(others), nil
+	case "number":
+		return *posting.Number, nil
+	case "currency":
+		return posting.Currency, nil
+	case "cost_number":
+		if posting.Cost == nil {
+			return nil, nil
+		}
+		return posting.Cost.Number, nil
+	case "cost_currency":
+		if posting.Cost == nil {
+			return nil, nil
+		}
+		return posting.Cost.Currency, nil
+	case "cost_date":
+		if posting.Cost == nil {
+			return nil, nil
+		}
+		return bqlDate(posting.Cost.Date), nil
+	case "cost_label":
+		if posting.Cost == nil {
+			return nil, nil
+		}
+		return posting.Cost.Label, nil
+	case "position":
+		return Position{Units: Amount{Number: *posting.Number, Currency: posting.Currency}, Cost: posting.Cost}, nil
+	case "price":
+		if posting.Price == nil || posting.Price.Number == nil {
+			return nil, nil
+		}
+		number := *posting.Price.Number
+		if posting.Price.Total && !posting.Number.IsZero() {
+			number = number.DivRound(posting.Number.Abs(), 16)
+		}
+		return Amount{Number: number, Currency: posting.Price.Currency}, nil
+	case "weight":
+		weight, _ := PostingWeight(*posting)
+		return weight, nil
+	case "balance":
+		if row.balance == nil {
+			return &Inventory{}, nil
+		}
+		return row.balance, nil
+	}
+	return nil, fmt.Errorf("%w: column '%s'", ErrUnsupportedSyntax, name)
+}
+
+func entryTypeName(typ string) string {
+	if typ == "txn" {
+		return "transaction"
+	}
+	return typ
+}
+
+func sortedSet(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
+
+func dateComponent(date bqlDate, name string) interface{} {
+	parts := strings.Split(string(date), "-")
+	if len(parts) != 3 {
+		return nil
+	}
+	idx := map[string]int{"year": 0, "month": 1, "day": 2}[name]
+	n, err := strconv.ParseInt(parts[idx], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+func (ctx *bqlContext) call(name string, args []interface{}) (interface{}, error) {
+	argc := func(n ...int) error {
+		for _, c := range n {
+			if len(args) == c {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid number of arguments for %s()", name)
+	}
+	switch name {
+	case "year", "month", "day":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		d, ok := args[0].(bqlDate)
+		if !ok {
+			return nil, nil
+		}
+		return dateComponent(d, name), nil
+	case "root":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		account, _ := args[0].(string)
+		n := int(toDecimal(args[1]).IntPart())
+		parts := strings.Split(account, ":")
+		if n < len(parts) {
+			parts = parts[:n]
+		}
+		return strings.Join(parts, ":"), nil
+	case "parent":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		account, _ := args[0].(string)
+		if idx := strings.LastIndex(account, ":"); idx >= 0 {
+			return account[:idx], nil
+		}
+		return nil, nil
+	case "leaf":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		account, _ := args[0].(string)
+		return GetAccountName(account), nil
+	case "neg":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		return negateBQLValue(args[0]), nil
+	case "abs":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case int64:
+			if v < 0 {
+				return -v, nil
+			}
+			return v, nil
+		case decimal.Decimal:
+			return v.Abs(), nil
+		case Amount:
+			return Amount{Number: v.Number.Abs(), Currency: v.Currency}, nil
+		}
+		return args[0], nil
+	case "str":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		return ctx.ledger.renderValue(args[0]), nil
+	case "length":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case string:
+			return int64(len([]rune(v))), nil
+		case []string:
+			return int64(len(v)), nil
+		}
+		return nil, nil
+	case "upper", "lower":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		s, _ := args[0].(string)
+		if name == "upper" {
+			return strings.ToUpper(s), nil
+		}
+		return strings.ToLower(s), nil
+	case "joinstr":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		set, _ := args[0].([]string)
+		return strings.Join(set, ","), nil
+	case "units":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		return mapPositions(args[0], func(p Position) interface{} { return p.Units }), nil
+	case "cost":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		return mapPositions(args[0], func(p Position) interface{} {
+			if p.Cost == nil {
+				return p.Units
+			}
+			return Amount{Number: p.Units.Number.Mul(p.Cost.Number), Currency: p.Cost.Currency}
+		}), nil
+	case "value":
+		if err := argc(1, 2); err != nil {
+			return nil, err
+		}
+		date := ""
+		if len(args) == 2 {
+			d, _ := args[1].(bqlDate)
+			date = string(d)
+		}
+		return mapPositions(args[0], func(p Position) interface{} { return ctx.ledger.positionValue(p, date) }), nil
+	case "convert":
+		if err := argc(2, 3); err != nil {
+			return nil, err
+		}
+		currency, _ := args[1].(string)
+		date := ""
+		if len(args) == 3 {
+			d, _ := args[2].(bqlDate)
+			date = string(d)
+		}
+		return mapPositions(args[0], func(p Position) interface{} { return ctx.ledger.convertPosition(p, currency, date) }), nil
+	case "number":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		if a, ok := args[0].(Amount); ok {
+			return a.Number, nil
+		}
+		return nil, nil
+	case "currency":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		if a, ok := args[0].(Amount); ok {
+			return a.Currency, nil
+		}
+		return nil, nil
+	case "only":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		currency, _ := args[0].(string)
+		inv, ok := args[1].(*Inventory)
+		if !ok {
+			return nil, nil
+		}
+		return Amount{Number: inv.Units(currency), Currency: currency}, nil
+	case "getprice":
+		if err := argc(2, 3); err != nil {
+			return nil, err
+		}
+		base, _ := args[0].(string)
+		quote, _ := args[1].(string)
+		date := ""
+		if len(args) == 3 {
+			d, _ := args[2].(bqlDate)
+			date = string(d)
+		}
+		if price, ok := ctx.ledger.GetPrice(base, quote, date); ok {
+			return price, nil
+		}
+		return nil, nil
+	case "meta", "entry_meta", "any_meta":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		key, _ := args[0].(string)
+		var value interface{}
+		if name != "entry_meta" && ctx.row.posting != nil {
+			value = ctx.row.posting.Meta[key]
+		}
+		if value == nil && name != "meta" {
+			value = ctx.row.entry.Meta[key]
+		}
+		return value, nil
+	case "coalesce":
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: function %s()", ErrUnsupportedSyntax, name)
+}
+
+func negateBQLValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int64:
+		return -value
+	case decimal.Decimal:
+		return value.Neg()
+	case Amount:
+		return Amount{Number: value.Number.Neg(), Currency: value.Currency}
+	case Position:
+		return Position{Units: Amount{Number: value.Units.Number.Neg(), Currency: value.Units.Currency}, Cost: value.Cost}
+	case *Inventory:
+		inv := &Inventory{}
+		for _, p := range value.Positions {
+			inv.Add(negateBQLValue(p).(Position))
+		}
+		return inv
+	}
+	return v
+}
+
+// mapPositions 对 Amount/Position/Inventory 中的每个持仓做转换，Inventory 的结果会重新汇总
+func mapPositions(v interface{}, fn func(Position) interface{}) interface{} {
+	switch value := v.(type) {
+	case Amount:
+		return fn(Position{Units: value})
+	case Position:
+		return fn(value)
+	case *Inventory:
+		inv := &Inventory{}
+		for _, p := range value.Positions {
+			switch converted := fn(p).(type) {
+			case Amount:
+				inv.Add(Position{Units: converted})
+			case Position:
+				inv.Add(converted)
+			}
+		}
+		return inv
+	}
+	return nil
+}
+
+// positionValue 按最新价格计算持仓市值，没有价格时返回数量本身
+func (l *Ledger) positionValue(p Position, date string) interface{} {
+	if p.Cost != nil && p.Cost.Currency != "" {
+		if price, ok := l.GetPrice(p.Units.Currency, p.Cost.Currency, date); ok {
+			return Amount{Number: p.Units.Number.Mul(price), Currency: p.Cost.Currency}
+		}
+	}
+	return p.Units
+}
+
+// convertPosition 将持仓换算为目标货币，直接汇率不存在时尝试经由成本货币中转
+func (l *Ledger) convertPosition(p Position, currency string, date string) interface{} {
+	units := p.Units
+	if price, ok := l.GetPrice(units.Currency, currency, date); ok {
+		return Amount{Number: units.Number.Mul(price), Currency: currency}
+	}
+	if p.Cost != nil && p.Cost.Currency != "" && p.Cost.Currency != currency {
+		if rate1, ok := l.GetPrice(units.Currency, p.Cost.Currency, date); ok {
+			if rate2, ok := l.GetPrice(p.Cost.Currency, currency, date); ok {
+				return Amount{Number: units.Number.Mul(rate1).Mul(rate2), Currency: currency}
+			}
+		}
+	}
+	return units
+}
+
+func compareBQLValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	switch x := a.(type) {
+	case int64, decimal.Decimal:
+		switch b.(type) {
+		case int64, decimal.Decimal:
+			return toDecimal(x).Cmp(toDecimal(b))
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	case Amount:
+		if y, ok := b.(Amount); ok {
+			if x.Currency != y.Currency {
+				return strings.Compare(x.Currency, y.Currency)
+			}
+			return x.Number.Cmp(y.Number)
+		}
+	}
+	return strings.Compare(bqlValueString(a), bqlValueString(b))
+}
+
+func bqlValueString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case bqlDate:
+		return string(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case decimal.Decimal:
+		return value.String()
+	case bool:
+		if value {
+			return "TRUE"
+		}
+		return "FALSE"
+	case []string:
+		return strings.Join(value, ",")
+	case Amount:
+		return value.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// renderValue 按账本推断的显示精度输出查询结果的值
+func (l *Ledger) renderValue(v interface{}) string {
+	switch value := v.(type) {
+	case Amount:
+		return l.renderNumber(value.Number, value.Currency) + " " + value.Currency
+	case Position:
+		s := l.renderValue(value.Units)
+		if value.Cost != nil {
+			s += " {" + l.renderValue(Amount{Number: value.Cost.Number, Currency: value.Cost.Currency})
+			if value.Cost.Date != "" {
+				s += ", " + value.Cost.Date
+			}
+			if value.Cost.Label != "" {
+				s += ", \"" + value.Cost.Label + "\""
+			}
+			s += "}"
+		}
+		return s
+	case *Inventory:
+		parts := make([]string, 0, len(value.Positions))
+		for _, p := range value.Positions {
+			parts = append(parts, l.renderValue(p))
+		}
+		return strings.Join(parts, ", ")
+	}
+	return bqlValueString(v)
+}
+
+func (l *Ledger) renderNumber(number decimal.Decimal, currency string) string {
+	if precision, ok := l.Precision(currency); ok {
+		return number.StringFixedBank(precision)
+	}
+	return number.String()
+}
+
+// renderText 输出与 bean-query 文本格式一致的表格（表头、分隔线、数据行）
+func (l *Ledger) renderText(result *bqlResult) string {
+	var sb strings.Builder
+	sb.WriteString(strings.Join(result.Columns, "  ") + "\n")
+	separators := make([]string, len(result.Columns))
+	for i, column := range result.Columns {
+		separators[i] = strings.Repeat("-", len(column)+1)
+	}
+	sb.WriteString(strings.Join(separators, "  ") + "\n")
+	for _, row := range result.Rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = strings.ReplaceAll(l.renderValue(v), "\n", " ")
+		}
+		sb.WriteString(strings.Join(cells, "  ") + "\n")
+	}
+	return sb.String()
+}
+
+// QueryText 执行 BQL 并输出 bean-query 格式的文本，PRINT 输出指令原文
+func (l *Ledger) QueryText(bql string) (string, error) {
+	result, err := queryLedger(l, bql)
+	if err != nil {
+		return "", err
+	}
+	if result.print {
+		entries := make([]string, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			entries = append(entries, row[0].(string))
+		}
+		return strings.Join(entries, "\n\n"), nil
+	}
+	return l.renderText(result), nil
+}
+
+// QueryCSV 执行 BQL 并输出 CSV，首行为列名
+func (l *Ledger) QueryCSV(bql string) (string, error) {
+	result, err := queryLedger(l, bql)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err = writer.Write(result.Columns); err != nil {
+		return "", err
+	}
+	for _, row := range result.Rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = l.renderValue(v)
+		}
+		if err = writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
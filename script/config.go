@@ -1,11 +1,13 @@
 package script
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,6 +17,9 @@ var serverSecret string
 var serverConfig Config
 var serverCurrencies []LedgerCurrency
 var ledgerConfigMap map[string]Config
+
+// ledgerConfigMap 的读写锁，定时任务和请求会同时读写
+var ledgerConfigMutex sync.RWMutex
 var ledgerAccountsMap map[string][]Account
 var ledgerAccountTypesMap map[string]map[string]string
 var ledgerCurrencyMap map[string][]LedgerCurrency
@@ -30,6 +35,15 @@ type Config struct {
 	IsBak             bool   `json:"isBak"`
 	OpeningBalances   string `json:"openingBalances"`
 	CreateDate        string `json:"createDate,omitempty"`
+	// QueryBackend 查询后端，为空时使用内存后端并回退到 bean-query、校验使用 bean-check；memory 只使用原生解析器（校验不运行插件）
+	QueryBackend string `json:"queryBackend,omitempty"`
+	// QueryTimeout beancount 子进程超时时间（秒）
+	QueryTimeout int `json:"queryTimeout,omitempty"`
+	// QueryConcurrency 同时运行的 beancount 子进程数上限，仅服务配置有效
+	QueryConcurrency int `json:"queryConcurrency,omitempty"`
+	// IdempotencyRetention 新增交易的 Idempotency-Key 保留时间（小时）
+	IdempotencyRetention int `json:"idempotencyRetention,omitempty"`
+	ctx                  context.Context
 }
 
 type Account struct {
@@ -144,11 +158,20 @@ func UpdateServerConfig(config Config) error {
 	return nil
 }
 
+// GetLedgerConfigMap 返回账本配置的副本，修改后通过 WriteLedgerConfigMap 写回
 func GetLedgerConfigMap() map[string]Config {
-	return ledgerConfigMap
+	ledgerConfigMutex.RLock()
+	defer ledgerConfigMutex.RUnlock()
+	result := make(map[string]Config, len(ledgerConfigMap))
+	for k, v := range ledgerConfigMap {
+		result[k] = v
+	}
+	return result
 }
 
 func GetLedgerConfig(ledgerId string) *Config {
+	ledgerConfigMutex.RLock()
+	defer ledgerConfigMutex.RUnlock()
 	for k, v := range ledgerConfigMap {
 		if k == ledgerId {
 			return &v
@@ -158,6 +181,8 @@ func GetLedgerConfig(ledgerId string) *Config {
 }
 
 func GetLedgerConfigByMail(mail string) *Config {
+	ledgerConfigMutex.RLock()
+	defer ledgerConfigMutex.RUnlock()
 	for _, v := range ledgerConfigMap {
 		if v.Mail == mail {
 			return &v
@@ -270,7 +295,7 @@ func LoadLedgerAccountsMap() error {
 	if ledgerAccountsMap == nil {
 		ledgerAccountsMap = make(map[string][]Account)
 	}
-	for _, config := range ledgerConfigMap {
+	for _, config := range GetLedgerConfigMap() {
 		// 兼容性处理
 		err := handleCompatible(config)
 		if err != nil {
@@ -302,7 +327,10 @@ func handleCompatible(config Config) error {
 }
 
 func LoadLedgerAccounts(ledgerId string) error {
-	config := ledgerConfigMap[ledgerId]
+	var config Config
+	if ledgerConfig := GetLedgerConfig(ledgerId); ledgerConfig != nil {
+		config = *ledgerConfig
+	}
 	// 加载 account_type.json 到缓存（内存）
 	loadErr := LoadLedgerAccountTypesMap(config)
 	if loadErr != nil {
@@ -397,8 +425,10 @@ func LoadLedgerAccountTypesMap(config Config) error {
 }
 
 func WriteLedgerConfigMap(newLedgerConfigMap map[string]Config) error {
+	ledgerConfigMutex.Lock()
+	defer ledgerConfigMutex.Unlock()
 	path := GetServerLedgerConfigFilePath()
-	mapBytes, err := json.Marshal(ledgerConfigMap)
+	mapBytes, err := json.Marshal(newLedgerConfigMap)
 	if err != nil {
 		LogSystemError("Failed marshal ConfigMap")
 		return err
@@ -0,0 +1,88 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 指令原文（首行及缩进的过账、元数据行）的修改，保留其它内容的格式和注释
+
+var ErrInvalidAccount = errors.New("invalid account")
+
+// CheckAccount 账户由冒号分隔，每一段以大写字母、数字或非 ASCII 字符开头
+func CheckAccount(account string) error {
+	if !isBeanAccount(account) {
+		return fmt.Errorf("%w: %s", ErrInvalidAccount, account)
+	}
+	return nil
+}
+
+// isEntryMetaLine 缩进的 key: value 行
+func isEntryMetaLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	i := strings.Index(trimmed, ":")
+	return i > 0 && metaKeyRegexp.MatchString(trimmed[:i]) && (i == len(trimmed)-1 || trimmed[i+1] == ' ')
+}
+
+// postingAccountRange 过账行中账户的位置（可以有 ! * 等标记），不是过账行时返回 -1
+func postingAccountRange(line string) (int, int) {
+	start := len(line) - len(strings.TrimLeft(line, " \t"))
+	if start == 0 || start == len(line) || line[start] == ';' || isEntryMetaLine(line) {
+		return -1, -1
+	}
+	if end := strings.IndexAny(line[start:], " \t"); end == 1 {
+		// 过账的标记
+		start += 1 + len(line[start+1:]) - len(strings.TrimLeft(line[start+1:], " \t"))
+	}
+	end := strings.IndexAny(line[start:], " \t;")
+	if end < 0 {
+		end = len(line) - start
+	}
+	return start, start + end
+}
+
+// ReplaceEntryAccount 将指令中账户为 from 的过账改为 to，返回修改的过账数量
+func ReplaceEntryAccount(lines []string, from string, to string) int {
+	count := 0
+	for i := 1; i < len(lines); i++ {
+		start, end := postingAccountRange(lines[i])
+		if start < 0 || lines[i][start:end] != from {
+			continue
+		}
+		lines[i] = lines[i][:start] + to + lines[i][end:]
+		count++
+	}
+	return count
+}
+
+// SetEntryMeta 设置指令的元数据（首行之后、第一个过账之前的元数据行），value 为 nil 时删除
+func SetEntryMeta(lines []string, key string, value interface{}) ([]string, error) {
+	end := 1
+	index := -1
+	for end < len(lines) {
+		if start, _ := postingAccountRange(lines[end]); start >= 0 {
+			break
+		}
+		if isEntryMetaLine(lines[end]) && strings.HasPrefix(strings.TrimSpace(lines[end]), key+":") {
+			index = end
+		}
+		end++
+	}
+	result := append(make([]string, 0, len(lines)+1), lines...)
+	if value == nil {
+		if index < 0 {
+			return result, CheckMetaKey(key)
+		}
+		return append(result[:index], result[index+1:]...), nil
+	}
+	metaLines, err := FormatMetaLines(map[string]interface{}{key: value}, "  ")
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		result[index] = metaLines[0]
+		return result, nil
+	}
+	return append(result[:end], append(metaLines, result[end:]...)...), nil
+}
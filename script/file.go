@@ -2,14 +2,28 @@ package script
 
 import (
 	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 )
 
+// 每个账本目录一个写锁
+var ledgerWriteLocks sync.Map
+
+// LedgerWriteLock 账本的写锁，新增交易时从校验到写入（及失败时恢复）、修改交易时从读取文件到写回都需持有，
+// 避免并发写入的交易被恢复操作或整个文件的写回覆盖
+func LedgerWriteLock(dataPath string) *sync.Mutex {
+	lock, _ := ledgerWriteLocks.LoadOrStore(filepath.Clean(dataPath), &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
 func FileIfExist(filePath string) bool {
 	_, err := os.Stat(filePath)
 	if nil != err {
@@ -33,6 +47,7 @@ func ReadFile(filePath string) ([]byte, error) {
 
 func WriteFile(filePath string, content string) error {
 	err := ioutil.WriteFile(filePath, []byte(content), 0777)
+	InvalidateQueryCache(filePath)
 	if err != nil {
 		LogSystemError("Failed to write file (" + filePath + ")")
 		return err
@@ -47,6 +62,7 @@ func AppendFileInNewLine(filePath string, content string) error {
 		return err
 	}
 	content = "\r\n" + content
+	defer InvalidateQueryCache(filePath)
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 	if err != nil {
 		LogSystemError("Failed to open file (" + filePath + ")")
@@ -64,6 +80,7 @@ func AppendFileInNewLine(filePath string, content string) error {
 }
 
 func DeleteLinesWithText(filePath string, textToDelete string) error {
+	defer InvalidateQueryCache(filePath)
 	// 打开文件以供读写
 	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
 	if err != nil {
@@ -301,6 +318,51 @@ func IsComment(line string) bool {
 	return false
 }
 
+// ReadLines 按行读取文件
+func ReadLines(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// FindEntryLineRange 从 lineNo 行（指令首行，从 1 开始）开始，向后包含所有缩进的行（过账、元数据、注释），返回指令的行范围
+func FindEntryLineRange(lines []string, lineNo int) (startLine, endLine int, err error) {
+	if lineNo < 1 || lineNo > len(lines) {
+		return -1, -1, fmt.Errorf("line %d out of range", lineNo)
+	}
+	header := lines[lineNo-1]
+	if strings.TrimSpace(header) == "" || header[0] == ' ' || header[0] == '\t' {
+		return -1, -1, fmt.Errorf("line %d is not the start of an entry", lineNo)
+	}
+	endLine = lineNo
+	for endLine < len(lines) {
+		next := lines[endLine]
+		if strings.TrimSpace(next) == "" || (next[0] != ' ' && next[0] != '\t') {
+			break
+		}
+		endLine++
+	}
+	return lineNo, endLine, nil
+}
+
+// ErrEntryChanged 文件在读取后被修改，按行号定位的指令已不是原来的内容
+var ErrEntryChanged = errors.New("entry changed since it was read")
+
+// EntryChecksum 指令原文的校验值，用于判断编辑期间原文是否被修改
+func EntryChecksum(lines []string) string {
+	sum := sha1.Sum([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
 // 删除指定行范围的内容
 func RemoveLines(filePath string, startLineNo, endLineNo int) ([]string, error) {
 	file, err := os.Open(filePath)
@@ -343,6 +405,7 @@ func InsertLines(lines []string, startLineNo int, newLines []string) ([]string,
 
 // 写回文件
 func WriteToFile(filePath string, lines []string) error {
+	defer InvalidateQueryCache(filePath)
 	file, err := os.Create(filePath)
 	if err != nil {
 		return err
@@ -0,0 +1,555 @@
+package script
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+type Cost struct {
+	Number   decimal.Decimal
+	Currency string
+	Date     string
+	Label    string
+}
+
+func (c *Cost) key() string {
+	if c == nil {
+		return ""
+	}
+	return c.Number.String() + "|" + c.Currency + "|" + c.Date + "|" + c.Label
+}
+
+type Position struct {
+	Units Amount
+	Cost  *Cost
+}
+
+// Inventory 持仓，相同币种和成本的持仓会被合并
+type Inventory struct {
+	Positions []Position
+}
+
+func (inv *Inventory) Add(position Position) {
+	for i := range inv.Positions {
+		p := &inv.Positions[i]
+		if p.Units.Currency == position.Units.Currency && p.Cost.key() == position.Cost.key() {
+			p.Units.Number = p.Units.Number.Add(position.Units.Number)
+			if p.Units.Number.IsZero() {
+				inv.Positions = append(inv.Positions[:i], inv.Positions[i+1:]...)
+			}
+			return
+		}
+	}
+	if !position.Units.Number.IsZero() {
+		inv.Positions = append(inv.Positions, position)
+	}
+}
+
+func (inv *Inventory) AddInventory(other *Inventory) {
+	if other == nil {
+		return
+	}
+	for _, p := range other.Positions {
+		inv.Add(p)
+	}
+}
+
+func (inv *Inventory) Units(currency string) decimal.Decimal {
+	sum := decimal.Zero
+	for _, p := range inv.Positions {
+		if p.Units.Currency == currency {
+			sum = sum.Add(p.Units.Number)
+		}
+	}
+	return sum
+}
+
+func (inv *Inventory) Clone() *Inventory {
+	return &Inventory{Positions: append([]Position{}, inv.Positions...)}
+}
+
+func (inv *Inventory) IsEmpty() bool {
+	return len(inv.Positions) == 0
+}
+
+// LedgerError 账本校验错误（不平衡、余额断言失败等），不影响查询
+type LedgerError struct {
+	FilePath string
+	LineNo   int
+	Message  string
+}
+
+func (e *LedgerError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.FilePath, e.LineNo, e.Message)
+}
+
+type datedPrice struct {
+	Date   string
+	Number decimal.Decimal
+}
+
+// Ledger 由原生解析器加载的账本内存模型
+type Ledger struct {
+	Entries    []*Entry
+	Options    map[string][]string
+	Files      []string
+	Errors     []error
+	precisions map[string]map[int32]int
+	prices     map[string][]datedPrice
+	accounts   map[string]*Entry
+}
+
+// LoadLedger 从 index.bean 开始沿 include 加载整个账本
+func LoadLedger(indexFilePath string) (*Ledger, error) {
+	return loadLedger(indexFilePath, ioutil.ReadFile, filepath.Glob)
+}
+
+func loadLedger(indexFilePath string, readFile func(string) ([]byte, error), glob func(string) ([]string, error)) (*Ledger, error) {
+	ledger := &Ledger{
+		Options:    make(map[string][]string),
+		precisions: make(map[string]map[int32]int),
+		prices:     make(map[string][]datedPrice),
+		accounts:   make(map[string]*Entry),
+	}
+	visited := make(map[string]bool)
+	var load func(path string) error
+	load = func(path string) error {
+		path = filepath.Clean(path)
+		if visited[path] {
+			return nil
+		}
+		visited[path] = true
+		content, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		p, err := parseBeanContent(path, string(content))
+		if err != nil {
+			return err
+		}
+		ledger.Files = append(ledger.Files, path)
+		ledger.Entries = append(ledger.Entries, p.entries...)
+		for k, v := range p.options {
+			ledger.Options[k] = append(ledger.Options[k], v...)
+		}
+		for currency, counts := range p.precisions {
+			if ledger.precisions[currency] == nil {
+				ledger.precisions[currency] = make(map[int32]int)
+			}
+			for exp, count := range counts {
+				ledger.precisions[currency][exp] += count
+			}
+		}
+		for _, include := range p.includes {
+			paths := []string{include}
+			if strings.ContainsAny(include, "*?[") {
+				paths, err = glob(include)
+				if err != nil {
+					return err
+				}
+				sort.Strings(paths)
+			}
+			for _, includePath := range paths {
+				if err = load(includePath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := load(indexFilePath); err != nil {
+		return nil, err
+	}
+	ledger.process()
+	return ledger, nil
+}
+
+func entrySortOrder(entry *Entry) int {
+	switch entry.Type {
+	case "open":
+		return -2
+	case "balance":
+		return -1
+	case "document":
+		return 1
+	case "close":
+		return 2
+	}
+	return 0
+}
+
+// process 排序并执行 pad、成本匹配、自动补全金额和余额断言校验
+func (l *Ledger) process() {
+	sort.SliceStable(l.Entries, func(i, j int) bool {
+		a, b := l.Entries[i], l.Entries[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return entrySortOrder(a) < entrySortOrder(b)
+	})
+
+	inventories := make(map[string]*Inventory)
+	pads := make(map[string]*Entry)
+	padded := make(map[*Entry]map[string]bool)
+	paddings := make(map[*Entry][]*Entry)
+
+	for _, entry := range l.Entries {
+		switch entry.Type {
+		case "open":
+			l.accounts[entry.Account] = entry
+		case "close":
+			if _, ok := l.accounts[entry.Account]; !ok {
+				l.addError(entry, "Unopened account "+entry.Account+" is being closed")
+			}
+		case "price":
+			l.addPrice(entry.Date, entry.Currency, entry.Amount.Currency, entry.Amount.Number)
+		case "pad":
+			pads[entry.Account] = entry
+			padded[entry] = make(map[string]bool)
+		case "balance":
+			currency := entry.Amount.Currency
+			balance := decimal.Zero
+			for account, inv := range inventories {
+				if account == entry.Account || strings.HasPrefix(account, entry.Account+":") {
+					balance = balance.Add(inv.Units(currency))
+				}
+			}
+			if pad, ok := pads[entry.Account]; ok && !padded[pad][currency] {
+				padded[pad][currency] = true
+				diff := entry.Amount.Number.Sub(balance)
+				if !diff.IsZero() {
+					padding := newPaddingEntry(pad, entry, diff)
+					paddings[pad] = append(paddings[pad], padding)
+					l.applyPostings(padding, inventories)
+					balance = entry.Amount.Number
+				}
+			}
+			tolerance := decimal.Zero
+			if exp := entry.Amount.Number.Exponent(); exp < 0 {
+				tolerance = decimal.New(1, exp)
+			}
+			if entry.Tolerance != nil {
+				tolerance = *entry.Tolerance
+			}
+			if balance.Sub(entry.Amount.Number).Abs().GreaterThan(tolerance) {
+				l.addError(entry, fmt.Sprintf("Balance failed for '%s': expected %s != accumulated %s (%s too much)",
+					entry.Account, entry.Amount, Amount{Number: balance, Currency: currency}, balance.Sub(entry.Amount.Number)))
+			}
+		case "txn":
+			l.checkAccounts(entry)
+			l.bookTransaction(entry, inventories)
+			l.interpolateTransaction(entry)
+			l.applyPostings(entry, inventories)
+		}
+	}
+
+	if len(paddings) > 0 {
+		entries := make([]*Entry, 0, len(l.Entries)+len(paddings))
+		for _, entry := range l.Entries {
+			entries = append(entries, entry)
+			entries = append(entries, paddings[entry]...)
+		}
+		l.Entries = entries
+	}
+}
+
+func newPaddingEntry(pad *Entry, balance *Entry, diff decimal.Decimal) *Entry {
+	currency := balance.Amount.Currency
+	number := diff
+	negNumber := diff.Neg()
+	entry := &Entry{
+		Type:        "txn",
+		Date:        pad.Date,
+		Flag:        "P",
+		Narration:   fmt.Sprintf("(Padding inserted for Balance of %s for difference %s)", balance.Amount, Amount{Number: diff, Currency: currency}),
+		FilePath:    pad.FilePath,
+		StartLineNo: pad.StartLineNo,
+		EndLineNo:   pad.EndLineNo,
+		Postings: []Posting{
+			{Account: pad.Account, Number: &number, Currency: currency, LineNo: pad.StartLineNo},
+			{Account: pad.Source, Number: &negNumber, Currency: currency, LineNo: pad.StartLineNo},
+		},
+		synthetic: true,
+	}
+	entry.Id = computeEntryId(entry)
+	return entry
+}
+
+func (l *Ledger) addError(entry *Entry, message string) {
+	l.Errors = append(l.Errors, &LedgerError{FilePath: entry.FilePath, LineNo: entry.StartLineNo, Message: message})
+}
+
+func (l *Ledger) checkAccounts(entry *Entry) {
+	for _, posting := range entry.Postings {
+		open, ok := l.accounts[posting.Account]
+		if !ok {
+			l.addError(entry, "Invalid reference to unknown account '"+posting.Account+"'")
+			continue
+		}
+		if len(open.Currencies) > 0 && posting.Currency != "" {
+			allowed := false
+			for _, c := range open.Currencies {
+				if c == posting.Currency {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				l.addError(entry, fmt.Sprintf("Invalid currency %s for account '%s'", posting.Currency, posting.Account))
+			}
+		}
+	}
+}
+
+func (l *Ledger) addPrice(date string, base string, quote string, number decimal.Decimal) {
+	l.prices[base+"/"+quote] = append(l.prices[base+"/"+quote], datedPrice{Date: date, Number: number})
+	if !number.IsZero() {
+		l.prices[quote+"/"+base] = append(l.prices[quote+"/"+base], datedPrice{Date: date, Number: decimal.NewFromInt(1).DivRound(number, 16)})
+	}
+}
+
+// GetPrice 查询 base 以 quote 计价的最新价格，date 为空时取最新一条
+func (l *Ledger) GetPrice(base string, quote string, date string) (decimal.Decimal, bool) {
+	if base == quote {
+		return decimal.NewFromInt(1), true
+	}
+	prices := l.prices[base+"/"+quote]
+	for i := len(prices) - 1; i >= 0; i-- {
+		if date == "" || prices[i].Date <= date {
+			return prices[i].Number, true
+		}
+	}
+	return decimal.Zero, false
+}
+
+// Prices 所有 price 指令
+func (l *Ledger) Prices() []*Entry {
+	result := make([]*Entry, 0)
+	for _, entry := range l.Entries {
+		if entry.Type == "price" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// Precision 推断商品的显示精度（账本中出现次数最多的小数位数）
+func (l *Ledger) Precision(currency string) (int32, bool) {
+	counts, ok := l.precisions[currency]
+	if !ok || len(counts) == 0 {
+		return 0, false
+	}
+	var best int32
+	bestCount := -1
+	for exp, count := range counts {
+		if count > bestCount || (count == bestCount && exp > best) {
+			best = exp
+			bestCount = count
+		}
+	}
+	return best, true
+}
+
+// Precisions 账本中所有商品的小数位数，规则与 Precision 相同
+func (l *Ledger) Precisions() map[string]int32 {
+	result := make(map[string]int32, len(l.precisions))
+	for currency := range l.precisions {
+		if places, ok := l.Precision(currency); ok {
+			result[currency] = places
+		}
+	}
+	return result
+}
+
+// bookTransaction 为带成本的过账匹配持仓批次，{} 形式的减仓按 FIFO/LIFO 拆分到各批次
+func (l *Ledger) bookTransaction(entry *Entry, inventories map[string]*Inventory) {
+	postings := make([]Posting, 0, len(entry.Postings))
+	for _, posting := range entry.Postings {
+		spec := posting.CostSpec
+		if spec == nil || posting.Number == nil {
+			postings = append(postings, posting)
+			continue
+		}
+		units := *posting.Number
+		var lots []Position
+		if inv, ok := inventories[posting.Account]; ok {
+			for _, p := range inv.Positions {
+				if p.Cost != nil && p.Units.Currency == posting.Currency && p.Units.Number.Sign() != units.Sign() && costMatches(p.Cost, spec) {
+					lots = append(lots, p)
+				}
+			}
+		}
+		if len(lots) == 0 {
+			// 增仓
+			cost := &Cost{Currency: spec.Currency, Date: spec.Date, Label: spec.Label}
+			if cost.Date == "" {
+				cost.Date = entry.Date
+			}
+			if cost.Currency == "" && posting.Price != nil {
+				cost.Currency = posting.Price.Currency
+			}
+			switch {
+			case spec.Number != nil:
+				cost.Number = *spec.Number
+				if spec.NumberTotal != nil && !units.IsZero() {
+					cost.Number = cost.Number.Add(spec.NumberTotal.DivRound(units.Abs(), 16))
+				}
+			case spec.NumberTotal != nil && !units.IsZero():
+				cost.Number = spec.NumberTotal.DivRound(units.Abs(), 16)
+			case posting.Price != nil && posting.Price.Number != nil && !posting.Price.Total:
+				cost.Number = *posting.Price.Number
+			}
+			posting.Cost = cost
+			postings = append(postings, posting)
+			continue
+		}
+		// 减仓
+		booking := ""
+		if open, ok := l.accounts[posting.Account]; ok {
+			booking = strings.ToUpper(open.Booking)
+		}
+		sort.SliceStable(lots, func(i, j int) bool {
+			if booking == "LIFO" {
+				return lots[i].Cost.Date > lots[j].Cost.Date
+			}
+			return lots[i].Cost.Date < lots[j].Cost.Date
+		})
+		remaining := units.Abs()
+		for _, lot := range lots {
+			if remaining.IsZero() {
+				break
+			}
+			take := decimal.Min(remaining, lot.Units.Number.Abs())
+			remaining = remaining.Sub(take)
+			number := take
+			if units.IsNegative() {
+				number = take.Neg()
+			}
+			reduced := posting
+			reduced.Number = &number
+			cost := *lot.Cost
+			reduced.Cost = &cost
+			postings = append(postings, reduced)
+		}
+		if !remaining.IsZero() {
+			l.addError(entry, fmt.Sprintf("Not enough lots to reduce '%s' of %s", posting.Account, posting.Currency))
+			number := remaining
+			if units.IsNegative() {
+				number = remaining.Neg()
+			}
+			reduced := posting
+			reduced.Number = &number
+			cost := *lots[len(lots)-1].Cost
+			reduced.Cost = &cost
+			postings = append(postings, reduced)
+		}
+	}
+	entry.Postings = postings
+}
+
+func costMatches(cost *Cost, spec *CostSpec) bool {
+	if spec.Number != nil && !spec.Number.Equal(cost.Number) {
+		return false
+	}
+	if spec.Currency != "" && spec.Currency != cost.Currency {
+		return false
+	}
+	if spec.Date != "" && spec.Date != cost.Date {
+		return false
+	}
+	if spec.Label != "" && spec.Label != cost.Label {
+		return false
+	}
+	return true
+}
+
+// PostingWeight 过账的权重：有成本按成本计，有价格按价格计，否则为数量本身
+func PostingWeight(posting Posting) (Amount, bool) {
+	if posting.Number == nil {
+		return Amount{}, false
+	}
+	units := *posting.Number
+	switch {
+	case posting.Cost != nil && posting.Cost.Currency != "":
+		return Amount{Number: units.Mul(posting.Cost.Number), Currency: posting.Cost.Currency}, true
+	case posting.Price != nil && posting.Price.Number != nil:
+		if posting.Price.Total {
+			number := *posting.Price.Number
+			if units.IsNegative() {
+				number = number.Neg()
+			}
+			return Amount{Number: number, Currency: posting.Price.Currency}, true
+		}
+		return Amount{Number: units.Mul(*posting.Price.Number), Currency: posting.Price.Currency}, true
+	}
+	return Amount{Number: units, Currency: posting.Currency}, true
+}
+
+// interpolateTransaction 补全缺失金额的过账并检查交易是否平衡
+func (l *Ledger) interpolateTransaction(entry *Entry) {
+	residual := make(map[string]decimal.Decimal)
+	tolerances := make(map[string]decimal.Decimal)
+	missing := -1
+	for i, posting := range entry.Postings {
+		weight, ok := PostingWeight(posting)
+		if !ok {
+			if missing >= 0 {
+				l.addError(entry, "Too many missing numbers for auto-posting")
+				return
+			}
+			missing = i
+			continue
+		}
+		residual[weight.Currency] = residual[weight.Currency].Add(weight.Number)
+		if exp := -posting.Number.Exponent(); exp > 0 {
+			tolerance := decimal.New(5, -exp-1)
+			if tolerance.GreaterThan(tolerances[posting.Currency]) {
+				tolerances[posting.Currency] = tolerance
+			}
+		}
+	}
+	currencies := make([]string, 0, len(residual))
+	for currency, number := range residual {
+		if !number.IsZero() {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+	if missing >= 0 {
+		auto := entry.Postings[missing]
+		postings := append([]Posting{}, entry.Postings[:missing]...)
+		for _, currency := range currencies {
+			number := residual[currency].Neg()
+			p := auto
+			p.Number = &number
+			p.Currency = currency
+			postings = append(postings, p)
+		}
+		entry.Postings = append(postings, entry.Postings[missing+1:]...)
+		return
+	}
+	for _, currency := range currencies {
+		if residual[currency].Abs().GreaterThan(tolerances[currency]) {
+			l.addError(entry, fmt.Sprintf("Transaction does not balance: (%s)", Amount{Number: residual[currency], Currency: currency}))
+		}
+	}
+}
+
+func (l *Ledger) applyPostings(entry *Entry, inventories map[string]*Inventory) {
+	for _, posting := range entry.Postings {
+		if posting.Number == nil {
+			continue
+		}
+		inv, ok := inventories[posting.Account]
+		if !ok {
+			inv = &Inventory{}
+			inventories[posting.Account] = inv
+		}
+		inv.Add(Position{Units: Amount{Number: *posting.Number, Currency: posting.Currency}, Cost: posting.Cost})
+	}
+}
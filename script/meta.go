@@ -0,0 +1,147 @@
+package script
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// 元数据（key: value）的校验、格式化和读取
+
+var ErrInvalidMeta = errors.New("invalid metadata")
+
+var (
+	metaKeyRegexp  = regexp.MustCompile(`^[a-z][a-zA-Z0-9\-_]*$`)
+	metaDateRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	uuidRegexp     = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// TransactionUUIDKey 交易的固定 id，保存在交易的元数据中，编辑交易时不变
+const TransactionUUIDKey = "uuid"
+
+// NewUUID 生成随机的 UUID（version 4）
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// IsUUID 是否为小写的 UUID 格式，beancount 的交易 id 为不带 - 的哈希值
+func IsUUID(s string) bool {
+	return uuidRegexp.MatchString(s)
+}
+
+// CheckMetaKey 元数据的 key 以小写字母开头，filename 和 lineno 由 beancount 保留
+func CheckMetaKey(key string) error {
+	if !metaKeyRegexp.MatchString(key) {
+		return fmt.Errorf("%w: key %s", ErrInvalidMeta, key)
+	}
+	if key == "filename" || key == "lineno" {
+		return fmt.Errorf("%w: key %s is reserved", ErrInvalidMeta, key)
+	}
+	return nil
+}
+
+// FormatBeanString 输出带引号的 beancount 字符串，转义引号和反斜杠
+func FormatBeanString(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// FormatMetaValue 按值的类型输出元数据的值：字符串加引号（日期除外），数字、布尔值原样输出
+func FormatMetaValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if metaDateRegexp.MatchString(v) {
+			return v, nil
+		}
+		return FormatBeanString(v), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case float64:
+		return decimal.NewFromFloat(v).String(), nil
+	case json.Number:
+		d, err := decimal.NewFromString(v.String())
+		if err != nil {
+			return "", fmt.Errorf("%w: value %s", ErrInvalidMeta, v)
+		}
+		return d.String(), nil
+	case int:
+		return fmt.Sprintf("%d", v), nil
+	case int64:
+		return fmt.Sprintf("%d", v), nil
+	case decimal.Decimal:
+		return v.String(), nil
+	case Amount:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("%w: unsupported value type %T", ErrInvalidMeta, value)
+}
+
+// FormatMetaLines 输出按 key 排序的元数据行，每行以 indent 开头
+func FormatMetaLines(meta map[string]interface{}, indent string) ([]string, error) {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		if err := CheckMetaKey(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, err := FormatMetaValue(meta[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		lines = append(lines, strings.TrimRight(indent+key+": "+value, " "))
+	}
+	return lines, nil
+}
+
+// MetaToJSON 将解析出的元数据转换为 JSON 值，数字保留原始精度，金额输出为字符串
+func MetaToJSON(meta map[string]interface{}) map[string]interface{} {
+	if len(meta) == 0 {
+		return nil
+	}
+	result := make(map[string]interface{}, len(meta))
+	for key, value := range meta {
+		switch v := value.(type) {
+		case decimal.Decimal:
+			result[key] = json.Number(v.String())
+		case Amount:
+			result[key] = v.String()
+		default:
+			result[key] = v
+		}
+	}
+	return result
+}
+
+// ParseTransactionText 解析交易原文，返回其中的第一个交易
+func ParseTransactionText(rawText string) (*Entry, error) {
+	entries, _, err := ParseBeanContent("", rawText)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Type == "txn" {
+			return entry, nil
+		}
+	}
+	return nil, errors.New("no transaction found")
+}
@@ -0,0 +1,46 @@
+package script
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidCursor 分页游标无法解析
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// PageCursor 分页游标，按 date、id 倒序排列时上一页最后一行的位置，
+// Offset 为该交易已返回的过账数（同一交易的多条过账可能跨页）
+type PageCursor struct {
+	Date   string `json:"d"`
+	Id     string `json:"i"`
+	Offset int    `json:"n"`
+}
+
+// Encode 编码为不透明的字符串
+func (cursor PageCursor) Encode() string {
+	bytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// After 按 date、id 倒序排列时，(date, id) 是否在游标所在交易之后
+func (cursor PageCursor) After(date string, id string) bool {
+	return date < cursor.Date || (date == cursor.Date && id < cursor.Id)
+}
+
+func DecodePageCursor(s string) (PageCursor, error) {
+	var cursor PageCursor
+	bytes, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(bytes, &cursor); err != nil || cursor.Date == "" || cursor.Offset < 0 {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
@@ -0,0 +1,1068 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrUnsupportedSyntax 原生解析器/查询引擎不支持的语法，调用方应回退到 bean-query
+var ErrUnsupportedSyntax = errors.New("unsupported beancount syntax")
+
+// ParseError 账本源文件解析错误
+type ParseError struct {
+	FilePath    string
+	LineNo      int
+	Message     string
+	Unsupported bool
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.FilePath, e.LineNo, e.Message)
+}
+
+func (e *ParseError) Unwrap() error {
+	if e.Unsupported {
+		return ErrUnsupportedSyntax
+	}
+	return nil
+}
+
+type Amount struct {
+	Number   decimal.Decimal
+	Currency string
+}
+
+func (a Amount) String() string {
+	return a.Number.String() + " " + a.Currency
+}
+
+// CostSpec 过账中 {} 或 {{}} 内的成本描述，未填写的字段为空
+type CostSpec struct {
+	Number      *decimal.Decimal
+	NumberTotal *decimal.Decimal
+	Currency    string
+	Date        string
+	Label       string
+	Merge       bool
+}
+
+type PriceSpec struct {
+	Number   *decimal.Decimal
+	Currency string
+	Total    bool
+}
+
+type Posting struct {
+	Flag     string
+	Account  string
+	Number   *decimal.Decimal
+	Currency string
+	CostSpec *CostSpec
+	Cost     *Cost
+	Price    *PriceSpec
+	Meta     map[string]interface{}
+	LineNo   int
+}
+
+// Entry 账本中的一条指令（open/close/txn/price/pad/balance/event/...）
+type Entry struct {
+	Id          string
+	Type        string
+	Date        string
+	Flag        string
+	Payee       string
+	Narration   string
+	Tags        []string
+	Links       []string
+	Meta        map[string]interface{}
+	Postings    []Posting
+	Account     string
+	Currencies  []string
+	Booking     string
+	Amount      *Amount
+	Tolerance   *decimal.Decimal
+	Currency    string
+	Source      string
+	Name        string
+	Description string
+	Values      []string
+	FilePath    string
+	StartLineNo int
+	EndLineNo   int
+	RawText     string
+	// synthetic 由 pad 等指令生成，源文件中不存在
+	synthetic bool
+}
+
+// Location 指令所在的源文件位置
+func (e *Entry) Location() string {
+	return fmt.Sprintf("%s:%d", e.FilePath, e.StartLineNo)
+}
+
+type beanTokenKind int
+
+const (
+	beanTokenEOL beanTokenKind = iota
+	beanTokenIndent
+	beanTokenDate
+	beanTokenString
+	beanTokenNumber
+	beanTokenCurrency
+	beanTokenAccount
+	beanTokenKey
+	beanTokenTag
+	beanTokenLink
+	beanTokenFlag
+	beanTokenKeyword
+	beanTokenBool
+	beanTokenNull
+	beanTokenPunct
+)
+
+type beanToken struct {
+	Kind    beanTokenKind
+	Text    string
+	Line    int
+	EndLine int
+}
+
+var (
+	beanDateRegexp     = regexp.MustCompile(`^\d{4}[-/]\d{1,2}[-/]\d{1,2}$`)
+	beanNumberRegexp   = regexp.MustCompile(`^[-+(]*[0-9.][0-9.,+\-*/()]*$`)
+	beanKeyRegexp      = regexp.MustCompile(`^[a-z][a-zA-Z0-9_-]*:$`)
+	beanCurrencyRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9'._-]{0,22}[A-Z0-9]$`)
+	beanKeywordRegexp  = regexp.MustCompile(`^[a-z][a-z_-]*$`)
+	beanFlags          = "*!&?%PSTCURM"
+)
+
+const beanDelimiters = " \t\r\n\";{}@,~"
+
+func lexBeanContent(filePath string, content string) ([]beanToken, error) {
+	tokens := make([]beanToken, 0)
+	line := 1
+	lineStart := true
+	lineHasToken := false
+	i := 0
+	emit := func(kind beanTokenKind, text string, start int) {
+		tokens = append(tokens, beanToken{Kind: kind, Text: text, Line: start, EndLine: line})
+		lineHasToken = true
+	}
+	skipLine := func() {
+		for i < len(content) && content[i] != '\n' {
+			i++
+		}
+	}
+	for i < len(content) {
+		ch := content[i]
+		if lineStart {
+			lineStart = false
+			switch ch {
+			case ' ', '\t':
+				j := i
+				for j < len(content) && (content[j] == ' ' || content[j] == '\t') {
+					j++
+				}
+				// 空白行或注释行不算缩进
+				if j < len(content) && content[j] != '\n' && content[j] != '\r' && content[j] != ';' {
+					emit(beanTokenIndent, "", line)
+				}
+				i = j
+				continue
+			case '*', '#', ':', '!', '&', '?', '%':
+				// org-mode 标题等非指令行
+				skipLine()
+				continue
+			}
+		}
+		switch {
+		case ch == '\n':
+			if lineHasToken {
+				tokens = append(tokens, beanToken{Kind: beanTokenEOL, Line: line, EndLine: line})
+			}
+			line++
+			i++
+			lineStart = true
+			lineHasToken = false
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+		case ch == ';':
+			skipLine()
+		case ch == '"':
+			start := line
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(content) {
+				c := content[i]
+				if c == '\\' && i+1 < len(content) {
+					sb.WriteByte(content[i+1])
+					if content[i+1] == '\n' {
+						line++
+					}
+					i += 2
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				if c == '\n' {
+					line++
+				}
+				sb.WriteByte(c)
+				i++
+			}
+			if !closed {
+				return nil, &ParseError{FilePath: filePath, LineNo: start, Message: "unterminated string"}
+			}
+			emit(beanTokenString, sb.String(), start)
+		case ch == '{' || ch == '}' || ch == '@':
+			if i+1 < len(content) && content[i+1] == ch {
+				emit(beanTokenPunct, content[i:i+2], line)
+				i += 2
+			} else {
+				emit(beanTokenPunct, string(ch), line)
+				i++
+			}
+		case ch == ',' || ch == '~':
+			emit(beanTokenPunct, string(ch), line)
+			i++
+		default:
+			j := i
+			for j < len(content) {
+				c := content[j]
+				if c == ',' && j > i && j+1 < len(content) && isDigit(content[j-1]) && isDigit(content[j+1]) && isDigit(content[i]) {
+					// 千分位分隔符
+					j++
+					continue
+				}
+				if strings.IndexByte(beanDelimiters, c) >= 0 {
+					break
+				}
+				j++
+			}
+			word := content[i:j]
+			i = j
+			kind, text, err := classifyBeanWord(word)
+			if err != nil {
+				return nil, &ParseError{FilePath: filePath, LineNo: line, Message: err.Error(), Unsupported: true}
+			}
+			emit(kind, text, line)
+		}
+	}
+	if lineHasToken {
+		tokens = append(tokens, beanToken{Kind: beanTokenEOL, Line: line, EndLine: line})
+	}
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func classifyBeanWord(word string) (beanTokenKind, string, error) {
+	switch {
+	case beanDateRegexp.MatchString(word):
+		return beanTokenDate, normalizeBeanDate(word), nil
+	case word == "#":
+		return beanTokenPunct, word, nil
+	case strings.HasPrefix(word, "#"):
+		return beanTokenTag, word[1:], nil
+	case strings.HasPrefix(word, "^"):
+		return beanTokenLink, word[1:], nil
+	case len(word) == 1 && strings.Contains(beanFlags, word):
+		return beanTokenFlag, word, nil
+	case beanNumberRegexp.MatchString(word):
+		return beanTokenNumber, word, nil
+	case beanKeyRegexp.MatchString(word):
+		return beanTokenKey, strings.TrimSuffix(word, ":"), nil
+	case word == "TRUE" || word == "FALSE":
+		return beanTokenBool, word, nil
+	case word == "NULL":
+		return beanTokenNull, word, nil
+	case isBeanAccount(word):
+		return beanTokenAccount, word, nil
+	case beanCurrencyRegexp.MatchString(word):
+		return beanTokenCurrency, word, nil
+	case beanKeywordRegexp.MatchString(word):
+		return beanTokenKeyword, word, nil
+	}
+	return 0, "", fmt.Errorf("unexpected token '%s'", word)
+}
+
+func isBeanAccount(word string) bool {
+	if !strings.Contains(word, ":") || strings.HasSuffix(word, ":") {
+		return false
+	}
+	for _, component := range strings.Split(word, ":") {
+		r, _ := utf8.DecodeRuneInString(component)
+		if component == "" || !(unicode.IsUpper(r) || unicode.IsDigit(r) || r >= utf8.RuneSelf) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeBeanDate(word string) string {
+	parts := strings.FieldsFunc(word, func(r rune) bool { return r == '-' || r == '/' })
+	return fmt.Sprintf("%s-%02s-%02s", parts[0], parts[1], parts[2])
+}
+
+// evalBeanNumber 计算金额表达式，支持 + - * / 和括号
+func evalBeanNumber(text string) (decimal.Decimal, error) {
+	p := &beanNumberParser{text: strings.ReplaceAll(text, ",", "")}
+	value, err := p.parseExpr()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if p.pos != len(p.text) {
+		return decimal.Zero, fmt.Errorf("invalid number '%s'", text)
+	}
+	return value, nil
+}
+
+type beanNumberParser struct {
+	text string
+	pos  int
+}
+
+func (p *beanNumberParser) parseExpr() (decimal.Decimal, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return left, err
+	}
+	for p.pos < len(p.text) && (p.text[p.pos] == '+' || p.text[p.pos] == '-') {
+		op := p.text[p.pos]
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return left, err
+		}
+		if op == '+' {
+			left = left.Add(right)
+		} else {
+			left = left.Sub(right)
+		}
+	}
+	return left, nil
+}
+
+func (p *beanNumberParser) parseTerm() (decimal.Decimal, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return left, err
+	}
+	for p.pos < len(p.text) && (p.text[p.pos] == '*' || p.text[p.pos] == '/') {
+		op := p.text[p.pos]
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return left, err
+		}
+		if op == '*' {
+			left = left.Mul(right)
+		} else {
+			if right.IsZero() {
+				return left, errors.New("division by zero")
+			}
+			left = left.DivRound(right, 16)
+		}
+	}
+	return left, nil
+}
+
+func (p *beanNumberParser) parseFactor() (decimal.Decimal, error) {
+	if p.pos >= len(p.text) {
+		return decimal.Zero, fmt.Errorf("invalid number '%s'", p.text)
+	}
+	switch p.text[p.pos] {
+	case '-':
+		p.pos++
+		v, err := p.parseFactor()
+		return v.Neg(), err
+	case '+':
+		p.pos++
+		return p.parseFactor()
+	case '(':
+		p.pos++
+		v, err := p.parseExpr()
+		if err != nil {
+			return v, err
+		}
+		if p.pos >= len(p.text) || p.text[p.pos] != ')' {
+			return v, fmt.Errorf("invalid number '%s'", p.text)
+		}
+		p.pos++
+		return v, nil
+	}
+	start := p.pos
+	for p.pos < len(p.text) && (isDigit(p.text[p.pos]) || p.text[p.pos] == '.') {
+		p.pos++
+	}
+	return decimal.NewFromString(p.text[start:p.pos])
+}
+
+// beanFileParser 将单个源文件解析为指令列表
+type beanFileParser struct {
+	filePath string
+	tokens   []beanToken
+	pos      int
+	entries  []*Entry
+	includes []string
+	options  map[string][]string
+	tagStack []string
+	// 数字出现的小数位数，用于推断商品的显示精度
+	precisions map[string]map[int32]int
+}
+
+// ParseBeanContent 解析 beancount 文本，返回指令列表和 include 的文件（已转为绝对路径）
+func ParseBeanContent(filePath string, content string) ([]*Entry, []string, error) {
+	p, err := parseBeanContent(filePath, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.entries, p.includes, nil
+}
+
+func parseBeanContent(filePath string, content string) (*beanFileParser, error) {
+	tokens, err := lexBeanContent(filePath, content)
+	if err != nil {
+		return nil, err
+	}
+	p := &beanFileParser{
+		filePath:   filePath,
+		tokens:     tokens,
+		options:    make(map[string][]string),
+		precisions: make(map[string]map[int32]int),
+	}
+	for p.pos < len(p.tokens) {
+		if err := p.parseLine(); err != nil {
+			return nil, err
+		}
+	}
+	lines := strings.Split(content, "\n")
+	for _, entry := range p.entries {
+		if entry.EndLineNo <= len(lines) {
+			raw := make([]string, 0, entry.EndLineNo-entry.StartLineNo+1)
+			for _, line := range lines[entry.StartLineNo-1 : entry.EndLineNo] {
+				raw = append(raw, strings.TrimRight(line, "\r"))
+			}
+			entry.RawText = strings.Join(raw, "\n")
+		}
+	}
+	return p, nil
+}
+
+func (p *beanFileParser) peek() *beanToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *beanFileParser) next() *beanToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+func (p *beanFileParser) errorf(line int, unsupported bool, format string, args ...interface{}) error {
+	return &ParseError{FilePath: p.filePath, LineNo: line, Message: fmt.Sprintf(format, args...), Unsupported: unsupported}
+}
+
+func (p *beanFileParser) atEOL() bool {
+	t := p.peek()
+	return t == nil || t.Kind == beanTokenEOL
+}
+
+func (p *beanFileParser) expect(kind beanTokenKind, what string) (*beanToken, error) {
+	t := p.peek()
+	if t == nil || t.Kind != kind {
+		line := 0
+		if t != nil {
+			line = t.Line
+		} else if len(p.tokens) > 0 {
+			line = p.tokens[len(p.tokens)-1].Line
+		}
+		return nil, p.errorf(line, false, "expected %s", what)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *beanFileParser) skipEOL() {
+	if t := p.peek(); t != nil && t.Kind == beanTokenEOL {
+		p.pos++
+	}
+}
+
+func (p *beanFileParser) expectEOL() error {
+	t := p.peek()
+	if t != nil && t.Kind != beanTokenEOL {
+		return p.errorf(t.Line, false, "unexpected '%s'", t.Text)
+	}
+	p.skipEOL()
+	return nil
+}
+
+func (p *beanFileParser) parseLine() error {
+	t := p.next()
+	switch t.Kind {
+	case beanTokenEOL:
+		return nil
+	case beanTokenIndent:
+		return p.errorf(t.Line, false, "indented line without directive")
+	case beanTokenDate:
+		return p.parseDirective(t)
+	case beanTokenKeyword:
+		return p.parseUndatedDirective(t)
+	}
+	return p.errorf(t.Line, false, "unexpected '%s'", t.Text)
+}
+
+func (p *beanFileParser) parseUndatedDirective(t *beanToken) error {
+	switch t.Text {
+	case "include":
+		s, err := p.expect(beanTokenString, "include path")
+		if err != nil {
+			return err
+		}
+		path := s.Text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(p.filePath), path)
+		}
+		p.includes = append(p.includes, path)
+	case "option":
+		key, err := p.expect(beanTokenString, "option name")
+		if err != nil {
+			return err
+		}
+		value, err := p.expect(beanTokenString, "option value")
+		if err != nil {
+			return err
+		}
+		p.options[key.Text] = append(p.options[key.Text], value.Text)
+	case "pushtag":
+		tag, err := p.expect(beanTokenTag, "tag")
+		if err != nil {
+			return err
+		}
+		p.tagStack = append(p.tagStack, tag.Text)
+	case "poptag":
+		tag, err := p.expect(beanTokenTag, "tag")
+		if err != nil {
+			return err
+		}
+		for i := len(p.tagStack) - 1; i >= 0; i-- {
+			if p.tagStack[i] == tag.Text {
+				p.tagStack = append(p.tagStack[:i], p.tagStack[i+1:]...)
+				break
+			}
+		}
+	default:
+		// plugin/pushmeta 等会改变账本语义，交给 bean-query 处理
+		return p.errorf(t.Line, true, "unsupported directive '%s'", t.Text)
+	}
+	return p.expectEOL()
+}
+
+func (p *beanFileParser) parseDirective(dateToken *beanToken) error {
+	entry := &Entry{
+		Date:        dateToken.Text,
+		FilePath:    p.filePath,
+		StartLineNo: dateToken.Line,
+		EndLineNo:   dateToken.Line,
+	}
+	t := p.next()
+	if t == nil {
+		return p.errorf(dateToken.Line, false, "expected directive")
+	}
+	var err error
+	switch {
+	case t.Kind == beanTokenFlag:
+		entry.Type = "txn"
+		entry.Flag = t.Text
+		err = p.parseTransactionHeader(entry)
+	case t.Kind == beanTokenKeyword && t.Text == "txn":
+		entry.Type = "txn"
+		entry.Flag = "*"
+		err = p.parseTransactionHeader(entry)
+	case t.Kind == beanTokenKeyword:
+		entry.Type = t.Text
+		err = p.parseDatedHeader(entry, t)
+	default:
+		return p.errorf(t.Line, false, "unexpected '%s'", t.Text)
+	}
+	if err != nil {
+		return err
+	}
+	if err = p.markEnd(entry); err != nil {
+		return err
+	}
+	if err = p.expectEOL(); err != nil {
+		return err
+	}
+	if err = p.parseBody(entry); err != nil {
+		return err
+	}
+	if entry.Type == "txn" && len(p.tagStack) > 0 {
+		entry.Tags = appendUnique(entry.Tags, p.tagStack...)
+	}
+	entry.Id = computeEntryId(entry)
+	p.entries = append(p.entries, entry)
+	return nil
+}
+
+func (p *beanFileParser) markEnd(entry *Entry) error {
+	if p.pos > 0 {
+		last := p.tokens[p.pos-1]
+		if last.EndLine > entry.EndLineNo {
+			entry.EndLineNo = last.EndLine
+		}
+	}
+	return nil
+}
+
+func (p *beanFileParser) parseTransactionHeader(entry *Entry) error {
+	strs := make([]string, 0, 2)
+	for !p.atEOL() {
+		t := p.next()
+		switch t.Kind {
+		case beanTokenString:
+			if len(strs) == 2 {
+				return p.errorf(t.Line, false, "too many strings in transaction")
+			}
+			strs = append(strs, t.Text)
+		case beanTokenTag:
+			entry.Tags = appendUnique(entry.Tags, t.Text)
+		case beanTokenLink:
+			entry.Links = appendUnique(entry.Links, t.Text)
+		default:
+			return p.errorf(t.Line, false, "unexpected '%s' in transaction", t.Text)
+		}
+	}
+	switch len(strs) {
+	case 1:
+		entry.Narration = strs[0]
+	case 2:
+		entry.Payee = strs[0]
+		entry.Narration = strs[1]
+	}
+	return nil
+}
+
+func (p *beanFileParser) parseDatedHeader(entry *Entry, t *beanToken) error {
+	switch t.Text {
+	case "open":
+		acc, err := p.expect(beanTokenAccount, "account")
+		if err != nil {
+			return err
+		}
+		entry.Account = acc.Text
+		for !p.atEOL() {
+			n := p.next()
+			switch n.Kind {
+			case beanTokenCurrency:
+				entry.Currencies = append(entry.Currencies, n.Text)
+			case beanTokenPunct:
+				if n.Text != "," {
+					return p.errorf(n.Line, false, "unexpected '%s'", n.Text)
+				}
+			case beanTokenString:
+				entry.Booking = n.Text
+			default:
+				return p.errorf(n.Line, false, "unexpected '%s'", n.Text)
+			}
+		}
+	case "close":
+		acc, err := p.expect(beanTokenAccount, "account")
+		if err != nil {
+			return err
+		}
+		entry.Account = acc.Text
+	case "commodity":
+		cur, err := p.expect(beanTokenCurrency, "currency")
+		if err != nil {
+			return err
+		}
+		entry.Currency = cur.Text
+	case "pad":
+		acc, err := p.expect(beanTokenAccount, "account")
+		if err != nil {
+			return err
+		}
+		src, err := p.expect(beanTokenAccount, "source account")
+		if err != nil {
+			return err
+		}
+		entry.Account = acc.Text
+		entry.Source = src.Text
+	case "balance":
+		acc, err := p.expect(beanTokenAccount, "account")
+		if err != nil {
+			return err
+		}
+		entry.Account = acc.Text
+		num, err := p.parseNumber()
+		if err != nil {
+			return err
+		}
+		if t := p.peek(); t != nil && t.Kind == beanTokenPunct && t.Text == "~" {
+			p.pos++
+			tolerance, err := p.parseNumber()
+			if err != nil {
+				return err
+			}
+			entry.Tolerance = &tolerance
+		}
+		cur, err := p.expect(beanTokenCurrency, "currency")
+		if err != nil {
+			return err
+		}
+		entry.Amount = &Amount{Number: num, Currency: cur.Text}
+		p.recordPrecision(cur.Text, num)
+	case "price":
+		cur, err := p.expect(beanTokenCurrency, "currency")
+		if err != nil {
+			return err
+		}
+		num, err := p.parseNumber()
+		if err != nil {
+			return err
+		}
+		quote, err := p.expect(beanTokenCurrency, "currency")
+		if err != nil {
+			return err
+		}
+		entry.Currency = cur.Text
+		entry.Amount = &Amount{Number: num, Currency: quote.Text}
+		p.recordPrecision(quote.Text, num)
+	case "event", "query":
+		name, err := p.expect(beanTokenString, "name")
+		if err != nil {
+			return err
+		}
+		desc, err := p.expect(beanTokenString, "value")
+		if err != nil {
+			return err
+		}
+		entry.Name = name.Text
+		entry.Description = desc.Text
+	case "note", "document":
+		acc, err := p.expect(beanTokenAccount, "account")
+		if err != nil {
+			return err
+		}
+		desc, err := p.expect(beanTokenString, "description")
+		if err != nil {
+			return err
+		}
+		entry.Account = acc.Text
+		entry.Description = desc.Text
+		for !p.atEOL() {
+			n := p.next()
+			if n.Kind == beanTokenTag {
+				entry.Tags = appendUnique(entry.Tags, n.Text)
+			} else if n.Kind == beanTokenLink {
+				entry.Links = appendUnique(entry.Links, n.Text)
+			} else {
+				return p.errorf(n.Line, false, "unexpected '%s'", n.Text)
+			}
+		}
+	case "custom":
+		name, err := p.expect(beanTokenString, "name")
+		if err != nil {
+			return err
+		}
+		entry.Name = name.Text
+		for !p.atEOL() {
+			entry.Values = append(entry.Values, p.next().Text)
+		}
+	default:
+		return p.errorf(t.Line, true, "unsupported directive '%s'", t.Text)
+	}
+	return nil
+}
+
+func (p *beanFileParser) parseNumber() (decimal.Decimal, error) {
+	t, err := p.expect(beanTokenNumber, "number")
+	if err != nil {
+		return decimal.Zero, err
+	}
+	num, err := evalBeanNumber(t.Text)
+	if err != nil {
+		return num, p.errorf(t.Line, false, "%s", err.Error())
+	}
+	return num, nil
+}
+
+func (p *beanFileParser) recordPrecision(currency string, number decimal.Decimal) {
+	if currency == "" {
+		return
+	}
+	counts, ok := p.precisions[currency]
+	if !ok {
+		counts = make(map[int32]int)
+		p.precisions[currency] = counts
+	}
+	exp := -number.Exponent()
+	if exp < 0 {
+		exp = 0
+	}
+	counts[exp]++
+}
+
+// parseBody 解析指令下方缩进的过账行和元数据行
+func (p *beanFileParser) parseBody(entry *Entry) error {
+	for {
+		t := p.peek()
+		if t == nil || t.Kind != beanTokenIndent {
+			return nil
+		}
+		p.pos++
+		head := p.peek()
+		if head == nil || head.Kind == beanTokenEOL {
+			p.skipEOL()
+			continue
+		}
+		if head.Kind == beanTokenKey {
+			p.pos++
+			value, err := p.parseMetaValue()
+			if err != nil {
+				return err
+			}
+			if len(entry.Postings) > 0 {
+				posting := &entry.Postings[len(entry.Postings)-1]
+				if posting.Meta == nil {
+					posting.Meta = make(map[string]interface{})
+				}
+				posting.Meta[head.Text] = value
+			} else {
+				if entry.Meta == nil {
+					entry.Meta = make(map[string]interface{})
+				}
+				entry.Meta[head.Text] = value
+			}
+		} else if entry.Type == "txn" {
+			posting, err := p.parsePosting()
+			if err != nil {
+				return err
+			}
+			entry.Postings = append(entry.Postings, posting)
+		} else {
+			return p.errorf(head.Line, false, "unexpected '%s'", head.Text)
+		}
+		if err := p.markEnd(entry); err != nil {
+			return err
+		}
+		if err := p.expectEOL(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *beanFileParser) parseMetaValue() (interface{}, error) {
+	if p.atEOL() {
+		return nil, nil
+	}
+	t := p.next()
+	switch t.Kind {
+	case beanTokenString, beanTokenDate, beanTokenAccount, beanTokenCurrency:
+		return t.Text, nil
+	case beanTokenTag:
+		return "#" + t.Text, nil
+	case beanTokenLink:
+		return "^" + t.Text, nil
+	case beanTokenBool:
+		return t.Text == "TRUE", nil
+	case beanTokenNull:
+		return nil, nil
+	case beanTokenNumber:
+		num, err := evalBeanNumber(t.Text)
+		if err != nil {
+			return nil, p.errorf(t.Line, false, "%s", err.Error())
+		}
+		if c := p.peek(); c != nil && c.Kind == beanTokenCurrency {
+			p.pos++
+			return Amount{Number: num, Currency: c.Text}, nil
+		}
+		return num, nil
+	}
+	return nil, p.errorf(t.Line, false, "unexpected '%s' in metadata", t.Text)
+}
+
+func (p *beanFileParser) parsePosting() (Posting, error) {
+	posting := Posting{}
+	t := p.next()
+	if t.Kind == beanTokenFlag {
+		posting.Flag = t.Text
+		t = p.next()
+		if t == nil {
+			return posting, p.errorf(p.tokens[len(p.tokens)-1].Line, false, "expected account")
+		}
+	}
+	if t.Kind != beanTokenAccount {
+		return posting, p.errorf(t.Line, false, "expected account, found '%s'", t.Text)
+	}
+	posting.Account = t.Text
+	posting.LineNo = t.Line
+	if n := p.peek(); n != nil && n.Kind == beanTokenNumber {
+		num, err := p.parseNumber()
+		if err != nil {
+			return posting, err
+		}
+		posting.Number = &num
+	}
+	if c := p.peek(); c != nil && c.Kind == beanTokenCurrency {
+		p.pos++
+		posting.Currency = c.Text
+		if posting.Number != nil {
+			p.recordPrecision(c.Text, *posting.Number)
+		}
+	}
+	if c := p.peek(); c != nil && c.Kind == beanTokenPunct && (c.Text == "{" || c.Text == "{{") {
+		p.pos++
+		spec, err := p.parseCostSpec(c.Text == "{{")
+		if err != nil {
+			return posting, err
+		}
+		posting.CostSpec = spec
+	}
+	if c := p.peek(); c != nil && c.Kind == beanTokenPunct && (c.Text == "@" || c.Text == "@@") {
+		p.pos++
+		price := &PriceSpec{Total: c.Text == "@@"}
+		if n := p.peek(); n != nil && n.Kind == beanTokenNumber {
+			num, err := p.parseNumber()
+			if err != nil {
+				return posting, err
+			}
+			price.Number = &num
+		}
+		if cur := p.peek(); cur != nil && cur.Kind == beanTokenCurrency {
+			p.pos++
+			price.Currency = cur.Text
+			if price.Number != nil && !price.Total {
+				p.recordPrecision(cur.Text, *price.Number)
+			}
+		}
+		posting.Price = price
+	}
+	return posting, nil
+}
+
+func (p *beanFileParser) parseCostSpec(total bool) (*CostSpec, error) {
+	spec := &CostSpec{}
+	closing := "}"
+	if total {
+		closing = "}}"
+	}
+	for {
+		t := p.next()
+		if t == nil || t.Kind == beanTokenEOL {
+			return nil, p.errorf(p.tokens[p.pos-1].Line, false, "unterminated cost")
+		}
+		switch t.Kind {
+		case beanTokenPunct:
+			switch t.Text {
+			case closing:
+				if total && spec.Number != nil {
+					spec.NumberTotal = spec.Number
+					spec.Number = nil
+				}
+				return spec, nil
+			case ",":
+			case "#":
+				num, err := p.parseNumber()
+				if err != nil {
+					return nil, err
+				}
+				spec.NumberTotal = &num
+			default:
+				return nil, p.errorf(t.Line, false, "unexpected '%s' in cost", t.Text)
+			}
+		case beanTokenNumber:
+			num, err := evalBeanNumber(t.Text)
+			if err != nil {
+				return nil, p.errorf(t.Line, false, "%s", err.Error())
+			}
+			spec.Number = &num
+		case beanTokenCurrency:
+			spec.Currency = t.Text
+		case beanTokenDate:
+			spec.Date = t.Text
+		case beanTokenString:
+			spec.Label = t.Text
+		case beanTokenFlag:
+			if t.Text != "*" {
+				return nil, p.errorf(t.Line, false, "unexpected '%s' in cost", t.Text)
+			}
+			spec.Merge = true
+		default:
+			return nil, p.errorf(t.Line, false, "unexpected '%s' in cost", t.Text)
+		}
+	}
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		exists := false
+		for _, s := range list {
+			if s == v {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// computeEntryId 根据指令内容计算哈希，内容变化后 ID 随之变化（与 bean-query 的 id 语义一致）
+func computeEntryId(entry *Entry) string {
+	var sb strings.Builder
+	sb.WriteString(entry.Type + "|" + entry.Date + "|" + entry.Flag + "|" + entry.Payee + "|" + entry.Narration + "|")
+	tags := append([]string{}, entry.Tags...)
+	sort.Strings(tags)
+	links := append([]string{}, entry.Links...)
+	sort.Strings(links)
+	sb.WriteString(strings.Join(tags, ",") + "|" + strings.Join(links, ",") + "|")
+	sb.WriteString(entry.Account + "|" + entry.Source + "|" + entry.Currency + "|" + entry.Name + "|" + entry.Description + "|")
+	if entry.Amount != nil {
+		sb.WriteString(entry.Amount.String())
+	}
+	for _, posting := range entry.Postings {
+		sb.WriteString("|" + posting.Flag + posting.Account + " ")
+		if posting.Number != nil {
+			sb.WriteString(posting.Number.String())
+		}
+		sb.WriteString(" " + posting.Currency)
+		if posting.CostSpec != nil {
+			spec := posting.CostSpec
+			sb.WriteString(fmt.Sprintf(" {%s %s %s %s %s}", decimalPtrString(spec.Number), decimalPtrString(spec.NumberTotal), spec.Currency, spec.Date, spec.Label))
+		}
+		if posting.Price != nil {
+			sb.WriteString(fmt.Sprintf(" @%t %s %s", posting.Price.Total, decimalPtrString(posting.Price.Number), posting.Price.Currency))
+		}
+	}
+	return md5Hex(sb.String())
+}
+
+func decimalPtrString(d *decimal.Decimal) string {
+	if d == nil {
+		return ""
+	}
+	return d.String()
+}
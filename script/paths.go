@@ -36,6 +36,22 @@ func GetLedgerTransactionsTemplateFilePath(dataPath string) string {
 	return dataPath + "/.beancount-gs/transaction_template.json"
 }
 
+func GetLedgerSavedQueriesFilePath(dataPath string) string {
+	return dataPath + "/.beancount-gs/saved_queries.json"
+}
+
+func GetLedgerRecurringRulesFilePath(dataPath string) string {
+	return dataPath + "/.beancount-gs/recurring.json"
+}
+
+func GetLedgerDuplicateIgnoreFilePath(dataPath string) string {
+	return dataPath + "/.beancount-gs/duplicate_ignore.json"
+}
+
+func GetLedgerIdempotencyFilePath(dataPath string) string {
+	return dataPath + "/.beancount-gs/idempotency.json"
+}
+
 func GetLedgerAccountTypeFilePath(dataPath string) string {
 	return dataPath + "/.beancount-gs/account_type.json"
 }
@@ -70,3 +86,7 @@ func GetLedgerEventsFilePath(dataPath string) string {
 	LogInfo(dataPath, dataPath+"/event/events.bean")
 	return dataPath + "/event/events.bean"
 }
+
+func GetLedgerCommodityPrecisionFilePath(dataPath string) string {
+	return dataPath + "/.beancount-gs/commodity_precision.json"
+}
@@ -0,0 +1,182 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// 过账的格式化和平衡校验
+
+var (
+	ErrInvalidPosting        = errors.New("invalid posting")
+	ErrTransactionNotBalance = errors.New("transaction does not balance")
+)
+
+// CheckCurrency 币种以大写字母开头，由大写字母、数字和 '._- 组成
+func CheckCurrency(currency string) error {
+	if !beanCurrencyRegexp.MatchString(currency) {
+		return fmt.Errorf("%w: currency %s", ErrInvalidPosting, currency)
+	}
+	return nil
+}
+
+// Check 成本的币种和日期是否合法，单位成本和总成本不能同时设置
+func (spec CostSpec) Check() error {
+	if spec.Number != nil && spec.NumberTotal != nil {
+		return fmt.Errorf("%w: cost number and total cannot both be set", ErrInvalidPosting)
+	}
+	if spec.Number != nil && spec.Number.IsNegative() || spec.NumberTotal != nil && spec.NumberTotal.IsNegative() {
+		return fmt.Errorf("%w: cost must not be negative", ErrInvalidPosting)
+	}
+	if (spec.Number != nil || spec.NumberTotal != nil) && spec.Currency == "" {
+		return fmt.Errorf("%w: cost currency is required", ErrInvalidPosting)
+	}
+	if spec.Currency != "" {
+		if err := CheckCurrency(spec.Currency); err != nil {
+			return err
+		}
+	}
+	if spec.Date != "" && !metaDateRegexp.MatchString(spec.Date) {
+		return fmt.Errorf("%w: cost date %s", ErrInvalidPosting, spec.Date)
+	}
+	return nil
+}
+
+// String 按默认小数位数输出成本
+func (spec CostSpec) String() string {
+	return spec.Format(nil)
+}
+
+// Format 输出成本，如 {100.00 USD, 2024-01-02, "lot-1"}、{{1000.00 USD}}，没有任何内容时为 {}（按持仓匹配成本）
+func (spec CostSpec) Format(precisions CommodityPrecisions) string {
+	parts := make([]string, 0, 3)
+	number := spec.Number
+	if number == nil {
+		number = spec.NumberTotal
+	}
+	if number != nil {
+		parts = append(parts, strings.TrimSpace(precisions.Format(*number, spec.Currency)+" "+spec.Currency))
+	} else if spec.Currency != "" {
+		parts = append(parts, spec.Currency)
+	}
+	if spec.Date != "" {
+		parts = append(parts, spec.Date)
+	}
+	if spec.Label != "" {
+		parts = append(parts, FormatBeanString(spec.Label))
+	}
+	if spec.NumberTotal != nil {
+		return "{{" + strings.Join(parts, ", ") + "}}"
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Check 价格不能为负数，币种必须合法
+func (spec PriceSpec) Check() error {
+	if spec.Number == nil || spec.Number.IsNegative() {
+		return fmt.Errorf("%w: price must not be negative", ErrInvalidPosting)
+	}
+	return CheckCurrency(spec.Currency)
+}
+
+// String 按默认小数位数输出价格
+func (spec PriceSpec) String() string {
+	return spec.Format(nil)
+}
+
+// Format 输出单价 @ 或总价 @@
+func (spec PriceSpec) Format(precisions CommodityPrecisions) string {
+	op := "@"
+	if spec.Total {
+		op = "@@"
+	}
+	number := decimalPtrString(spec.Number)
+	if spec.Number != nil {
+		number = precisions.Format(*spec.Number, spec.Currency)
+	}
+	return fmt.Sprintf("%s %s %s", op, number, spec.Currency)
+}
+
+// FormatPosting 输出过账（不含缩进）：账户 数量 币种 {成本} @ 价格，数值按各自商品的小数位数输出，没有数量时只输出账户
+func FormatPosting(posting Posting, precisions CommodityPrecisions) string {
+	line := posting.Account
+	if posting.Number == nil {
+		return line
+	}
+	line += " " + precisions.Format(*posting.Number, posting.Currency) + " " + posting.Currency
+	if posting.CostSpec != nil {
+		line += " " + posting.CostSpec.Format(precisions)
+	}
+	if posting.Price != nil {
+		line += " " + posting.Price.Format(precisions)
+	}
+	return line
+}
+
+// CheckPostingsBalance 使用 decimal 计算每个币种的权重之和（成本优先，其次价格），超出 tolerance 时返回 ErrTransactionNotBalance。
+// 没有数量的过账（自动补全）吸收其币种的差额，没有币种时吸收所有币种的差额，同一币种最多一个，否则返回 ErrInvalidPosting；
+// 按持仓匹配成本且没有价格的过账无法计算权重，不做校验
+func CheckPostingsBalance(postings []Posting, tolerance decimal.Decimal) error {
+	residual := make(map[string]decimal.Decimal)
+	elided := make(map[string]bool)
+	unknownWeight := false
+	for _, posting := range postings {
+		if posting.Number == nil {
+			if elided[posting.Currency] || elided[""] || (posting.Currency == "" && len(elided) > 0) {
+				return fmt.Errorf("%w: more than one posting without number", ErrInvalidPosting)
+			}
+			elided[posting.Currency] = true
+			continue
+		}
+		weight, ok := postingSpecWeight(posting)
+		if !ok {
+			unknownWeight = true
+			continue
+		}
+		residual[weight.Currency] = residual[weight.Currency].Add(weight.Number)
+	}
+	if unknownWeight {
+		return nil
+	}
+	currencies := make([]string, 0, len(residual))
+	for currency := range residual {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		if elided[currency] || elided[""] {
+			continue
+		}
+		if residual[currency].Abs().GreaterThan(tolerance) {
+			return fmt.Errorf("%w: (%s)", ErrTransactionNotBalance, Amount{Number: residual[currency], Currency: currency})
+		}
+	}
+	return nil
+}
+
+// postingSpecWeight 按过账中填写的成本和价格计算权重，与 PostingWeight 不同，不需要记账后的成本
+func postingSpecWeight(posting Posting) (Amount, bool) {
+	if posting.Number == nil {
+		return Amount{}, false
+	}
+	units := *posting.Number
+	if spec := posting.CostSpec; spec != nil {
+		switch {
+		case spec.NumberTotal != nil && spec.Currency != "":
+			total := *spec.NumberTotal
+			if units.IsNegative() {
+				total = total.Neg()
+			}
+			return Amount{Number: total, Currency: spec.Currency}, true
+		case spec.Number != nil && spec.Currency != "":
+			return Amount{Number: units.Mul(*spec.Number), Currency: spec.Currency}, true
+		case posting.Price == nil:
+			return Amount{}, false
+		}
+	}
+	return PostingWeight(Posting{Number: posting.Number, Currency: posting.Currency, Price: posting.Price})
+}
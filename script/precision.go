@@ -0,0 +1,156 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// 商品的小数位数：账本设置优先，其次从账本已有的过账推断，都没有时使用 DefaultPrecision
+
+const (
+	DefaultPrecision int32 = 2
+	MaxPrecision     int32 = 18
+)
+
+// CommodityPrecisions 商品 -> 小数位数
+type CommodityPrecisions map[string]int32
+
+// Places 商品的小数位数
+func (p CommodityPrecisions) Places(currency string) int32 {
+	if places, ok := p[currency]; ok {
+		return places
+	}
+	return DefaultPrecision
+}
+
+// Format 按商品的小数位数输出数值，位数不足时补 0，超出的有效小数位保留不截断
+func (p CommodityPrecisions) Format(number decimal.Decimal, currency string) string {
+	places := p.Places(currency)
+	if exp := -number.Exponent(); exp > places {
+		// 去掉多余的 0 后仍超出的小数位是有效数字
+		trimmed := strings.TrimRight(strings.TrimRight(number.StringFixed(exp), "0"), ".")
+		if dot := strings.IndexByte(trimmed, '.'); dot >= 0 && int32(len(trimmed)-dot-1) > places {
+			return trimmed
+		}
+	}
+	return number.StringFixed(places)
+}
+
+// FormatString 格式化查询结果中的数值，无法解析时原样返回
+func (p CommodityPrecisions) FormatString(number string, currency string) string {
+	value, err := decimal.NewFromString(strings.TrimSpace(number))
+	if err != nil {
+		return number
+	}
+	return p.Format(value, currency)
+}
+
+// CheckPrecision 小数位数的范围为 0 ~ MaxPrecision
+func CheckPrecision(precision int32) error {
+	if precision < 0 || precision > MaxPrecision {
+		return fmt.Errorf("precision must be between 0 and %d", MaxPrecision)
+	}
+	return nil
+}
+
+// ReadCommodityPrecisionSettings 读取账本设置的商品小数位数，文件不存在时为空
+func ReadCommodityPrecisionSettings(dataPath string) (map[string]int32, error) {
+	result := make(map[string]int32)
+	filePath := GetLedgerCommodityPrecisionFilePath(dataPath)
+	if !FileIfExist(filePath) {
+		return result, nil
+	}
+	bytes, err := ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, &result); err != nil {
+		LogSystemError("Failed unmarshal config file (" + filePath + ")")
+		return nil, err
+	}
+	return result, nil
+}
+
+// WriteCommodityPrecisionSettings 保存账本设置的商品小数位数
+func WriteCommodityPrecisionSettings(dataPath string, settings map[string]int32) error {
+	filePath := GetLedgerCommodityPrecisionFilePath(dataPath)
+	if err := CreateFileIfNotExist(filePath); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return WriteFile(filePath, string(bytes))
+}
+
+type commodityUnitsRow struct {
+	Currency string `bql:"currency"`
+	Units    string `bql:"units"`
+}
+
+// InferCommodityPrecisions 从账本中的数量推断商品的小数位数（出现次数最多的位数，次数相同时取较多的位数）。
+// 使用缓存的账本解析结果，账本无法在内存中加载时才查询过账的数量
+func InferCommodityPrecisions(ledgerConfig *Config) (map[string]int32, error) {
+	if ledger, err := LoadCachedLedger(ledgerConfig); err == nil {
+		return ledger.Precisions(), nil
+	}
+	rows := make([]commodityUnitsRow, 0)
+	query := NewBQLQuery().Select("currency").SelectAs("units", "units(position)")
+	if err := BQLQueryListByCustomSelect(ledgerConfig, query, nil, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]map[int32]int)
+	for _, row := range rows {
+		fields := strings.Fields(row.Units)
+		if len(fields) == 0 {
+			continue
+		}
+		number, err := decimal.NewFromString(fields[0])
+		if err != nil {
+			continue
+		}
+		places := -number.Exponent()
+		if places < 0 {
+			places = 0
+		}
+		if counts[row.Currency] == nil {
+			counts[row.Currency] = make(map[int32]int)
+		}
+		counts[row.Currency][places]++
+	}
+	result := make(map[string]int32)
+	for currency, placeCounts := range counts {
+		best, bestCount := int32(0), -1
+		for places, count := range placeCounts {
+			if count > bestCount || (count == bestCount && places > best) {
+				best, bestCount = places, count
+			}
+		}
+		result[currency] = best
+	}
+	return result, nil
+}
+
+// GetCommodityPrecisions 账本中各商品的小数位数，推断失败时只使用账本设置
+func GetCommodityPrecisions(ledgerConfig *Config) CommodityPrecisions {
+	result := make(CommodityPrecisions)
+	inferred, err := InferCommodityPrecisions(ledgerConfig)
+	if err != nil {
+		LogError(ledgerConfig.Mail, "Failed to infer commodity precision: "+err.Error())
+	}
+	for currency, places := range inferred {
+		result[currency] = places
+	}
+	settings, err := ReadCommodityPrecisionSettings(ledgerConfig.DataPath)
+	if err != nil {
+		LogError(ledgerConfig.Mail, "Failed to read commodity precision: "+err.Error())
+	}
+	for currency, places := range settings {
+		result[currency] = places
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrQueryTimeout beancount 子进程执行超时
+var ErrQueryTimeout = errors.New("beancount query timeout")
+
+const defaultQueryTimeout = 30 * time.Second
+
+var (
+	processPoolOnce sync.Once
+	processPool     chan struct{}
+)
+
+// getProcessPool 限制同时运行的 beancount 子进程数量，默认为 CPU 核数
+func getProcessPool() chan struct{} {
+	processPoolOnce.Do(func() {
+		size := serverConfig.QueryConcurrency
+		if size <= 0 {
+			size = runtime.NumCPU()
+		}
+		processPool = make(chan struct{}, size)
+	})
+	return processPool
+}
+
+// WithContext 返回绑定 ctx 的配置副本，使用该配置执行的子进程随 ctx 取消
+func (config Config) WithContext(ctx context.Context) *Config {
+	config.ctx = ctx
+	return &config
+}
+
+// Context 配置绑定的上下文，未绑定时为 context.Background()
+func (config *Config) Context() context.Context {
+	if config.ctx == nil {
+		return context.Background()
+	}
+	return config.ctx
+}
+
+// queryTimeout 账本配置的超时时间，未配置时使用服务配置，均未配置时为 30 秒
+func (config *Config) queryTimeout() time.Duration {
+	if config.QueryTimeout > 0 {
+		return time.Duration(config.QueryTimeout) * time.Second
+	}
+	if serverConfig.QueryTimeout > 0 {
+		return time.Duration(serverConfig.QueryTimeout) * time.Second
+	}
+	return defaultQueryTimeout
+}
+
+// RunBeanCommand 执行 beancount 命令行工具，等待进程池和执行的时间都计入超时
+func RunBeanCommand(config *Config, stderr io.Writer, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(config.Context(), config.queryTimeout())
+	defer cancel()
+
+	pool := getProcessPool()
+	select {
+	case pool <- struct{}{}:
+		defer func() { <-pool }()
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		LogError(config.Mail, name+" is killed, "+ctx.Err().Error())
+		return nil, contextError(ctx)
+	}
+	return output, err
+}
+
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return ctx.Err()
+}
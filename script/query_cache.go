@@ -0,0 +1,247 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 查询结果缓存：按账本缓存 BQL 查询结果，账本文件（index.bean 及其 include 的所有文件）变化后失效
+
+var beanIncludeRegexp = regexp.MustCompile(`^include\s+"([^"]+)"`)
+
+type ledgerQueryCache struct {
+	mu          sync.Mutex
+	dataPath    string
+	files       []string
+	fingerprint string
+	entries     map[string]string
+	// ledger 内存后端解析的账本，与查询结果一起失效；ledgerErr 为账本包含不支持的语法时的加载错误
+	ledger    *Ledger
+	ledgerErr error
+	hits      uint64
+	misses    uint64
+}
+
+// QueryCacheStats 查询缓存统计
+type QueryCacheStats struct {
+	Entries int    `json:"entries"`
+	Files   int    `json:"files"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+var (
+	queryCachesMu sync.Mutex
+	queryCaches   = make(map[string]*ledgerQueryCache)
+)
+
+func getLedgerQueryCache(ledgerConfig *Config) *ledgerQueryCache {
+	dataPath := filepath.Clean(ledgerConfig.DataPath)
+	queryCachesMu.Lock()
+	defer queryCachesMu.Unlock()
+	cache, ok := queryCaches[dataPath]
+	if !ok {
+		cache = &ledgerQueryCache{dataPath: dataPath, entries: make(map[string]string)}
+		queryCaches[dataPath] = cache
+	}
+	return cache
+}
+
+// cachedQuery 命中缓存时直接返回结果，否则执行 query 并缓存成功的结果
+func cachedQuery(ledgerConfig *Config, bql string, query func() (string, error)) (string, error) {
+	cache := getLedgerQueryCache(ledgerConfig)
+	key := ledgerConfig.QueryBackend + "\x00" + normalizeBQL(bql)
+
+	cache.mu.Lock()
+	cache.refresh()
+	output, ok := cache.entries[key]
+	if ok {
+		cache.hits++
+	} else {
+		cache.misses++
+	}
+	fingerprint := cache.fingerprint
+	cache.mu.Unlock()
+	if ok {
+		return output, nil
+	}
+
+	output, err := query()
+	if err != nil {
+		return "", err
+	}
+	cache.mu.Lock()
+	// 查询期间文件发生变化时不缓存
+	if cache.fingerprint == fingerprint {
+		cache.entries[key] = output
+	}
+	cache.mu.Unlock()
+	return output, nil
+}
+
+// refresh 检查账本文件的修改时间和大小，变化时清空缓存并重新读取 include 关系
+func (cache *ledgerQueryCache) refresh() {
+	if cache.files != nil && cache.fingerprint != "" && statFingerprint(cache.files) == cache.fingerprint {
+		return
+	}
+	cache.files = beanIncludeFiles(filepath.Join(cache.dataPath, "index.bean"))
+	cache.fingerprint = statFingerprint(cache.files)
+	cache.entries = make(map[string]string)
+	cache.ledger, cache.ledgerErr = nil, nil
+}
+
+func (cache *ledgerQueryCache) invalidate() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.fingerprint = ""
+	cache.entries = make(map[string]string)
+	cache.ledger, cache.ledgerErr = nil, nil
+}
+
+// LoadCachedLedger 加载账本（index.bean 及其 include 的文件），解析结果按与查询结果相同的规则缓存和失效。
+// 账本包含不支持的语法时同样缓存错误，文件变化前不再重复解析
+func LoadCachedLedger(ledgerConfig *Config) (*Ledger, error) {
+	cache := getLedgerQueryCache(ledgerConfig)
+	cache.mu.Lock()
+	cache.refresh()
+	if cache.ledger != nil || cache.ledgerErr != nil {
+		defer cache.mu.Unlock()
+		return cache.ledger, cache.ledgerErr
+	}
+	fingerprint := cache.fingerprint
+	cache.mu.Unlock()
+
+	ledger, err := LoadLedger(filepath.Join(cache.dataPath, "index.bean"))
+	cache.mu.Lock()
+	// 解析期间文件发生变化时不缓存
+	if cache.fingerprint == fingerprint {
+		if err == nil {
+			cache.ledger = ledger
+		} else if errors.Is(err, ErrUnsupportedSyntax) {
+			cache.ledgerErr = err
+		}
+	}
+	cache.mu.Unlock()
+	return ledger, err
+}
+
+// resetQueryCaches 清空所有账本的查询缓存
+func resetQueryCaches() {
+	queryCachesMu.Lock()
+	defer queryCachesMu.Unlock()
+	queryCaches = make(map[string]*ledgerQueryCache)
+}
+
+// InvalidateQueryCache 文件写入后使其所在账本的查询缓存失效
+func InvalidateQueryCache(filePath string) {
+	filePath = filepath.Clean(filePath)
+	queryCachesMu.Lock()
+	caches := make([]*ledgerQueryCache, 0)
+	for dataPath, cache := range queryCaches {
+		if strings.HasPrefix(filePath, dataPath+string(filepath.Separator)) {
+			caches = append(caches, cache)
+		}
+	}
+	queryCachesMu.Unlock()
+	for _, cache := range caches {
+		cache.invalidate()
+	}
+}
+
+// GetQueryCacheStats 账本查询缓存的命中统计
+func GetQueryCacheStats(ledgerConfig *Config) QueryCacheStats {
+	cache := getLedgerQueryCache(ledgerConfig)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return QueryCacheStats{Entries: len(cache.entries), Files: len(cache.files), Hits: cache.hits, Misses: cache.misses}
+}
+
+// beanIncludeFiles 从 index.bean 开始收集 include 的所有文件（不存在的文件也会记录，创建后可以触发失效）
+func beanIncludeFiles(indexFilePath string) []string {
+	files := make([]string, 0)
+	visited := make(map[string]bool)
+	var walk func(path string)
+	walk = func(path string) {
+		path = filepath.Clean(path)
+		if visited[path] {
+			return
+		}
+		visited[path] = true
+		files = append(files, path)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			match := beanIncludeRegexp.FindStringSubmatch(strings.TrimSpace(line))
+			if match == nil {
+				continue
+			}
+			include := match[1]
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			paths := []string{include}
+			if strings.ContainsAny(include, "*?[") {
+				paths, _ = filepath.Glob(include)
+				sort.Strings(paths)
+				// 通配符所在目录新增文件时目录的修改时间会变化
+				files = append(files, filepath.Dir(include))
+			}
+			for _, p := range paths {
+				walk(p)
+			}
+		}
+	}
+	walk(indexFilePath)
+	return files
+}
+
+func statFingerprint(files []string) string {
+	var sb strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			sb.WriteString(file + ":-;")
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return md5Hex(sb.String())
+}
+
+// normalizeBQL 合并引号外的连续空白，引号内的内容保持不变
+func normalizeBQL(bql string) string {
+	var sb strings.Builder
+	var quote rune
+	space := false
+	for _, r := range strings.TrimSpace(bql) {
+		if quote != 0 {
+			sb.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteRune(' ')
+			space = false
+		}
+		if r == '\'' || r == '"' {
+			quote = r
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,241 @@
+package script
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 查询控制台：执行用户输入的只读 BQL，结果按列推断类型
+
+var ErrReadOnlyBQL = errors.New("only SELECT, BALANCES and JOURNAL statements are allowed")
+
+const (
+	DefaultQueryRowLimit = 1000
+	MaxQueryRowLimit     = 10000
+)
+
+var (
+	bqlStatementRegexp = regexp.MustCompile(`^\s*([A-Za-z]+)\b`)
+	bqlIntegerRegexp   = regexp.MustCompile(`^-?\d+$`)
+	bqlNumberRegexp    = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+	bqlDateOnlyRegexp  = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// QueryColumn 查询结果列，Type 为 integer、number、boolean、date 或 string
+type QueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// QueryTable 查询结果表，Truncated 表示结果超过行数限制被截断
+type QueryTable struct {
+	Columns   []QueryColumn   `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"`
+}
+
+// CheckReadOnlyBQL 只允许单条 SELECT/BALANCES/JOURNAL 语句
+func CheckReadOnlyBQL(bql string) error {
+	match := bqlStatementRegexp.FindStringSubmatch(bql)
+	if match == nil {
+		return ErrReadOnlyBQL
+	}
+	switch strings.ToLower(match[1]) {
+	case "select", "balances", "journal":
+	default:
+		return fmt.Errorf("%w: %s", ErrReadOnlyBQL, match[1])
+	}
+	// 引号外的分号只允许出现在末尾
+	var quote rune
+	text := strings.TrimSpace(bql)
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ';' && strings.TrimSpace(text[i+1:]) != "":
+			return fmt.Errorf("%w: multiple statements", ErrReadOnlyBQL)
+		}
+	}
+	return nil
+}
+
+// BQLQueryRecords 执行只读 BQL，返回 CSV 记录，首行为列名
+func BQLQueryRecords(ledgerConfig *Config, bql string) ([][]string, error) {
+	if err := CheckReadOnlyBQL(bql); err != nil {
+		return nil, err
+	}
+	output, err := queryByBQL(ledgerConfig, bql)
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return [][]string{{}}, nil
+	}
+	return records, nil
+}
+
+// BQLQueryTable 执行只读 BQL，最多返回 limit 行
+func BQLQueryTable(ledgerConfig *Config, bql string, limit int) (*QueryTable, error) {
+	records, err := BQLQueryRecords(ledgerConfig, bql)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueryTable(records[0], records[1:], limit), nil
+}
+
+// NewQueryTable 根据列的所有非空值推断列类型，并转换为对应的 JSON 值
+func NewQueryTable(header []string, records [][]string, limit int) *QueryTable {
+	table := &QueryTable{Columns: make([]QueryColumn, len(header)), Rows: make([][]interface{}, 0)}
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+		table.Truncated = true
+	}
+	for i, name := range header {
+		table.Columns[i] = QueryColumn{Name: strings.TrimSpace(name), Type: inferColumnType(records, i)}
+	}
+	for _, record := range records {
+		row := make([]interface{}, len(header))
+		for i := range header {
+			if i < len(record) {
+				row[i] = typedColumnValue(table.Columns[i].Type, strings.TrimSpace(record[i]))
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+// WriteQueryCSV 输出 CSV，最多 limit 行
+func WriteQueryCSV(w io.Writer, records [][]string, limit int) error {
+	writer := csv.NewWriter(w)
+	for i, record := range records {
+		if limit > 0 && i > limit {
+			break
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func inferColumnType(records [][]string, column int) string {
+	types := []string{"integer", "number", "boolean", "date"}
+	matched := make([]bool, len(types))
+	for i := range matched {
+		matched[i] = true
+	}
+	empty := true
+	for _, record := range records {
+		if column >= len(record) {
+			continue
+		}
+		v := strings.TrimSpace(record[column])
+		if v == "" {
+			continue
+		}
+		empty = false
+		matched[0] = matched[0] && bqlIntegerRegexp.MatchString(v)
+		matched[1] = matched[1] && bqlNumberRegexp.MatchString(v)
+		matched[2] = matched[2] && (strings.EqualFold(v, "true") || strings.EqualFold(v, "false"))
+		matched[3] = matched[3] && bqlDateOnlyRegexp.MatchString(v)
+	}
+	if empty {
+		return "string"
+	}
+	for i, t := range types {
+		if matched[i] {
+			return t
+		}
+	}
+	return "string"
+}
+
+func typedColumnValue(columnType string, v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	switch columnType {
+	case "integer", "number":
+		// json.Number 保留原始精度
+		return json.Number(v)
+	case "boolean":
+		return strings.EqualFold(v, "true")
+	}
+	return v
+}
+
+// LedgerQueryDirectives 账本文件中的 query 指令。文件中有无法解析的指令（如 plugin）时逐条解析该文件的 query 指令，
+// 无法解析的 query 指令和无法读取的文件以错误返回
+func LedgerQueryDirectives(ledgerConfig *Config) ([]*Entry, []error) {
+	result := make([]*Entry, 0)
+	errs := make([]error, 0)
+	for _, filePath := range beanIncludeFiles(filepath.Join(ledgerConfig.DataPath, "index.bean")) {
+		if !strings.HasSuffix(filePath, ".bean") || !FileIfExist(filePath) {
+			continue
+		}
+		content, err := ReadFile(filePath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries, _, err := ParseBeanContent(filePath, string(content))
+		if err != nil {
+			LogError(ledgerConfig.Mail, "Failed to parse "+filePath+", parse query directives one by one: "+err.Error())
+			var queryErrs []error
+			entries, queryErrs = parseQueryDirectives(filePath, string(content))
+			errs = append(errs, queryErrs...)
+		}
+		for _, entry := range entries {
+			if entry.Type == "query" {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result, errs
+}
+
+var (
+	queryDirectiveRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\s+query\b`)
+	// 指令的开始，query 指令到下一个指令之前结束
+	directiveStartRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}|option|include|plugin|pushtag|poptag|pushmeta|popmeta)\b`)
+)
+
+// parseQueryDirectives 单独解析文件中的每条 query 指令，行号与原文件一致
+func parseQueryDirectives(filePath string, content string) ([]*Entry, []error) {
+	entries := make([]*Entry, 0)
+	errs := make([]error, 0)
+	lines := strings.Split(content, "\n")
+	for start := 0; start < len(lines); start++ {
+		if !queryDirectiveRegexp.MatchString(lines[start]) {
+			continue
+		}
+		end := start + 1
+		for end < len(lines) && !directiveStartRegexp.MatchString(lines[end]) {
+			end++
+		}
+		text := strings.Repeat("\n", start) + strings.Join(lines[start:end], "\n")
+		parsed, _, err := ParseBeanContent(filePath, text)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		entries = append(entries, parsed...)
+		start = end - 1
+	}
+	return entries, errs
+}
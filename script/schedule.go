@@ -0,0 +1,225 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 周期交易的日期规则：cron 表达式或每 N 个月的第几日
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+const scheduleDateLayout = "2006-01-02"
+
+// cron 表达式最多向后查找的天数，避免 2 月 30 日这类永远不会匹配的表达式无限循环
+const maxScheduleScanDays = 366 * 30
+
+// Schedule 周期规则，Cron 不为空时使用 cron 表达式，否则每 Interval 个月的 DayOfMonth 日（超过当月天数时为月末）
+type Schedule struct {
+	// Cron 5 段的 cron 表达式（分 时 日 月 周），交易只记录日期，分和时只校验不参与计算
+	Cron       string `json:"cron,omitempty"`
+	DayOfMonth int    `json:"dayOfMonth,omitempty"`
+	// Interval 间隔的月数，默认为 1
+	Interval  int    `json:"interval,omitempty"`
+	StartDate string `json:"startDate"`
+	// EndDate 结束日期（包含），为空时不结束
+	EndDate string `json:"endDate,omitempty"`
+}
+
+// Check 校验开始、结束日期和 cron 表达式或每月的日期
+func (s Schedule) Check() error {
+	start, err := time.Parse(scheduleDateLayout, s.StartDate)
+	if err != nil {
+		return fmt.Errorf("%w: start date %s", ErrInvalidSchedule, s.StartDate)
+	}
+	if s.EndDate != "" {
+		end, err := time.Parse(scheduleDateLayout, s.EndDate)
+		if err != nil || end.Before(start) {
+			return fmt.Errorf("%w: end date %s", ErrInvalidSchedule, s.EndDate)
+		}
+	}
+	if s.Cron != "" {
+		_, err = parseCron(s.Cron)
+		return err
+	}
+	if s.DayOfMonth < 1 || s.DayOfMonth > 31 {
+		return fmt.Errorf("%w: day of month %d", ErrInvalidSchedule, s.DayOfMonth)
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("%w: interval %d", ErrInvalidSchedule, s.Interval)
+	}
+	return nil
+}
+
+// Occurrences 返回 after 之后（不含，为空时从开始日期开始）到 until（包含，为空时不限制）之间的日期，
+// limit 大于 0 时最多返回 limit 个。until 和结束日期都为空时 limit 必须大于 0
+func (s Schedule) Occurrences(after string, until string, limit int) ([]string, error) {
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	start, _ := time.Parse(scheduleDateLayout, s.StartDate)
+	if after != "" {
+		afterDate, err := time.Parse(scheduleDateLayout, after)
+		if err != nil {
+			return nil, fmt.Errorf("%w: date %s", ErrInvalidSchedule, after)
+		}
+		if !afterDate.Before(start) {
+			start = afterDate.AddDate(0, 0, 1)
+		}
+	}
+	var end *time.Time
+	for _, date := range []string{s.EndDate, until} {
+		if date == "" {
+			continue
+		}
+		t, err := time.Parse(scheduleDateLayout, date)
+		if err != nil {
+			return nil, fmt.Errorf("%w: date %s", ErrInvalidSchedule, date)
+		}
+		if end == nil || t.Before(*end) {
+			end = &t
+		}
+	}
+	if end == nil && limit <= 0 {
+		return nil, fmt.Errorf("%w: occurrences without end", ErrInvalidSchedule)
+	}
+
+	next := s.monthlyNext
+	if s.Cron != "" {
+		cron, _ := parseCron(s.Cron)
+		next = cron.next
+	}
+	result := make([]string, 0)
+	for date, ok := next(start); ok; date, ok = next(date.AddDate(0, 0, 1)) {
+		if end != nil && date.After(*end) {
+			break
+		}
+		result = append(result, date.Format(scheduleDateLayout))
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// monthlyNext 不早于 from 的下一个日期
+func (s Schedule) monthlyNext(from time.Time) (time.Time, bool) {
+	interval := s.Interval
+	if interval == 0 {
+		interval = 1
+	}
+	first, _ := time.Parse(scheduleDateLayout, s.StartDate)
+	// 从开始月份起每 interval 个月
+	months := (from.Year()-first.Year())*12 + int(from.Month()-first.Month())
+	if months < 0 {
+		months = 0
+	}
+	months = months / interval * interval
+	for {
+		month := time.Date(first.Year(), first.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+		day := s.DayOfMonth
+		if last := month.AddDate(0, 1, -1).Day(); day > last {
+			day = last
+		}
+		date := month.AddDate(0, 0, day-1)
+		if !date.Before(from) && !date.Before(first) {
+			return date, true
+		}
+		months += interval
+	}
+}
+
+type cronSchedule struct {
+	days     []bool
+	months   []bool
+	weekdays []bool
+	// 日和周都不是 * 时满足其一即可（与 cron 一致）
+	dayRestricted     bool
+	weekdayRestricted bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron %s must have 5 fields", ErrInvalidSchedule, expr)
+	}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([][]bool, 5)
+	restricted := make([]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: cron %s", err, expr)
+		}
+		sets[i], restricted[i] = set, field != "*"
+	}
+	// 周日可以写为 0 或 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{days: sets[2], months: sets[3], weekdays: sets[4], dayRestricted: restricted[2], weekdayRestricted: restricted[4]}, nil
+}
+
+// parseCronField 解析 *、n、a-b、*/n、a/n、a-b/n 及逗号分隔的列表
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%w: step %s", ErrInvalidSchedule, part)
+			}
+			step, stepped, part = n, true, part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("%w: value %s", ErrInvalidSchedule, part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("%w: value %s", ErrInvalidSchedule, part)
+				}
+			} else if stepped {
+				// a/n 从 a 开始每 n 个直到最大值
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%w: value %s out of range %d-%d", ErrInvalidSchedule, part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(date time.Time) bool {
+	if !c.months[int(date.Month())] {
+		return false
+	}
+	day, weekday := c.days[date.Day()], c.weekdays[int(date.Weekday())]
+	if c.dayRestricted && c.weekdayRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// next 不早于 from 的下一个匹配的日期
+func (c *cronSchedule) next(from time.Time) (time.Time, bool) {
+	for i := 0; i < maxScheduleScanDays; i++ {
+		date := from.AddDate(0, 0, i)
+		if c.matches(date) {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
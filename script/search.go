@@ -0,0 +1,282 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+)
+
+// 交易搜索语法：空格分隔的条件之间为 AND 关系，条件前加 - 表示取反
+//   payee:星巴克 narration:午饭 tag:trip #trip link:abc ^abc account:Expenses:* currency:CNY
+//   amount>30 amount<=100 date>=2024-03 2024 2024-05 2024-03-15..2024-04-14
+//   其它文本同时匹配 payee 和 narration，包含空格的值使用双引号
+
+var ErrSearchSyntax = errors.New("invalid search syntax")
+
+// SearchSyntaxError 搜索语法错误，Pos 为出错位置（从 0 开始的字符下标）
+type SearchSyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *SearchSyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+func (e *SearchSyntaxError) Unwrap() error {
+	return ErrSearchSyntax
+}
+
+var searchDateRegexp = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+type searchTerm struct {
+	pos      int
+	negate   bool
+	key      string
+	op       string
+	value    string
+	valuePos int
+}
+
+// ParseSearchQuery 将搜索语法转换为查询条件，空查询返回 nil
+func ParseSearchQuery(q string) (BQLCondition, error) {
+	terms, err := lexSearchQuery([]rune(q))
+	if err != nil {
+		return nil, err
+	}
+	conditions := make([]BQLCondition, 0, len(terms))
+	for _, term := range terms {
+		cond, err := term.condition()
+		if err != nil {
+			return nil, err
+		}
+		if term.negate {
+			cond = Not(cond)
+		}
+		conditions = append(conditions, cond)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	return And(conditions...), nil
+}
+
+func lexSearchQuery(runes []rune) ([]searchTerm, error) {
+	terms := make([]searchTerm, 0)
+	i := 0
+	for i < len(runes) {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		term := searchTerm{pos: i}
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			term.negate = true
+			i++
+		}
+		// key 后紧跟 : 或比较运算符
+		j := i
+		for j < len(runes) && (runes[j] == '_' || (runes[j] < unicode.MaxASCII && unicode.IsLetter(runes[j]))) {
+			j++
+		}
+		if j > i && j < len(runes) {
+			op := searchOperator(runes[j:])
+			if op != "" {
+				term.key = strings.ToLower(string(runes[i:j]))
+				term.op = op
+				i = j + len([]rune(op))
+			}
+		}
+		term.valuePos = i
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, &SearchSyntaxError{Pos: i, Message: "unterminated quote"}
+			}
+			term.value = string(runes[i+1 : end])
+			i = end + 1
+			if i < len(runes) && !unicode.IsSpace(runes[i]) {
+				return nil, &SearchSyntaxError{Pos: i, Message: "expected space after quote"}
+			}
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			term.value = string(runes[i:end])
+			i = end
+		}
+		if term.value == "" {
+			return nil, &SearchSyntaxError{Pos: term.valuePos, Message: "missing value"}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func searchOperator(runes []rune) string {
+	switch runes[0] {
+	case ':', '=':
+		return string(runes[0])
+	case '>', '<':
+		if len(runes) > 1 && runes[1] == '=' {
+			return string(runes[:2])
+		}
+		return string(runes[0])
+	}
+	return ""
+}
+
+func (term searchTerm) errorf(format string, args ...interface{}) error {
+	return &SearchSyntaxError{Pos: term.valuePos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (term searchTerm) condition() (BQLCondition, error) {
+	switch term.key {
+	case "", "amount", "date":
+	case "payee", "narration", "desc", "tag", "link", "account", "currency":
+		if term.op != ":" {
+			return nil, &SearchSyntaxError{Pos: term.pos, Message: fmt.Sprintf("operator %s is not supported by %s", term.op, term.key)}
+		}
+	default:
+		return nil, &SearchSyntaxError{Pos: term.pos, Message: "unknown field " + term.key}
+	}
+	switch term.key {
+	case "":
+		return term.textCondition()
+	case "payee":
+		return HasSubstring("payee", term.value), nil
+	case "narration", "desc":
+		return HasSubstring("narration", term.value), nil
+	case "tag":
+		return Contains("tags", strings.TrimPrefix(term.value, "#")), nil
+	case "link":
+		return Contains("links", strings.TrimPrefix(term.value, "^")), nil
+	case "account":
+		return accountGlobCondition(term.value), nil
+	case "currency":
+		return Eq("currency", strings.ToUpper(term.value)), nil
+	case "amount":
+		number, err := decimal.NewFromString(term.value)
+		if err != nil {
+			return nil, term.errorf("invalid amount %s", term.value)
+		}
+		op := term.op
+		if op == ":" {
+			op = "="
+		}
+		// 按金额的绝对值比较，支出和收入都可以用 amount>30 搜索
+		return Compare("abs(number)", op, number.Abs()), nil
+	}
+	return term.dateCondition()
+}
+
+// textCondition 无 key 的条件：#tag、^link、日期或日期范围，其它文本匹配 payee 或 narration
+func (term searchTerm) textCondition() (BQLCondition, error) {
+	value := term.value
+	switch {
+	case strings.HasPrefix(value, "#") && len(value) > 1:
+		return Contains("tags", value[1:]), nil
+	case strings.HasPrefix(value, "^") && len(value) > 1:
+		return Contains("links", value[1:]), nil
+	case strings.Contains(value, ".."):
+		parts := strings.SplitN(value, "..", 2)
+		if (parts[0] == "" || searchDateRegexp.MatchString(parts[0])) && (parts[1] == "" || searchDateRegexp.MatchString(parts[1])) {
+			return term.dateRangeCondition(parts[0], parts[1])
+		}
+	case searchDateRegexp.MatchString(value):
+		return term.dateRangeCondition(value, value)
+	}
+	return Or(HasSubstring("payee", value), HasSubstring("narration", value)), nil
+}
+
+func (term searchTerm) dateCondition() (BQLCondition, error) {
+	start, end, err := term.parseDate(term.value)
+	if err != nil {
+		return nil, err
+	}
+	switch term.op {
+	case ">":
+		return Compare("date", ">=", end), nil
+	case ">=":
+		return Compare("date", ">=", start), nil
+	case "<":
+		return Compare("date", "<", start), nil
+	case "<=":
+		return Compare("date", "<", end), nil
+	}
+	return And(Compare("date", ">=", start), Compare("date", "<", end)), nil
+}
+
+// dateRangeCondition from..to，两端均包含，为空时不限制
+func (term searchTerm) dateRangeCondition(from string, to string) (BQLCondition, error) {
+	conditions := make([]BQLCondition, 0, 2)
+	if from != "" {
+		start, _, err := term.parseDate(from)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, Compare("date", ">=", start))
+	}
+	if to != "" {
+		_, end, err := term.parseDate(to)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, Compare("date", "<", end))
+	}
+	return And(conditions...), nil
+}
+
+// parseDate 解析 2024、2024-05、2024-05-03，返回 [start, end) 区间
+func (term searchTerm) parseDate(value string) (time.Time, time.Time, error) {
+	var start time.Time
+	var err error
+	switch len(value) {
+	case 4:
+		start, err = time.Parse("2006", value)
+		if err == nil {
+			return start, start.AddDate(1, 0, 0), nil
+		}
+	case 7:
+		start, err = time.Parse("2006-01", value)
+		if err == nil {
+			return start, start.AddDate(0, 1, 0), nil
+		}
+	case 10:
+		start, err = time.Parse("2006-01-02", value)
+		if err == nil {
+			return start, start.AddDate(0, 0, 1), nil
+		}
+	}
+	return start, start, term.errorf("invalid date %s", value)
+}
+
+// accountGlobCondition 账户通配符，* 匹配任意字符，? 匹配单个字符，不含通配符时按前缀匹配
+func accountGlobCondition(glob string) BQLCondition {
+	if !strings.ContainsAny(glob, "*?") {
+		return HasPrefix("account", glob)
+	}
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return Match("account", sb.String())
+}
@@ -0,0 +1,184 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 交易首行（日期、标记、payee、narration、tags、links）的修改，保留其它内容和行尾注释
+
+var (
+	ErrInvalidLink = errors.New("invalid link")
+	ErrInvalidTag  = errors.New("invalid tag")
+	ErrInvalidFlag = errors.New("invalid flag")
+)
+
+var beanLinkRegexp = regexp.MustCompile(`^[A-Za-z0-9\-_/.]+$`)
+
+// CheckLink link 只能包含字母、数字和 -_/.
+func CheckLink(link string) error {
+	if !beanLinkRegexp.MatchString(link) {
+		return fmt.Errorf("%w: %s", ErrInvalidLink, link)
+	}
+	return nil
+}
+
+// CheckTag tag 与 link 的字符规则相同
+func CheckTag(tag string) error {
+	if !beanLinkRegexp.MatchString(tag) {
+		return fmt.Errorf("%w: %s", ErrInvalidTag, tag)
+	}
+	return nil
+}
+
+const (
+	FlagCleared = "*"
+	FlagPending = "!"
+)
+
+// CheckFlag 交易标记只支持 *（已确认）和 !（待确认）
+func CheckFlag(flag string) error {
+	if flag != FlagCleared && flag != FlagPending {
+		return fmt.Errorf("%w: %s", ErrInvalidFlag, flag)
+	}
+	return nil
+}
+
+// IsTransactionHeader 首行是交易（日期后为 *、! 或 txn）。pad 生成的交易（标记 P）的行号指向 pad 指令，不是交易首行
+func IsTransactionHeader(header string) bool {
+	tokens, _ := splitHeader(header)
+	if len(tokens) < 2 {
+		return false
+	}
+	flag := tokens[1].text
+	return flag == FlagCleared || flag == FlagPending || flag == "txn"
+}
+
+type headerToken struct {
+	text  string
+	start int
+	end   int
+}
+
+// splitHeader 将交易首行拆分为 token（引号内的字符串为一个 token）和行尾注释
+func splitHeader(header string) ([]headerToken, string) {
+	tokens := make([]headerToken, 0)
+	i := 0
+	for i < len(header) {
+		ch := header[i]
+		if ch == ' ' || ch == '\t' || ch == '\r' {
+			i++
+			continue
+		}
+		if ch == ';' {
+			return tokens, header[i:]
+		}
+		start := i
+		if ch == '"' {
+			i++
+			for i < len(header) && header[i] != '"' {
+				if header[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if i > len(header) {
+				i = len(header)
+			}
+		} else {
+			for i < len(header) && header[i] != ' ' && header[i] != '\t' && header[i] != '\r' && header[i] != '"' {
+				i++
+			}
+		}
+		tokens = append(tokens, headerToken{text: header[start:i], start: start, end: i})
+	}
+	return tokens, ""
+}
+
+// AddHeaderLink 在交易首行末尾（行尾注释之前）添加 link，已存在时不变
+func AddHeaderLink(header string, link string) string {
+	return addHeaderToken(header, "^"+link)
+}
+
+// RemoveHeaderLink 删除交易首行中的 link 及其前面的空白
+func RemoveHeaderLink(header string, link string) string {
+	return removeHeaderToken(header, "^"+link)
+}
+
+// AddHeaderTag 在交易首行末尾（行尾注释之前）添加 tag，已存在时不变
+func AddHeaderTag(header string, tag string) string {
+	return addHeaderToken(header, "#"+tag)
+}
+
+// RemoveHeaderTag 删除交易首行中的 tag 及其前面的空白
+func RemoveHeaderTag(header string, tag string) string {
+	return removeHeaderToken(header, "#"+tag)
+}
+
+func addHeaderToken(header string, text string) string {
+	tokens, comment := splitHeader(header)
+	for _, token := range tokens {
+		if token.text == text {
+			return header
+		}
+	}
+	body := strings.TrimRight(header[:len(header)-len(comment)], " \t\r") + " " + text
+	if comment != "" {
+		body += " " + comment
+	}
+	return body
+}
+
+func removeHeaderToken(header string, text string) string {
+	tokens, _ := splitHeader(header)
+	for i, token := range tokens {
+		if token.text != text {
+			continue
+		}
+		start := token.start
+		if i > 0 {
+			start = tokens[i-1].end
+		}
+		return header[:start] + header[token.end:]
+	}
+	return header
+}
+
+// SetHeaderPayee 设置交易首行的 payee：有 payee 和 narration 时替换 payee，只有 narration 时在其前面插入 payee
+func SetHeaderPayee(header string, payee string) string {
+	tokens, _ := splitHeader(header)
+	if len(tokens) < 2 {
+		return header
+	}
+	quoted := make([]headerToken, 0, 2)
+	for _, token := range tokens[2:] {
+		if !strings.HasPrefix(token.text, "\"") {
+			break
+		}
+		quoted = append(quoted, token)
+	}
+	switch len(quoted) {
+	case 0:
+		flag := tokens[1]
+		return header[:flag.end] + " " + FormatBeanString(payee) + " \"\"" + header[flag.end:]
+	case 1:
+		return header[:quoted[0].start] + FormatBeanString(payee) + " " + header[quoted[0].start:]
+	}
+	return header[:quoted[0].start] + FormatBeanString(payee) + header[quoted[0].end:]
+}
+
+// SetHeaderFlag 替换交易首行日期后的标记（* ! 或 txn），只修改标记本身
+func SetHeaderFlag(header string, flag string) string {
+	tokens, _ := splitHeader(header)
+	if len(tokens) < 2 {
+		return header
+	}
+	token := tokens[1]
+	if token.text != "txn" && len(token.text) != 1 {
+		return header
+	}
+	return header[:token.start] + flag + header[token.end:]
+}
@@ -2,18 +2,18 @@ package script
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 	"io/ioutil"
 	"math/rand"
 	"net"
-	"os/exec"
 	"time"
 )
 
-func checkCommandExists(command string) bool {
-	cmd := exec.Command(command, "--version")
-	_, err := cmd.Output()
+func checkCommandExists(config *Config, command string) bool {
+	_, err := RunBeanCommand(config, nil, command, "--version")
 	return err == nil
 }
 
@@ -115,3 +115,8 @@ func GetMonth(date string) (string, error) {
 	formattedDate := parsedDate.Format("2006-01")
 	return formattedDate, nil
 }
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
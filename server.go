@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"time"
 )
 
 func InitServerFiles() error {
@@ -33,7 +34,8 @@ func AuthorizedHandler() gin.HandlerFunc {
 		ledgerId := c.GetHeader("ledgerId")
 		ledgerConfig := script.GetLedgerConfig(ledgerId)
 		if ledgerConfig != nil {
-			c.Set("LedgerConfig", ledgerConfig)
+			// 查询子进程随请求取消
+			c.Set("LedgerConfig", ledgerConfig.WithContext(c.Request.Context()))
 			c.Next()
 		} else {
 			service.Unauthorized(c)
@@ -69,6 +71,8 @@ func RegisterRouter(router *gin.Engine) {
 		authorized.POST("/account/refresh", service.RefreshAccountCache)
 		authorized.POST("/commodity/price", service.SyncCommodityPrice)
 		authorized.GET("/commodity/currencies", service.QueryAllCurrencies)
+		authorized.GET("/commodity/precision", service.QueryCommodityPrecisions)
+		authorized.POST("/commodity/precision", service.UpdateCommodityPrecision)
 		authorized.GET("/stats/months", service.MonthsList)
 		authorized.GET("/stats/total", service.StatsTotal)
 		authorized.GET("/stats/payee", service.StatsPayee)
@@ -81,12 +85,32 @@ func RegisterRouter(router *gin.Engine) {
 		authorized.GET("/stats/commodity/price", service.StatsCommodityPrice)
 		authorized.GET("/transaction/detail", service.QueryTransactionDetailById)
 		authorized.GET("/transaction/raw", service.QueryTransactionRawTextById)
+		authorized.GET("/transaction/search", service.SearchTransactions)
 		authorized.GET("/transaction", service.QueryTransactions)
-		authorized.POST("/transaction", service.AddTransactions)
+		authorized.POST("/transaction", service.IdempotencyHandler(), service.AddTransactions)
 		authorized.POST("/transaction/raw", service.UpdateTransactionRawTextById)
 		authorized.DELETE("/transaction", service.DeleteTransactionById)
-		authorized.POST("/transaction/batch", service.AddBatchTransactions)
+		authorized.POST("/transaction/batch", service.IdempotencyHandler(), service.AddBatchTransactions)
+		authorized.POST("/transaction/bulk", service.BulkEditTransactions)
+		authorized.POST("/transaction/clear", service.ClearTransactions)
+		authorized.GET("/transaction/duplicate", service.QueryDuplicateTransactions)
+		authorized.POST("/transaction/duplicate", service.ResolveDuplicateTransactions)
+		authorized.GET("/transaction/duplicate/ignore", service.QueryDuplicateIgnores)
+		authorized.DELETE("/transaction/duplicate/ignore", service.DeleteDuplicateIgnore)
+		authorized.POST("/transaction/uuid", service.BackfillTransactionUUIDs)
 		authorized.GET("/transaction/payee", service.QueryTransactionPayees)
+		authorized.GET("/transaction/link", service.QueryTransactionsByLink)
+		authorized.POST("/transaction/link", service.AddTransactionLink)
+		authorized.DELETE("/transaction/link", service.DeleteTransactionLink)
+		authorized.GET("/transaction/installment", service.QueryInstallment)
+		authorized.DELETE("/transaction/installment", service.CancelInstallment)
+		authorized.GET("/transaction/recurring", service.QueryRecurringRules)
+		authorized.POST("/transaction/recurring", service.SaveRecurringRule)
+		authorized.DELETE("/transaction/recurring", service.DeleteRecurringRule)
+		authorized.POST("/transaction/recurring/pause", service.PauseRecurringRule)
+		authorized.POST("/transaction/recurring/skip", service.SkipRecurringRule)
+		authorized.GET("/transaction/recurring/preview", service.PreviewRecurringRule)
+		authorized.POST("/transaction/recurring/run", service.RunRecurringRules)
 		authorized.GET("/transaction/template", service.QueryTransactionTemplates)
 		authorized.POST("/transaction/template", service.AddTransactionTemplate)
 		authorized.DELETE("/transaction/template", service.DeleteTransactionTemplate)
@@ -102,6 +126,12 @@ func RegisterRouter(router *gin.Engine) {
 		authorized.POST("/import/icbc", service.ImportICBCCSV)
 		authorized.POST("/import/abc", service.ImportABCCSV)
 		authorized.GET("/ledger/check", service.CheckLedger)
+		authorized.GET("/ledger/cache", service.QueryLedgerCacheStats)
+		authorized.POST("/query", service.QueryBQL)
+		authorized.GET("/query/saved", service.QuerySavedQueries)
+		authorized.POST("/query/saved", service.SaveQuery)
+		authorized.DELETE("/query/saved", service.DeleteSavedQuery)
+		authorized.POST("/query/saved/run", service.RunSavedQuery)
 		authorized.DELETE("/ledger", service.DeleteLedger)
 	}
 }
@@ -135,6 +165,8 @@ func main() {
 			return
 		}
 	}
+	// 定时生成到期的周期交易，之后创建的账本也会处理
+	service.StartRecurringScheduler(time.Hour)
 	// gin 日志设置
 	gin.DisableConsoleColor()
 	fs, _ := os.Create("logs/gin.log")
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/beancount-gs/script"
 	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
 	"regexp"
 	"sort"
 	"strings"
@@ -29,19 +30,22 @@ func QueryValidAccount(c *gin.Context) {
 }
 
 type accountPosition struct {
-	Account        string `json:"account"`
-	MarketPosition string `json:"market_position"`
-	Position       string `json:"position"`
+	Account        string `bql:"account" json:"account"`
+	MarketPosition string `bql:"market_position" json:"market_position"`
+	Position       string `bql:"position" json:"position"`
 }
 
 func QueryAllAccount(c *gin.Context) {
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
 
-	bql := fmt.Sprintf("select '\\', account, '\\', sum(convert(value(position), '%s')) as market_position, '\\', sum(convert(value(position), currency)) as position, '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		Select("account").
+		SelectAs("market_position", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency).
+		SelectAs("position", "sum(convert(value(position), currency))")
 	accountPositions := make([]accountPosition, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, nil, &accountPositions)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, nil, &accountPositions)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 	// 将查询结果放入 map 中方便查询账户金额
@@ -300,6 +304,13 @@ func BalanceAccount(c *gin.Context) {
 		InternalError(c, err.Error())
 		return
 	}
+	number, err := decimal.NewFromString(accountForm.Number)
+	if err != nil {
+		BadRequest(c, "Invalid number "+accountForm.Number)
+		return
+	}
+	// 断言金额按币种的小数位数写入
+	accountForm.Number = script.GetCommodityPrecisions(ledgerConfig).Format(number, acc.Currency)
 	todayStr := today.Format("2006-01-02")
 	yesterdayStr := today.AddDate(0, 0, -1).Format("2006-01-02")
 	month := today.Format("2006-01")
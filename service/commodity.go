@@ -2,8 +2,11 @@ package service
 
 import (
 	"fmt"
+	"sort"
+
 	"github.com/beancount-gs/script"
 	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
 )
 
 type SyncCommodityPriceForm struct {
@@ -19,11 +22,19 @@ func SyncCommodityPrice(c *gin.Context) {
 		return
 	}
 
+	price, err := decimal.NewFromString(syncCommodityPriceForm.Price)
+	if err != nil || price.IsNegative() {
+		BadRequest(c, "Invalid price "+syncCommodityPriceForm.Price)
+		return
+	}
+
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	// 价格按记账货币的小数位数写入
+	syncCommodityPriceForm.Price = script.GetCommodityPrecisions(ledgerConfig).Format(price, ledgerConfig.OperatingCurrency)
 	filePath := script.GetLedgerPriceFilePath(ledgerConfig.DataPath)
 	line := fmt.Sprintf("%s price %s %s %s", syncCommodityPriceForm.Date, syncCommodityPriceForm.Commodity, syncCommodityPriceForm.Price, ledgerConfig.OperatingCurrency)
 	// 写入文件
-	err := script.AppendFileInNewLine(filePath, line)
+	err = script.AppendFileInNewLine(filePath, line)
 	if err != nil {
 		InternalError(c, err.Error())
 		return
@@ -44,3 +55,72 @@ func QueryAllCurrencies(c *gin.Context) {
 	currency := script.RefreshLedgerCurrency(ledgerConfig)
 	OK(c, currency)
 }
+
+type CommodityPrecision struct {
+	Currency  string `json:"currency"`
+	Precision int32  `json:"precision"`
+	// Configured 为 true 表示账本设置的小数位数，否则为从账本推断
+	Configured bool `json:"configured"`
+}
+
+// QueryCommodityPrecisions 账本中各商品的小数位数
+func QueryCommodityPrecisions(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	settings, err := script.ReadCommodityPrecisionSettings(ledgerConfig.DataPath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	result := make([]CommodityPrecision, 0)
+	for currency, precision := range script.GetCommodityPrecisions(ledgerConfig) {
+		_, configured := settings[currency]
+		result = append(result, CommodityPrecision{Currency: currency, Precision: precision, Configured: configured})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Currency < result[j].Currency
+	})
+	OK(c, result)
+}
+
+type CommodityPrecisionForm struct {
+	Currency string `form:"currency" binding:"required" json:"currency"`
+	// Precision 为空时删除设置，恢复为从账本推断
+	Precision *int32 `form:"precision" json:"precision"`
+}
+
+// UpdateCommodityPrecision 设置商品的小数位数，写入过账、价格和余额断言时使用
+func UpdateCommodityPrecision(c *gin.Context) {
+	var form CommodityPrecisionForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if err := script.CheckCurrency(form.Currency); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if form.Precision != nil {
+		if err := script.CheckPrecision(*form.Precision); err != nil {
+			BadRequest(c, err.Error())
+			return
+		}
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	settings, err := script.ReadCommodityPrecisionSettings(ledgerConfig.DataPath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	if form.Precision == nil {
+		delete(settings, form.Currency)
+	} else {
+		settings[form.Currency] = *form.Precision
+	}
+	err = script.WriteCommodityPrecisionSettings(ledgerConfig.DataPath, settings)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, form)
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"errors"
+	"github.com/beancount-gs/script"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -40,3 +42,35 @@ func DuplicateAccount(c *gin.Context) {
 func ServerSecretNotMatch(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"code": 1008})
 }
+
+func QueryTimeout(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": 1009})
+}
+
+// EntryChanged 账本文件在读取后被修改，需要重新读取后再编辑
+func EntryChanged(c *gin.Context, message string) {
+	c.JSON(http.StatusOK, gin.H{"code": 1011, "message": message})
+}
+
+// QueryError 查询超时返回 1009，账本文件已被修改返回 1011，其它错误按服务端错误处理
+func QueryError(c *gin.Context, err error) {
+	if errors.Is(err, script.ErrQueryTimeout) {
+		QueryTimeout(c)
+		return
+	}
+	if errors.Is(err, script.ErrEntryChanged) {
+		EntryChanged(c, err.Error())
+		return
+	}
+	InternalError(c, err.Error())
+}
+
+// IdempotencyKeyReused 相同的 Idempotency-Key 已用于不同的请求
+func IdempotencyKeyReused(c *gin.Context, message string) {
+	c.JSON(http.StatusOK, gin.H{"code": 1012, "message": message})
+}
+
+// SearchSyntaxError 搜索语法错误，data.position 为出错位置
+func SearchSyntaxError(c *gin.Context, err *script.SearchSyntaxError) {
+	c.JSON(http.StatusOK, gin.H{"code": 1010, "message": err.Error(), "data": gin.H{"position": err.Pos}})
+}
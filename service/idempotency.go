@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyReplayedHeader 返回的是已保存的结果时响应头为 true
+	IdempotencyReplayedHeader   = "Idempotency-Replayed"
+	maxIdempotencyKeyLength     = 255
+	defaultIdempotencyRetention = 24 * time.Hour
+	// 处理函数没有写入账本时设置，不保存本次的结果
+	idempotencySkipKey = "idempotencySkip"
+)
+
+// IdempotencyRecord 已处理的请求，相同 Key 的请求直接返回 Response
+type IdempotencyRecord struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	// BodyHash 请求体的 sha256，相同 Key 的请求体不同时拒绝
+	BodyHash  string `json:"bodyHash"`
+	Status    int    `json:"status"`
+	Response  string `json:"response"`
+	CreatedAt string `json:"createdAt"`
+}
+
+var (
+	// 幂等记录文件的读写锁
+	idempotencyMutex sync.Mutex
+	// 处理中的请求，相同 Key 的请求等待其完成后再读取结果
+	idempotencyInFlight = make(map[string]chan struct{})
+)
+
+// idempotencyWriter 缓存响应，保存幂等记录后再返回，保存失败时返回错误
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// skipIdempotencyRecord 请求没有写入账本（如批量新增的交易全部未写入），不保存结果，可以用相同的 Key 重试
+func skipIdempotencyRecord(c *gin.Context) {
+	c.Set(idempotencySkipKey, true)
+}
+
+// IdempotencyHandler 请求头带 Idempotency-Key 时，保留期内相同 Key 的请求返回第一次成功的结果而不再写入账本。
+// 只保存成功（code 为 200）且写入了账本的结果，失败的请求可以用相同的 Key 重试。
+// 批量新增设置 continueOnError 时部分交易失败的结果也会保存，重放时返回相同的失败项，失败的交易需使用新的 Key 重新提交。
+// 无法保存幂等记录时返回错误，此时账本已经写入
+func IdempotencyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			BadRequest(c, "Header 'Idempotency-Key' is too long.")
+			c.Abort()
+			return
+		}
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			BadRequest(c, err.Error())
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+
+		ledgerConfig := script.GetLedgerConfigFromContext(c)
+		filePath := script.GetLedgerIdempotencyFilePath(ledgerConfig.DataPath)
+		inFlightKey := ledgerConfig.DataPath + "\n" + key
+		for {
+			idempotencyMutex.Lock()
+			done, ok := idempotencyInFlight[inFlightKey]
+			if !ok {
+				idempotencyInFlight[inFlightKey] = make(chan struct{})
+				idempotencyMutex.Unlock()
+				break
+			}
+			idempotencyMutex.Unlock()
+			select {
+			case <-done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+		}
+		defer func() {
+			idempotencyMutex.Lock()
+			close(idempotencyInFlight[inFlightKey])
+			delete(idempotencyInFlight, inFlightKey)
+			idempotencyMutex.Unlock()
+		}()
+
+		idempotencyMutex.Lock()
+		records, err := getLedgerIdempotencyRecords(filePath)
+		idempotencyMutex.Unlock()
+		if err != nil {
+			InternalError(c, err.Error())
+			c.Abort()
+			return
+		}
+		expiredAt := time.Now().Add(-idempotencyRetention(ledgerConfig))
+		for _, record := range records {
+			if record.Key != key || isIdempotencyRecordExpired(record, expiredAt) {
+				continue
+			}
+			if record.Path != c.Request.URL.Path || record.BodyHash != bodyHash {
+				IdempotencyKeyReused(c, "Idempotency-Key "+key+" was used by a different request")
+				c.Abort()
+				return
+			}
+			c.Header(IdempotencyReplayedHeader, "true")
+			c.Data(record.Status, "application/json; charset=utf-8", []byte(record.Response))
+			c.Abort()
+			return
+		}
+
+		writer := &idempotencyWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+		var response struct {
+			Code int `json:"code"`
+		}
+		_, skip := c.Get(idempotencySkipKey)
+		if skip || writer.Status() != http.StatusOK || json.Unmarshal(writer.body.Bytes(), &response) != nil || response.Code != 200 {
+			_, _ = writer.ResponseWriter.Write(writer.body.Bytes())
+			return
+		}
+		if err = saveIdempotencyRecord(filePath, key, IdempotencyRecord{
+			Key:       key,
+			Path:      c.Request.URL.Path,
+			BodyHash:  bodyHash,
+			Status:    writer.Status(),
+			Response:  writer.body.String(),
+			CreatedAt: time.Now().Format(time.RFC3339),
+		}, expiredAt); err != nil {
+			script.LogError(ledgerConfig.Mail, "Failed to save idempotency record: "+err.Error())
+			InternalError(c, "The request was processed, but its Idempotency-Key could not be saved: "+err.Error())
+			return
+		}
+		_, _ = writer.ResponseWriter.Write(writer.body.Bytes())
+	}
+}
+
+// saveIdempotencyRecord 保存幂等记录，同时清理过期的记录
+func saveIdempotencyRecord(filePath string, key string, record IdempotencyRecord, expiredAt time.Time) error {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	records, err := getLedgerIdempotencyRecords(filePath)
+	if err != nil {
+		return err
+	}
+	kept := make([]IdempotencyRecord, 0, len(records)+1)
+	for _, r := range records {
+		if r.Key != key && !isIdempotencyRecordExpired(r, expiredAt) {
+			kept = append(kept, r)
+		}
+	}
+	return writeLedgerIdempotencyRecords(filePath, append(kept, record))
+}
+
+// idempotencyRetention 账本配置的保留时间，未配置时使用服务配置，均未配置时为 24 小时
+func idempotencyRetention(ledgerConfig *script.Config) time.Duration {
+	if ledgerConfig.IdempotencyRetention > 0 {
+		return time.Duration(ledgerConfig.IdempotencyRetention) * time.Hour
+	}
+	if serverConfig := script.GetServerConfig(); serverConfig.IdempotencyRetention > 0 {
+		return time.Duration(serverConfig.IdempotencyRetention) * time.Hour
+	}
+	return defaultIdempotencyRetention
+}
+
+func isIdempotencyRecordExpired(record IdempotencyRecord, expiredAt time.Time) bool {
+	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
+	return err != nil || createdAt.Before(expiredAt)
+}
+
+func getLedgerIdempotencyRecords(filePath string) ([]IdempotencyRecord, error) {
+	result := make([]IdempotencyRecord, 0)
+	if script.FileIfExist(filePath) {
+		content, err := script.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(content, &result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func writeLedgerIdempotencyRecords(filePath string, records []IdempotencyRecord) error {
+	if !script.FileIfExist(filePath) {
+		err := script.CreateFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return script.WriteFile(filePath, string(content))
+}
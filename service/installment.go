@@ -0,0 +1,275 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// InstallmentLinkPrefix 同一笔分期的所有交易共用的 link 前缀
+	InstallmentLinkPrefix = "installment-"
+	// InstallmentMetaKey 分期交易的期数，如 "2/12"
+	InstallmentMetaKey = "installment"
+)
+
+// splitInstallmentNumber 将 number 拆分为 count 期，按 places 位小数对累计值取整后作差，各期之和等于 number，余数分散到各期
+func splitInstallmentNumber(number decimal.Decimal, count int, places int32) []decimal.Decimal {
+	parts := make([]decimal.Decimal, count)
+	n := decimal.NewFromInt(int64(count))
+	previous := decimal.Zero
+	for i := 0; i < count; i++ {
+		cumulative := number
+		if i < count-1 {
+			cumulative = number.Mul(decimal.NewFromInt(int64(i + 1))).Div(n).Round(places)
+		}
+		parts[i] = cumulative.Sub(previous)
+		previous = cumulative
+	}
+	return parts
+}
+
+// installmentForms 按 DivideDateList 将交易拆分为每期的交易：金额按币种的小数位数拆分且总和不变，
+// 所有交易添加相同的分期 link 和期数元数据，InstallmentFees 中的手续费/利息过账添加到每一期
+func installmentForms(ledgerConfig *script.Config, form TransactionForm) ([]TransactionForm, string, error) {
+	count := len(form.DivideDateList)
+	for _, date := range form.DivideDateList {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, "", fmt.Errorf("invalid installment date %s", date)
+		}
+	}
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
+	link := InstallmentLinkPrefix + strings.ReplaceAll(script.NewUUID(), "-", "")[:12]
+
+	entries := make([][]TransactionEntryForm, count)
+	for i := range entries {
+		entries[i] = make([]TransactionEntryForm, len(form.Entries))
+	}
+	plain := true
+	for j, entry := range form.Entries {
+		numbers := splitInstallmentNumber(entry.Number, count, precisions.Places(entry.Currency))
+		var totals []decimal.Decimal
+		if entry.Cost != nil && entry.Cost.Total != nil {
+			totals = splitInstallmentNumber(*entry.Cost.Total, count, precisions.Places(entry.Cost.Currency))
+		}
+		var prices []decimal.Decimal
+		if entry.PriceAnnotation != nil && entry.PriceAnnotation.Total {
+			prices = splitInstallmentNumber(entry.PriceAnnotation.Number, count, precisions.Places(entry.PriceAnnotation.Currency))
+		}
+		if entry.Cost != nil || entry.PriceAnnotation != nil || entry.Price.IsPositive() {
+			plain = false
+		}
+		for i := 0; i < count; i++ {
+			part := entry
+			part.Number = numbers[i]
+			if totals != nil {
+				cost := *entry.Cost
+				cost.Total = &totals[i]
+				part.Cost = &cost
+			}
+			if prices != nil {
+				price := *entry.PriceAnnotation
+				price.Number = prices[i]
+				part.PriceAnnotation = &price
+			}
+			entries[i][j] = part
+		}
+	}
+	// 各分录独立取整后每期可能差一个最小单位，只有同币种金额的交易由该币种的最后一个分录补齐差额
+	if plain {
+		balanceInstallmentEntries(ledgerConfig, form.Entries, entries)
+	}
+
+	forms := make([]TransactionForm, count)
+	for i, date := range form.DivideDateList {
+		part := form
+		part.ID = ""
+		part.Date = date
+		part.DivideDateList = nil
+		part.InstallmentFees = nil
+		part.Entries = append(entries[i], form.InstallmentFees...)
+		part.Links = append(append(make([]string, 0, len(form.Links)+1), form.Links...), link)
+		part.Meta = map[string]interface{}{InstallmentMetaKey: fmt.Sprintf("%d/%d", i+1, count)}
+		for key, value := range form.Meta {
+			if key != script.TransactionUUIDKey && key != InstallmentMetaKey {
+				part.Meta[key] = value
+			}
+		}
+		forms[i] = part
+	}
+	return forms, link, nil
+}
+
+// balanceInstallmentEntries 原交易在某币种上正好平衡时，每期该币种最后一个分录的金额取其它分录之和的相反数
+func balanceInstallmentEntries(ledgerConfig *script.Config, original []TransactionEntryForm, entries [][]TransactionEntryForm) {
+	totals := make(map[string]decimal.Decimal)
+	last := make(map[string]int)
+	for j, entry := range original {
+		if entry.Account == ledgerConfig.OpeningBalances {
+			continue
+		}
+		totals[entry.Currency] = totals[entry.Currency].Add(entry.Number)
+		last[entry.Currency] = j
+	}
+	for currency, total := range totals {
+		if !total.IsZero() {
+			continue
+		}
+		for i := range entries {
+			sum := decimal.Zero
+			for j, entry := range entries[i] {
+				if j != last[currency] && entry.Currency == currency && entry.Account != ledgerConfig.OpeningBalances {
+					sum = sum.Add(entry.Number)
+				}
+			}
+			entries[i][last[currency]].Number = sum.Neg()
+		}
+	}
+}
+
+// InstallmentPlan 同一笔分期的所有交易，Remaining 为今天之后尚未到期的期数
+type InstallmentPlan struct {
+	Link      string             `json:"link"`
+	Total     int                `json:"total"`
+	Remaining int                `json:"remaining"`
+	Items     []TransactionGroup `json:"items"`
+}
+
+func checkInstallmentLink(link string) error {
+	if !strings.HasPrefix(link, InstallmentLinkPrefix) {
+		return fmt.Errorf("%w: %s is not an installment link", script.ErrInvalidLink, link)
+	}
+	return script.CheckLink(link)
+}
+
+func queryInstallmentPlan(ledgerConfig *script.Config, link string) (*InstallmentPlan, error) {
+	if err := checkInstallmentLink(link); err != nil {
+		return nil, err
+	}
+	result, err := queryTransactionGroups(ledgerConfig, script.Contains("links", link), script.MaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	plan := &InstallmentPlan{Link: link, Total: len(result.Items), Items: result.Items}
+	today := time.Now().Format("2006-01-02")
+	for _, item := range result.Items {
+		if item.Date > today {
+			plan.Remaining++
+		}
+	}
+	return plan, nil
+}
+
+// QueryInstallment 查询分期 link 对应的所有交易
+func QueryInstallment(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	plan, err := queryInstallmentPlan(ledgerConfig, c.Query("link"))
+	if err != nil {
+		if errors.Is(err, script.ErrInvalidLink) {
+			BadRequest(c, err.Error())
+		} else {
+			QueryError(c, err)
+		}
+		return
+	}
+	OK(c, plan)
+}
+
+// CancelInstallment 删除分期中今天之后尚未到期的交易，返回删除的交易 id（uuid，没有 uuid 时为交易 id）。
+// 先定位并校验所有交易，每个文件只写回一次，写入失败时恢复已写回的文件，取消要么全部完成要么不做任何修改
+func CancelInstallment(c *gin.Context) {
+	link := c.Query("link")
+	if err := checkInstallmentLink(link); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	rows, err := queryTransactionUUIDs(ledgerConfig, script.Contains("links", link))
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+	today := time.Now().Format("2006-01-02")
+	fileRows := make(map[string][]transactionUUIDRow)
+	filePaths := make([]string, 0)
+	for _, row := range rows {
+		if row.Date <= today {
+			continue
+		}
+		filePath := filepath.Clean(row.FileName)
+		if _, ok := fileRows[filePath]; !ok {
+			filePaths = append(filePaths, filePath)
+		}
+		fileRows[filePath] = append(fileRows[filePath], row)
+	}
+	sort.Strings(filePaths)
+
+	deleted := make([]transactionUUIDRow, 0)
+	originals := make(map[string][]string)
+	updated := make(map[string][]string)
+	for _, filePath := range filePaths {
+		originals[filePath], err = script.ReadLines(filePath)
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		lines := append([]string{}, originals[filePath]...)
+		// 同一文件从后往前删除，前面的行号不受影响
+		entries := fileRows[filePath]
+		sort.Slice(entries, func(i, j int) bool {
+			a, _ := strconv.Atoi(entries[i].LineNo)
+			b, _ := strconv.Atoi(entries[j].LineNo)
+			return a > b
+		})
+		for _, row := range entries {
+			lineNo, _ := strconv.Atoi(row.LineNo)
+			start, end, err := script.FindEntryLineRange(lines, lineNo)
+			if err != nil || !strings.HasPrefix(lines[lineNo-1], row.Date) || !script.IsTransactionHeader(lines[lineNo-1]) {
+				QueryError(c, fmt.Errorf("%w: %s:%d", script.ErrEntryChanged, filePath, lineNo))
+				return
+			}
+			lines = append(lines[:start-1], lines[end:]...)
+			deleted = append(deleted, row)
+		}
+		updated[filePath] = lines
+	}
+
+	written := make([]string, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		if err = script.WriteToFile(filePath, updated[filePath]); err != nil {
+			for _, path := range append(written, filePath) {
+				if e := script.WriteToFile(path, originals[path]); e != nil {
+					script.LogError(ledgerConfig.Mail, "Failed to restore "+filepath.Base(path)+", "+e.Error())
+				}
+			}
+			InternalError(c, err.Error())
+			return
+		}
+		written = append(written, filePath)
+	}
+
+	// 按日期倒序返回
+	sort.SliceStable(deleted, func(i, j int) bool {
+		return deleted[i].Date > deleted[j].Date
+	})
+	ids := make([]string, 0, len(deleted))
+	for _, row := range deleted {
+		if row.UUID != "" {
+			ids = append(ids, row.UUID)
+		} else {
+			ids = append(ids, row.Id)
+		}
+	}
+	OK(c, ids)
+}
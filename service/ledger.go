@@ -1,13 +1,11 @@
 package service
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"sort"
 	"strings"
 	"time"
@@ -17,8 +15,8 @@ import (
 )
 
 func CheckBeancount(c *gin.Context) {
-	cmd := exec.Command("bean-query", "--version")
-	output, err := cmd.Output()
+	serverConfig := script.GetServerConfig()
+	output, err := script.RunBeanCommand(serverConfig.WithContext(c.Request.Context()), nil, "bean-query", "--version")
 	if err != nil {
 		InternalError(c, err.Error())
 		return
@@ -208,21 +206,18 @@ func DeleteLedger(c *gin.Context) {
 	OK(c, "OK")
 }
 
+// QueryLedgerCacheStats 查询结果缓存的命中情况，用于诊断
+func QueryLedgerCacheStats(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	OK(c, script.GetQueryCacheStats(ledgerConfig))
+}
+
 func CheckLedger(c *gin.Context) {
-	var stderr bytes.Buffer
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
-	cmd := exec.Command("bean-check", script.GetLedgerIndexFilePath(ledgerConfig.DataPath))
-	cmd.Stderr = &stderr
-	_, err := cmd.Output()
-	result := make([]string, 0)
+	result, err := script.GetQueryBackend(ledgerConfig).Check(ledgerConfig)
 	if err != nil {
-		errors := strings.Split(stderr.String(), "\r\n")
-		for _, e := range errors {
-			if e == "" {
-				continue
-			}
-			result = append(result, e)
-		}
+		QueryError(c, err)
+		return
 	}
 	OK(c, result)
 }
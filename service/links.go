@@ -0,0 +1,82 @@
+package service
+
+import (
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+type TransactionLinkForm struct {
+	IDs  []string `form:"ids" binding:"required" json:"ids"`
+	Link string   `form:"link" binding:"required" json:"link"`
+}
+
+// QueryTransactionsByLink 查询包含同一个 link 的所有交易
+func QueryTransactionsByLink(c *gin.Context) {
+	link := c.Query("link")
+	if err := script.CheckLink(link); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	result, err := queryTransactionGroups(ledgerConfig, script.Contains("links", link), script.MaxPageSize)
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+	OK(c, result.Items)
+}
+
+// AddTransactionLink 为多个交易添加同一个 link，id 为交易的 uuid 时只修改该笔交易
+func AddTransactionLink(c *gin.Context) {
+	var linkForm TransactionLinkForm
+	if err := c.ShouldBindJSON(&linkForm); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if err := script.CheckLink(linkForm.Link); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range linkForm.IDs {
+		err := updateTransactionHeader(ledgerConfig, id, func(header string) string {
+			return script.AddHeaderLink(header, linkForm.Link)
+		})
+		if err != nil {
+			QueryError(c, err)
+			return
+		}
+	}
+	OK(c, linkForm.Link)
+}
+
+// DeleteTransactionLink 删除交易的 link，id 可以传多次
+func DeleteTransactionLink(c *gin.Context) {
+	link := c.Query("link")
+	ids := c.QueryArray("id")
+	if len(ids) == 0 {
+		BadRequest(c, "Param 'id' must not be blank.")
+		return
+	}
+	if err := script.CheckLink(link); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range ids {
+		err := updateTransactionHeader(ledgerConfig, id, func(header string) string {
+			return script.RemoveHeaderLink(header, link)
+		})
+		if err != nil {
+			QueryError(c, err)
+			return
+		}
+	}
+	OK(c, link)
+}
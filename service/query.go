@@ -0,0 +1,65 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+type QueryForm struct {
+	BQL string `form:"bql" binding:"required" json:"bql"`
+	// Format json（默认）或 csv
+	Format string `form:"format" json:"format"`
+	Limit  int    `form:"limit" json:"limit"`
+}
+
+// QueryBQL 执行只读 BQL 查询，返回列和行，format 为 csv 时直接输出 CSV
+func QueryBQL(c *gin.Context) {
+	var queryForm QueryForm
+	if err := c.ShouldBindJSON(&queryForm); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	writeQueryResult(c, ledgerConfig, queryForm.BQL, queryForm.Format, queryForm.Limit)
+}
+
+// writeQueryResult 执行只读 BQL 并按 format 输出结果，limit 超出范围时使用默认值或上限
+func writeQueryResult(c *gin.Context, ledgerConfig *script.Config, bql string, format string, limit int) {
+	if limit <= 0 {
+		limit = script.DefaultQueryRowLimit
+	}
+	if limit > script.MaxQueryRowLimit {
+		limit = script.MaxQueryRowLimit
+	}
+	if format != "" && format != "json" && format != "csv" {
+		BadRequest(c, "Unsupported format "+format)
+		return
+	}
+
+	records, err := script.BQLQueryRecords(ledgerConfig, bql)
+	if err != nil {
+		if errors.Is(err, script.ErrReadOnlyBQL) {
+			BadRequest(c, err.Error())
+			return
+		}
+		QueryError(c, err)
+		return
+	}
+
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", "attachment; filename=query.csv")
+		if len(records)-1 > limit {
+			c.Header("X-Query-Truncated", "true")
+		}
+		c.Status(http.StatusOK)
+		if err = script.WriteQueryCSV(c.Writer, records, limit); err != nil {
+			script.LogError(ledgerConfig.Mail, "Failed to write query csv, "+err.Error())
+		}
+		return
+	}
+	OK(c, script.NewQueryTable(records[0], records[1:], limit))
+}
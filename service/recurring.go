@@ -0,0 +1,437 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+// RecurringRuleMetaKey 周期规则生成的交易在元数据中记录规则的 id
+const RecurringRuleMetaKey = "recurring"
+
+const (
+	defaultRecurringPreviewCount = 5
+	maxRecurringPreviewCount     = 100
+)
+
+// 周期规则文件的读写和生成交易互斥（后台任务和接口可能同时执行）
+var recurringMutex sync.Mutex
+
+// RecurringTransaction 周期规则生成的交易内容，日期由规则计算
+type RecurringTransaction struct {
+	Flag    string                 `json:"flag,omitempty"`
+	Payee   string                 `json:"payee,omitempty"`
+	Desc    string                 `binding:"required" json:"desc"`
+	Tags    []string               `json:"tags,omitempty"`
+	Links   []string               `json:"links,omitempty"`
+	Entries []TransactionEntryForm `json:"entries"`
+	Meta    map[string]interface{} `json:"meta,omitempty"`
+}
+
+type RecurringRule struct {
+	Id       string          `json:"id"`
+	Name     string          `binding:"required" json:"name"`
+	Schedule script.Schedule `json:"schedule"`
+	Paused   bool            `json:"paused"`
+	// Skipped 跳过（不生成交易）的日期
+	Skipped []string `json:"skipped,omitempty"`
+	// LastDate 最近一次处理到的日期，只为之后的日期生成交易
+	LastDate    string               `json:"lastDate,omitempty"`
+	Transaction RecurringTransaction `json:"transaction"`
+}
+
+// transactionForm 规则在 date 生成的交易
+func (rule RecurringRule) transactionForm(date string) TransactionForm {
+	meta := map[string]interface{}{RecurringRuleMetaKey: rule.Id}
+	for key, value := range rule.Transaction.Meta {
+		if key != RecurringRuleMetaKey && key != script.TransactionUUIDKey {
+			meta[key] = value
+		}
+	}
+	return TransactionForm{
+		Date:    date,
+		Flag:    rule.Transaction.Flag,
+		Payee:   rule.Transaction.Payee,
+		Desc:    rule.Transaction.Desc,
+		Tags:    rule.Transaction.Tags,
+		Links:   rule.Transaction.Links,
+		Entries: rule.Transaction.Entries,
+		Meta:    meta,
+	}
+}
+
+func (rule RecurringRule) isSkipped(date string) bool {
+	for _, skipped := range rule.Skipped {
+		if skipped == date {
+			return true
+		}
+	}
+	return false
+}
+
+// check 校验日期规则和交易内容（分录是否平衡、标记、link、元数据）
+func (rule RecurringRule) check(ledgerConfig *script.Config) error {
+	if err := rule.Schedule.Check(); err != nil {
+		return err
+	}
+	if len(rule.Transaction.Entries) == 0 {
+		return errors.New("recurring transaction entries must not be empty")
+	}
+	form := rule.transactionForm(rule.Schedule.StartDate)
+	if _, _, err := transactionPostings(ledgerConfig, form); err != nil {
+		return err
+	}
+	if form.Flag != "" {
+		if err := script.CheckFlag(form.Flag); err != nil {
+			return err
+		}
+	}
+	for _, link := range form.Links {
+		if err := script.CheckLink(link); err != nil {
+			return err
+		}
+	}
+	_, err := script.FormatMetaLines(form.Meta, "  ")
+	return err
+}
+
+func QueryRecurringRules(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	rules, err := getLedgerRecurringRules(script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, rules)
+}
+
+// SaveRecurringRule 新增周期规则，id 不为空时修改对应的规则（保留已处理到的日期）
+func SaveRecurringRule(c *gin.Context) {
+	var rule RecurringRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	if err := rule.check(ledgerConfig); err != nil {
+		if errors.Is(err, script.ErrTransactionNotBalance) {
+			TransactionNotBalance(c)
+		} else {
+			BadRequest(c, err.Error())
+		}
+		return
+	}
+
+	recurringMutex.Lock()
+	defer recurringMutex.Unlock()
+	filePath := script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath)
+	rules, err := getLedgerRecurringRules(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	if rule.Id == "" {
+		rule.Id = script.NewUUID()
+		rule.LastDate = ""
+		rules = append(rules, rule)
+	} else {
+		index := findRecurringRule(rules, rule.Id)
+		if index < 0 {
+			BadRequest(c, "Recurring rule "+rule.Id+" not found")
+			return
+		}
+		rule.LastDate = rules[index].LastDate
+		rules[index] = rule
+	}
+	if err = writeLedgerRecurringRules(filePath, rules); err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, rule)
+}
+
+func DeleteRecurringRule(c *gin.Context) {
+	ruleId := c.Query("id")
+	if ruleId == "" {
+		BadRequest(c, "id is not blank")
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	recurringMutex.Lock()
+	defer recurringMutex.Unlock()
+	filePath := script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath)
+	rules, err := getLedgerRecurringRules(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	index := findRecurringRule(rules, ruleId)
+	if index < 0 {
+		BadRequest(c, "Recurring rule "+ruleId+" not found")
+		return
+	}
+	rules = append(rules[:index], rules[index+1:]...)
+	if err = writeLedgerRecurringRules(filePath, rules); err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, ruleId)
+}
+
+type PauseRecurringRuleForm struct {
+	Id     string `binding:"required" json:"id"`
+	Paused bool   `json:"paused"`
+}
+
+// PauseRecurringRule 暂停或恢复周期规则，恢复后不补生成暂停期间（今天之前）的交易
+func PauseRecurringRule(c *gin.Context) {
+	var form PauseRecurringRuleForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	updateRecurringRule(c, form.Id, func(rule *RecurringRule) error {
+		if rule.Paused && !form.Paused {
+			yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+			if rule.LastDate < yesterday {
+				rule.LastDate = yesterday
+			}
+		}
+		rule.Paused = form.Paused
+		return nil
+	})
+}
+
+type SkipRecurringRuleForm struct {
+	Id   string `binding:"required" json:"id"`
+	Date string `binding:"required" json:"date"`
+}
+
+// SkipRecurringRule 跳过周期规则尚未生成的某一次交易
+func SkipRecurringRule(c *gin.Context) {
+	var form SkipRecurringRuleForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	updateRecurringRule(c, form.Id, func(rule *RecurringRule) error {
+		dates, err := rule.Schedule.Occurrences(rule.LastDate, form.Date, 0)
+		if err != nil {
+			return err
+		}
+		if len(dates) == 0 || dates[len(dates)-1] != form.Date {
+			return errors.New("date " + form.Date + " is not an upcoming occurrence")
+		}
+		if !rule.isSkipped(form.Date) {
+			rule.Skipped = append(rule.Skipped, form.Date)
+		}
+		return nil
+	})
+}
+
+func updateRecurringRule(c *gin.Context, ruleId string, update func(rule *RecurringRule) error) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	recurringMutex.Lock()
+	defer recurringMutex.Unlock()
+	filePath := script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath)
+	rules, err := getLedgerRecurringRules(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	index := findRecurringRule(rules, ruleId)
+	if index < 0 {
+		BadRequest(c, "Recurring rule "+ruleId+" not found")
+		return
+	}
+	if err = update(&rules[index]); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if err = writeLedgerRecurringRules(filePath, rules); err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, rules[index])
+}
+
+type RecurringOccurrence struct {
+	Date    string `json:"date"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+
+// PreviewRecurringRule 周期规则接下来（尚未生成交易）的 count 次日期
+func PreviewRecurringRule(c *gin.Context) {
+	ruleId := c.Query("id")
+	if ruleId == "" {
+		BadRequest(c, "id is not blank")
+		return
+	}
+	count := defaultRecurringPreviewCount
+	if c.Query("count") != "" {
+		var err error
+		count, err = strconv.Atoi(c.Query("count"))
+		if err != nil || count <= 0 || count > maxRecurringPreviewCount {
+			BadRequest(c, "Param 'count' must be between 1 and "+strconv.Itoa(maxRecurringPreviewCount)+".")
+			return
+		}
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	rules, err := getLedgerRecurringRules(script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	index := findRecurringRule(rules, ruleId)
+	if index < 0 {
+		BadRequest(c, "Recurring rule "+ruleId+" not found")
+		return
+	}
+	rule := rules[index]
+	dates, err := rule.Schedule.Occurrences(rule.LastDate, "", count)
+	if err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	result := make([]RecurringOccurrence, 0, len(dates))
+	for _, date := range dates {
+		result = append(result, RecurringOccurrence{Date: date, Skipped: rule.isSkipped(date)})
+	}
+	OK(c, result)
+}
+
+// RunRecurringRules 立即为当前账本生成到期的周期交易，返回生成的交易数量
+func RunRecurringRules(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	count, err := materializeRecurringRules(ledgerConfig, time.Now().Format("2006-01-02"))
+	if err != nil {
+		if errors.Is(err, script.ErrTransactionNotBalance) {
+			TransactionNotBalance(c)
+		} else {
+			InternalError(c, err.Error())
+		}
+		return
+	}
+	OK(c, count)
+}
+
+// StartRecurringScheduler 启动后台任务，每隔 interval 为所有账本生成到期的周期交易
+func StartRecurringScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			today := time.Now().Format("2006-01-02")
+			for _, config := range script.GetLedgerConfigMap() {
+				ledgerConfig := config
+				count, err := materializeRecurringRules(&ledgerConfig, today)
+				if err != nil {
+					script.LogError(ledgerConfig.Mail, "Failed to materialize recurring transactions, "+err.Error())
+				} else if count > 0 {
+					script.LogInfo(ledgerConfig.Mail, "Materialized "+strconv.Itoa(count)+" recurring transactions")
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// materializeRecurringRules 通过 saveTransaction 为未暂停的规则生成 today 及之前到期的交易，跳过的日期不生成
+// 某条规则生成失败时停在失败的日期，下次重试，不影响其它规则
+func materializeRecurringRules(ledgerConfig *script.Config, today string) (int, error) {
+	recurringMutex.Lock()
+	defer recurringMutex.Unlock()
+	filePath := script.GetLedgerRecurringRulesFilePath(ledgerConfig.DataPath)
+	if !script.FileIfExist(filePath) {
+		return 0, nil
+	}
+	rules, err := getLedgerRecurringRules(filePath)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	var firstErr error
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Paused {
+			continue
+		}
+		dates, err := rule.Schedule.Occurrences(rule.LastDate, today, 0)
+		if err != nil {
+			script.LogError(ledgerConfig.Mail, "Invalid recurring rule "+rule.Id+", "+err.Error())
+			continue
+		}
+		if len(dates) == 0 {
+			continue
+		}
+		for _, date := range dates {
+			if !rule.isSkipped(date) {
+				if err = saveTransaction(nil, rule.transactionForm(date), ledgerConfig); err != nil {
+					script.LogError(ledgerConfig.Mail, "Failed to materialize recurring rule "+rule.Id+" at "+date+", "+err.Error())
+					if firstErr == nil {
+						firstErr = err
+					}
+					break
+				}
+				count++
+			}
+			rule.LastDate = date
+		}
+		// 已处理过的跳过日期不再需要
+		skipped := make([]string, 0, len(rule.Skipped))
+		for _, date := range rule.Skipped {
+			if date > rule.LastDate {
+				skipped = append(skipped, date)
+			}
+		}
+		rule.Skipped = skipped
+		// 每条规则处理后立即保存，避免后续失败时重复生成
+		if err = writeLedgerRecurringRules(filePath, rules); err != nil {
+			return count, err
+		}
+	}
+	return count, firstErr
+}
+
+func findRecurringRule(rules []RecurringRule, ruleId string) int {
+	for i, rule := range rules {
+		if rule.Id == ruleId {
+			return i
+		}
+	}
+	return -1
+}
+
+func getLedgerRecurringRules(filePath string) ([]RecurringRule, error) {
+	result := make([]RecurringRule, 0)
+	if script.FileIfExist(filePath) {
+		bytes, err := script.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(bytes, &result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func writeLedgerRecurringRules(filePath string, rules []RecurringRule) error {
+	if !script.FileIfExist(filePath) {
+		err := script.CreateFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	bytes, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return script.WriteFile(filePath, string(bytes))
+}
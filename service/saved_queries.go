@@ -0,0 +1,243 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SavedQuerySourceUser   = "user"
+	SavedQuerySourceLedger = "ledger"
+)
+
+// SavedQuery 保存的查询，BQL 中可以使用 :name 参数，运行时传入参数值
+type SavedQuery struct {
+	Id          string   `json:"id"`
+	Name        string   `form:"name" binding:"required" json:"name"`
+	Description string   `form:"description" json:"description,omitempty"`
+	BQL         string   `form:"bql" binding:"required" json:"bql"`
+	Params      []string `json:"params"`
+	// Source user 为通过接口保存的查询，ledger 为账本文件中的 query 指令（只读）
+	Source   string `json:"source"`
+	FilePath string `json:"filePath,omitempty"`
+	LineNo   int    `json:"lineNo,omitempty"`
+	// Error 账本中无法解析的 query 指令的错误信息，这类查询不能运行
+	Error string `json:"error,omitempty"`
+}
+
+type RunSavedQueryForm struct {
+	Id     string                 `form:"id" json:"id"`
+	Name   string                 `form:"name" json:"name"`
+	Params map[string]interface{} `json:"params"`
+	Format string                 `form:"format" json:"format"`
+	Limit  int                    `form:"limit" json:"limit"`
+}
+
+func QuerySavedQueries(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	queries, err := getAllSavedQueries(ledgerConfig)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, queries)
+}
+
+// SaveQuery 新增查询，id 不为空时更新对应的查询
+func SaveQuery(c *gin.Context) {
+	var savedQuery SavedQuery
+	if err := c.ShouldBindJSON(&savedQuery); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if err := script.CheckReadOnlyBQL(savedQuery.BQL); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	filePath := script.GetLedgerSavedQueriesFilePath(ledgerConfig.DataPath)
+	queries, err := getLedgerSavedQueries(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+
+	savedQuery.Params = script.BQLParams(savedQuery.BQL)
+	savedQuery.Source = SavedQuerySourceUser
+	index := -1
+	for i, q := range queries {
+		if savedQuery.Id != "" && q.Id == savedQuery.Id {
+			index = i
+		} else if q.Name == savedQuery.Name {
+			BadRequest(c, "Saved query "+savedQuery.Name+" already exists")
+			return
+		}
+	}
+	if savedQuery.Id == "" {
+		t := sha1.New()
+		_, err = io.WriteString(t, time.Now().String())
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		savedQuery.Id = hex.EncodeToString(t.Sum(nil))
+		queries = append(queries, savedQuery)
+	} else if index < 0 {
+		BadRequest(c, "Saved query "+savedQuery.Id+" not found")
+		return
+	} else {
+		queries[index] = savedQuery
+	}
+
+	err = writeLedgerSavedQueries(filePath, queries)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, savedQuery)
+}
+
+func DeleteSavedQuery(c *gin.Context) {
+	queryId := c.Query("id")
+	if queryId == "" {
+		BadRequest(c, "id is not blank")
+		return
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	filePath := script.GetLedgerSavedQueriesFilePath(ledgerConfig.DataPath)
+	oldQueries, err := getLedgerSavedQueries(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+
+	newQueries := make([]SavedQuery, 0)
+	for _, q := range oldQueries {
+		if q.Id != queryId {
+			newQueries = append(newQueries, q)
+		}
+	}
+	if len(newQueries) == len(oldQueries) {
+		BadRequest(c, "Saved query "+queryId+" not found")
+		return
+	}
+
+	err = writeLedgerSavedQueries(filePath, newQueries)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, queryId)
+}
+
+// RunSavedQuery 按 id 或名称运行保存的查询，同名时优先使用接口保存的查询
+func RunSavedQuery(c *gin.Context) {
+	var runForm RunSavedQueryForm
+	if err := c.ShouldBindJSON(&runForm); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if runForm.Id == "" && runForm.Name == "" {
+		BadRequest(c, "id or name is required")
+		return
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	queries, err := getAllSavedQueries(ledgerConfig)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	var savedQuery *SavedQuery
+	for i, q := range queries {
+		if (runForm.Id != "" && q.Id == runForm.Id) || (runForm.Id == "" && q.Name == runForm.Name) {
+			savedQuery = &queries[i]
+			break
+		}
+	}
+	if savedQuery == nil {
+		BadRequest(c, "Saved query not found")
+		return
+	}
+
+	bql, err := script.BindBQLParams(savedQuery.BQL, runForm.Params)
+	if err != nil {
+		if errors.Is(err, script.ErrInvalidBQLValue) {
+			BadRequest(c, err.Error())
+			return
+		}
+		InternalError(c, err.Error())
+		return
+	}
+	writeQueryResult(c, ledgerConfig, bql, runForm.Format, runForm.Limit)
+}
+
+// getAllSavedQueries 接口保存的查询在前，账本中的 query 指令在后
+func getAllSavedQueries(ledgerConfig *script.Config) ([]SavedQuery, error) {
+	queries, err := getLedgerSavedQueries(script.GetLedgerSavedQueriesFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		return nil, err
+	}
+	entries, errs := script.LedgerQueryDirectives(ledgerConfig)
+	for _, err := range errs {
+		script.LogError(ledgerConfig.Mail, "Failed to read query directive, "+err.Error())
+		// 无法解析的 query 指令作为带错误信息的查询返回
+		savedQuery := SavedQuery{Source: SavedQuerySourceLedger, Error: err.Error()}
+		var parseErr *script.ParseError
+		if errors.As(err, &parseErr) {
+			savedQuery.FilePath, savedQuery.LineNo = parseErr.FilePath, parseErr.LineNo
+		}
+		queries = append(queries, savedQuery)
+	}
+	for _, entry := range entries {
+		queries = append(queries, SavedQuery{
+			Id:       entry.Id,
+			Name:     entry.Name,
+			BQL:      entry.Description,
+			Params:   script.BQLParams(entry.Description),
+			Source:   SavedQuerySourceLedger,
+			FilePath: entry.FilePath,
+			LineNo:   entry.StartLineNo,
+		})
+	}
+	return queries, nil
+}
+
+func getLedgerSavedQueries(filePath string) ([]SavedQuery, error) {
+	result := make([]SavedQuery, 0)
+	if script.FileIfExist(filePath) {
+		bytes, err := script.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(bytes, &result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func writeLedgerSavedQueries(filePath string, queries []SavedQuery) error {
+	if !script.FileIfExist(filePath) {
+		err := script.CreateFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	bytes, err := json.Marshal(queries)
+	if err != nil {
+		return err
+	}
+	return script.WriteFile(filePath, string(bytes))
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+type transactionGroupId struct {
+	Date     string `bql:"date" json:"date"`
+	Id       string `bql:"id" json:"id"`
+	FileName string `bql:"filename" json:"filename"`
+	LineNo   string `bql:"lineno" json:"lineno"`
+	UUID     string `bql:"uuid" json:"uuid"`
+}
+
+// location 交易所在的文件和行号，内容相同的交易 id 相同，按位置区分
+func (id transactionGroupId) location() string {
+	return id.FileName + ":" + id.LineNo
+}
+
+type transactionGroupPosting struct {
+	Id        string   `bql:"id" json:"id"`
+	Date      string   `bql:"date" json:"date"`
+	Payee     string   `bql:"payee" json:"payee"`
+	Narration string   `bql:"narration" json:"narration"`
+	Tags      []string `bql:"tags" json:"tags"`
+	Links     []string `bql:"links" json:"links"`
+	Account   string   `bql:"account" json:"account"`
+	Number    string   `bql:"number" json:"number"`
+	Currency  string   `bql:"currency" json:"currency"`
+	FileName  string   `bql:"filename" json:"filename"`
+	LineNo    string   `bql:"lineno" json:"lineno"`
+}
+
+type TransactionGroupEntry struct {
+	Account        string `json:"account"`
+	Number         string `json:"number"`
+	Currency       string `json:"currency"`
+	CurrencySymbol string `json:"currencySymbol,omitempty"`
+}
+
+// TransactionGroup 按交易分组的查询结果，包含交易的所有过账
+// TransactionGroup 一笔交易及其过账，Id 为交易的 uuid（没有 uuid 时为交易 id）
+type TransactionGroup struct {
+	Id      string                  `json:"id"`
+	Date    string                  `json:"date"`
+	Payee   string                  `json:"payee"`
+	Desc    string                  `json:"desc"`
+	Tags    []string                `json:"tags"`
+	Links   []string                `json:"links"`
+	Entries []TransactionGroupEntry `json:"entries"`
+}
+
+type TransactionGroupResult struct {
+	Items   []TransactionGroup `json:"items"`
+	Total   int                `json:"total"`
+	HasMore bool               `json:"hasMore"`
+}
+
+// SearchTransactions 按搜索语法查询交易，如 payee:星巴克 tag:trip amount>30 2024-05
+func SearchTransactions(c *gin.Context) {
+	condition, err := script.ParseSearchQuery(c.Query("q"))
+	if err != nil {
+		var syntaxErr *script.SearchSyntaxError
+		if errors.As(err, &syntaxErr) {
+			SearchSyntaxError(c, syntaxErr)
+			return
+		}
+		BadRequest(c, err.Error())
+		return
+	}
+	limit := script.DefaultPageSize
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > script.MaxPageSize {
+			BadRequest(c, fmt.Sprintf("Param 'limit' must be between 1 and %d.", script.MaxPageSize))
+			return
+		}
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	result, err := queryTransactionGroups(ledgerConfig, condition, limit)
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+	OK(c, result)
+}
+
+// queryTransactionGroups 先查询匹配条件的交易（按日期倒序，最多 limit 条），再查询这些交易的全部过账
+func queryTransactionGroups(ledgerConfig *script.Config, condition script.BQLCondition, limit int) (*TransactionGroupResult, error) {
+	ids := make([]transactionGroupId, 0)
+	query := script.NewBQLQuery().Distinct().Select("date").Select("id").Select("filename").Select("lineno").
+		SelectAs("uuid", "entry_meta(?)", script.TransactionUUIDKey).Where(condition).OrderBy("date desc, id desc")
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, nil, &ids)
+	if err != nil {
+		return nil, err
+	}
+	result := &TransactionGroupResult{Items: make([]TransactionGroup, 0), Total: len(ids), HasMore: len(ids) > limit}
+	if result.HasMore {
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	idList := make([]string, 0, len(ids))
+	for _, id := range ids {
+		idList = append(idList, id.Id)
+	}
+	postings := make([]transactionGroupPosting, 0)
+	err = script.BQLQueryList(ledgerConfig, &script.QueryParams{IDList: idList}, &postings)
+	if err != nil {
+		return nil, err
+	}
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
+	groupIds := make(map[string]string)
+	for _, id := range ids {
+		groupIds[id.location()] = id.UUID
+		if id.UUID == "" {
+			groupIds[id.location()] = id.Id
+		}
+	}
+	groups := make(map[string]*TransactionGroup)
+	for _, posting := range postings {
+		location := transactionGroupId{FileName: posting.FileName, LineNo: posting.LineNo}.location()
+		groupId, ok := groupIds[location]
+		if !ok {
+			continue
+		}
+		group, ok := groups[location]
+		if !ok {
+			group = &TransactionGroup{
+				Id:      groupId,
+				Date:    posting.Date,
+				Payee:   posting.Payee,
+				Desc:    posting.Narration,
+				Tags:    posting.Tags,
+				Links:   posting.Links,
+				Entries: make([]TransactionGroupEntry, 0),
+			}
+			groups[location] = group
+		}
+		group.Entries = append(group.Entries, TransactionGroupEntry{
+			Account:        posting.Account,
+			Number:         precisions.FormatString(posting.Number, posting.Currency),
+			Currency:       posting.Currency,
+			CurrencySymbol: script.GetCommoditySymbol(ledgerConfig.Id, posting.Currency),
+		})
+	}
+	for _, id := range ids {
+		if group, ok := groups[id.location()]; ok {
+			result.Items = append(result.Items, *group)
+		}
+	}
+	return result, nil
+}
@@ -26,7 +26,7 @@ func MonthsList(c *gin.Context) {
 	yearMonthList := make([]YearMonth, 0)
 	err := script.BQLQueryList(ledgerConfig, &queryParams, &yearMonthList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 	months := make([]string, 0)
@@ -37,18 +37,20 @@ func MonthsList(c *gin.Context) {
 }
 
 type StatsResult struct {
-	Key   string
-	Value string
+	Key   string `bql:"key"`
+	Value string `bql:"value"`
 }
 
 func StatsTotal(c *gin.Context) {
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
 	queryParams := script.GetQueryParams(c)
-	selectBql := fmt.Sprintf("SELECT '\\', root(account, 1), '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		SelectAs("key", "root(account, 1)").
+		SelectAs("value", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	accountTypeTotalList := make([]StatsResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, selectBql, &queryParams, &accountTypeTotalList)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &accountTypeTotalList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
@@ -72,8 +74,8 @@ type StatsQuery struct {
 }
 
 type AccountPercentQueryResult struct {
-	Account  string
-	Position string
+	Account  string `bql:"account"`
+	Position string `bql:"position"`
 }
 
 type AccountPercentResult struct {
@@ -97,12 +99,14 @@ func StatsAccountPercent(c *gin.Context) {
 		Where:       true,
 	}
 
-	bql := fmt.Sprintf("SELECT '\\', account, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		Select("account").
+		SelectAs("position", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 
 	statsQueryResultList := make([]AccountPercentQueryResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsQueryResultList)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &statsQueryResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
@@ -144,6 +148,13 @@ func aggregateAccountPercentList(result []AccountPercentResult) []AccountPercent
 	return aggregateResult
 }
 
+type AccountTrendQueryResult struct {
+	Date  string `bql:"date"`
+	Year  int    `bql:"year"`
+	Month int    `bql:"month"`
+	Value string `bql:"value"`
+}
+
 type AccountTrendResult struct {
 	Date              string      `json:"date"`
 	Amount            json.Number `json:"amount"`
@@ -164,28 +175,29 @@ func StatsAccountTrend(c *gin.Context) {
 		Month:       statsQuery.Month,
 		Where:       true,
 	}
-	var bql string
+	query := script.NewBQLQuery()
 	switch {
 	case statsQuery.Type == "day":
-		bql = fmt.Sprintf("SELECT '\\', date, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+		query.Select("date").SelectAs("value", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	case statsQuery.Type == "month":
-		bql = fmt.Sprintf("SELECT '\\', year, '-', month, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+		query.Select("year").Select("month").SelectAs("value", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	case statsQuery.Type == "year":
-		bql = fmt.Sprintf("SELECT '\\', year, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+		query.Select("year").SelectAs("value", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	case statsQuery.Type == "sum":
-		bql = fmt.Sprintf("SELECT '\\', date, '\\', convert(balance, '%s'), '\\'", ledgerConfig.OperatingCurrency)
+		query.Select("date").SelectAs("value", "convert(balance, ?)", ledgerConfig.OperatingCurrency)
 	default:
 		OK(c, new([]string))
 		return
 	}
 
-	statsResultList := make([]StatsResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsResultList)
+	statsResultList := make([]AccountTrendQueryResult, 0)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &statsResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
 	result := make([]AccountTrendResult, 0)
 	for _, stats := range statsResultList {
 		commodities := strings.Split(stats.Value, ",")
@@ -202,14 +214,15 @@ func StatsAccountTrend(c *gin.Context) {
 		fields := strings.Fields(selectedCommodity)
 		amount, _ := decimal.NewFromString(fields[0])
 
-		var date = stats.Key
-		// 月格式化日期
-		if statsQuery.Type == "month" {
-			yearMonth := strings.Split(date, "-")
-			date = fmt.Sprintf("%s-%s", strings.Trim(yearMonth[0], " "), strings.Trim(yearMonth[1], " "))
+		var date = stats.Date
+		switch statsQuery.Type {
+		case "month":
+			date = fmt.Sprintf("%d-%d", stats.Year, stats.Month)
+		case "year":
+			date = strconv.Itoa(stats.Year)
 		}
 
-		result = append(result, AccountTrendResult{Date: date, Amount: json.Number(amount.Round(2).String()), OperatingCurrency: fields[1]})
+		result = append(result, AccountTrendResult{Date: date, Amount: json.Number(amount.Round(precisions.Places(fields[1])).String()), OperatingCurrency: fields[1]})
 	}
 	OK(c, result)
 }
@@ -243,13 +256,18 @@ func StatsAccountBalance(c *gin.Context) {
 	}
 
 	balResultList := make([]AccountBalanceBQLResult, 0)
-	bql := fmt.Sprintf("select '\\', year, '\\', month, '\\', day, '\\', last(convert(balance, '%s')), '\\'", ledgerConfig.OperatingCurrency)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &balResultList)
+	query := script.NewBQLQuery().
+		Select("year").
+		Select("month").
+		Select("day").
+		SelectAs("balance", "last(convert(balance, ?))", ledgerConfig.OperatingCurrency)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &balResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
 	resultList := make([]AccountBalanceResult, 0)
 	for _, bqlResult := range balResultList {
 		if bqlResult.Balance != "" {
@@ -257,7 +275,7 @@ func StatsAccountBalance(c *gin.Context) {
 			amount, _ := decimal.NewFromString(fields[0])
 			resultList = append(resultList, AccountBalanceResult{
 				Date:              bqlResult.Year + "-" + bqlResult.Month + "-" + bqlResult.Day,
-				Amount:            json.Number(amount.Round(2).String()),
+				Amount:            json.Number(amount.Round(precisions.Places(fields[1])).String()),
 				OperatingCurrency: fields[1],
 			})
 		}
@@ -287,9 +305,9 @@ func NewAccountSankeyLink() *AccountSankeyLink {
 }
 
 type TransactionAccountPositionBQLResult struct {
-	Id       string
-	Account  string
-	Position string
+	Id       string `bql:"id"`
+	Account  string `bql:"account"`
+	Position string `bql:"position"`
 }
 
 type TransactionAccountPosition struct {
@@ -315,18 +333,16 @@ func StatsAccountSankey(c *gin.Context) {
 		Where:       true,
 	}
 	statsQueryResultList := make([]TransactionAccountPositionBQLResult, 0)
-	var bql string
 	// 账户不为空，则查询时间范围内所有涉及该账户的交易记录
 	if statsQuery.Prefix != "" {
-		bql = "SELECT '\\', id, '\\'"
-		err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsQueryResultList)
+		err := script.BQLQueryListByCustomSelect(ledgerConfig, script.NewBQLQuery().Select("id"), &queryParams, &statsQueryResultList)
 		if err != nil {
-			InternalError(c, err.Error())
+			QueryError(c, err)
 			return
 		}
 		// 清空 account 查询条件，改为使用 ID 查询包含该账户所有交易记录
 		queryParams.AccountLike = ""
-		queryParams.IDList = "|"
+		queryParams.IDList = make([]string, 0)
 		if len(statsQueryResultList) != 0 {
 			idSet := make(map[string]bool)
 			for _, bqlResult := range statsQueryResultList {
@@ -336,16 +352,19 @@ func StatsAccountSankey(c *gin.Context) {
 			for id := range idSet {
 				idList = append(idList, id)
 			}
-			queryParams.IDList = strings.Join(idList, "|")
+			queryParams.IDList = idList
 		}
 	}
 	// 查询全部account的交易数据
-	bql = fmt.Sprintf("SELECT '\\', id, '\\', account, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		Select("id").
+		Select("account").
+		SelectAs("position", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 
 	statsQueryResultList = make([]TransactionAccountPositionBQLResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsQueryResultList)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &statsQueryResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
@@ -626,7 +645,6 @@ func aggregateLinkNodes(links []AccountSankeyLink) []AccountSankeyLink {
 
 	for _, link := range links {
 		if link.Source == link.Target {
-			fmt.Printf("%-%s-%d", link.Source, link.Target, link.Value)
 			continue
 		}
 
@@ -665,9 +683,9 @@ func aggregateLinkNodes(links []AccountSankeyLink) []AccountSankeyLink {
 }
 
 type MonthTotalBQLResult struct {
-	Year  int
-	Month int
-	Value string
+	Year  int    `bql:"year"`
+	Month int    `bql:"month"`
+	Value string `bql:"value"`
 }
 
 type MonthTotal struct {
@@ -700,11 +718,14 @@ func StatsMonthTotal(c *gin.Context) {
 		OrderBy:     "year, month",
 	}
 	// 按月查询收入
-	queryIncomeBql := fmt.Sprintf("select '\\', year, '\\', month, '\\', neg(sum(convert(value(position), '%s'))), '\\'", ledgerConfig.OperatingCurrency)
+	queryIncome := script.NewBQLQuery().
+		Select("year").
+		Select("month").
+		SelectAs("value", "neg(sum(convert(value(position), ?)))", ledgerConfig.OperatingCurrency)
 	monthIncomeTotalResultList := make([]MonthTotalBQLResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, queryIncomeBql, &queryParams, &monthIncomeTotalResultList)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, queryIncome, &queryParams, &monthIncomeTotalResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 	monthIncomeMap := make(map[string]MonthTotalBQLResult)
@@ -716,11 +737,14 @@ func StatsMonthTotal(c *gin.Context) {
 
 	// 按月查询支出
 	queryParams.AccountLike = "Expenses"
-	queryExpensesBql := fmt.Sprintf("select '\\', year, '\\', month, '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	queryExpenses := script.NewBQLQuery().
+		Select("year").
+		Select("month").
+		SelectAs("value", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	monthExpensesTotalResultList := make([]MonthTotalBQLResult, 0)
-	err = script.BQLQueryListByCustomSelect(ledgerConfig, queryExpensesBql, &queryParams, &monthExpensesTotalResultList)
+	err = script.BQLQueryListByCustomSelect(ledgerConfig, queryExpenses, &queryParams, &monthExpensesTotalResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 	monthExpensesMap := make(map[string]MonthTotalBQLResult)
@@ -730,6 +754,7 @@ func StatsMonthTotal(c *gin.Context) {
 		monthExpensesMap[month] = expenses
 	}
 
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
 	monthTotalResult := make([]MonthTotal, 0)
 	// 合并结果
 	var monthIncome, monthExpenses MonthTotal
@@ -739,7 +764,7 @@ func StatsMonthTotal(c *gin.Context) {
 			fields := strings.Fields(monthIncomeMap[month].Value)
 			amount, _ := decimal.NewFromString(fields[0])
 			monthIncomeAmount = amount
-			monthIncome = MonthTotal{Type: "收入", Month: month, Amount: json.Number(amount.Round(2).String()), OperatingCurrency: fields[1]}
+			monthIncome = MonthTotal{Type: "收入", Month: month, Amount: json.Number(amount.Round(precisions.Places(fields[1])).String()), OperatingCurrency: fields[1]}
 		} else {
 			monthIncome = MonthTotal{Type: "收入", Month: month, Amount: "0", OperatingCurrency: ledgerConfig.OperatingCurrency}
 		}
@@ -749,12 +774,12 @@ func StatsMonthTotal(c *gin.Context) {
 			fields := strings.Fields(monthExpensesMap[month].Value)
 			amount, _ := decimal.NewFromString(fields[0])
 			monthExpensesAmount = amount
-			monthExpenses = MonthTotal{Type: "支出", Month: month, Amount: json.Number(amount.Round(2).String()), OperatingCurrency: fields[1]}
+			monthExpenses = MonthTotal{Type: "支出", Month: month, Amount: json.Number(amount.Round(precisions.Places(fields[1])).String()), OperatingCurrency: fields[1]}
 		} else {
 			monthExpenses = MonthTotal{Type: "支出", Month: month, Amount: "0", OperatingCurrency: ledgerConfig.OperatingCurrency}
 		}
 		monthTotalResult = append(monthTotalResult, monthExpenses)
-		monthTotalResult = append(monthTotalResult, MonthTotal{Type: "结余", Month: month, Amount: json.Number(monthIncomeAmount.Sub(monthExpensesAmount).Round(2).String()), OperatingCurrency: ledgerConfig.OperatingCurrency})
+		monthTotalResult = append(monthTotalResult, MonthTotal{Type: "结余", Month: month, Amount: json.Number(monthIncomeAmount.Sub(monthExpensesAmount).Round(precisions.Places(ledgerConfig.OperatingCurrency)).String()), OperatingCurrency: ledgerConfig.OperatingCurrency})
 	}
 	sort.Sort(MonthTotalSort(monthTotalResult))
 	OK(c, monthTotalResult)
@@ -765,9 +790,9 @@ type StatsMonthQuery struct {
 	Month int `form:"month"`
 }
 type StatsCalendarQueryResult struct {
-	Date     string
-	Account  string
-	Position string
+	Date     string `bql:"date"`
+	Account  string `bql:"account"`
+	Position string `bql:"position"`
 }
 type StatsCalendarResult struct {
 	Date           string      `json:"date"`
@@ -791,11 +816,14 @@ func StatsMonthCalendar(c *gin.Context) {
 		Where: true,
 	}
 
-	bql := fmt.Sprintf("SELECT '\\', date, '\\', root(account, 1), '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		Select("date").
+		SelectAs("account", "root(account, 1)").
+		SelectAs("position", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	statsCalendarQueryResult := make([]StatsCalendarQueryResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsCalendarQueryResult)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &statsCalendarQueryResult)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
@@ -817,9 +845,9 @@ func StatsMonthCalendar(c *gin.Context) {
 }
 
 type StatsPayeeQueryResult struct {
-	Payee    string
-	Count    int32
-	Position string
+	Payee    string `bql:"payee"`
+	Count    int32  `bql:"count"`
+	Position string `bql:"position"`
 }
 type StatsPayeeResult struct {
 	Payee    string      `json:"payee"`
@@ -855,14 +883,18 @@ func StatsPayee(c *gin.Context) {
 		Currency:    ledgerConfig.OperatingCurrency,
 	}
 
-	bql := fmt.Sprintf("SELECT '\\', payee, '\\', count(payee), '\\', sum(convert(value(position), '%s')), '\\'", ledgerConfig.OperatingCurrency)
+	query := script.NewBQLQuery().
+		Select("payee").
+		SelectAs("count", "count(payee)").
+		SelectAs("position", "sum(convert(value(position), ?))", ledgerConfig.OperatingCurrency)
 	statsPayeeQueryResultList := make([]StatsPayeeQueryResult, 0)
-	err := script.BQLQueryListByCustomSelect(ledgerConfig, bql, &queryParams, &statsPayeeQueryResultList)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, &queryParams, &statsPayeeQueryResultList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
 	result := make([]StatsPayeeResult, 0)
 	for _, l := range statsPayeeQueryResultList {
 		// 交易账户名称非空
@@ -889,7 +921,7 @@ func StatsPayee(c *gin.Context) {
 
 					if statsQuery.Type == "avg" {
 						// 如果是查询平均交易金额
-						payee.Value = json.Number(total.Div(decimal.NewFromInt32(l.Count)).Round(2).String())
+						payee.Value = json.Number(total.Div(decimal.NewFromInt32(l.Count)).Round(precisions.Places(ledgerConfig.OperatingCurrency)).String())
 					} else {
 						// 如果是查询总交易金额
 						payee.Value = json.Number(fields[0])
@@ -14,7 +14,7 @@ func QueryTags(c *gin.Context) {
 	tags := make([]Tags, 0)
 	err := script.BQLQueryList(ledgerConfig, nil, &tags)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 
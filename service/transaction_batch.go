@@ -0,0 +1,208 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BatchItemCreated = "created"
+	BatchItemFailed  = "failed"
+	// BatchItemSkipped 校验通过，但因其它交易校验失败而未写入
+	BatchItemSkipped = "skipped"
+)
+
+// BatchTransactionForm 批量新增交易，默认全部成功才写入；ContinueOnError 为 true 时跳过校验失败的交易，写入其余交易。
+// 带 Idempotency-Key 时，没有写入任何交易的结果不保存；部分写入的结果会保存，失败的交易需使用新的 Key 重新提交
+type BatchTransactionForm struct {
+	Transactions    []TransactionForm `json:"transactions"`
+	ContinueOnError bool              `json:"continueOnError"`
+}
+
+// BatchItemResult 每个交易的处理结果，Code 与单个新增交易接口的错误码一致
+type BatchItemResult struct {
+	Index   int    `json:"index"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	UUID    string `json:"uuid,omitempty"`
+}
+
+type BatchTransactionResult struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Items   []BatchItemResult `json:"items"`
+}
+
+// AddBatchTransactions 批量新增交易。请求体为数组时逐个写入并返回成功的交易（兼容旧接口），
+// 为 BatchTransactionForm 时先校验所有交易，再一次性写入，写入失败时恢复所有修改过的文件
+func AddBatchTransactions(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var addTransactionForms []TransactionForm
+		if err = json.Unmarshal(body, &addTransactionForms); err != nil {
+			BadRequest(c, err.Error())
+			return
+		}
+		result := make([]string, 0)
+		for _, form := range addTransactionForms {
+			err := saveTransaction(nil, form, ledgerConfig)
+			if err == nil {
+				result = append(result, form.Date+form.Payee+form.Desc)
+			} else {
+				script.LogError(ledgerConfig.Mail, err.Error())
+			}
+		}
+		if len(result) == 0 {
+			skipIdempotencyRecord(c)
+		}
+		OK(c, result)
+		return
+	}
+
+	var batchForm BatchTransactionForm
+	if err = json.Unmarshal(body, &batchForm); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if len(batchForm.Transactions) == 0 {
+		BadRequest(c, "transactions must not be empty")
+		return
+	}
+	// 校验和写入之间不能有其它交易写入
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	result := BatchTransactionResult{Items: make([]BatchItemResult, len(batchForm.Transactions))}
+	prepared := make([]*preparedTransaction, len(batchForm.Transactions))
+	uuids := make(map[string]int)
+	for i, form := range batchForm.Transactions {
+		item := BatchItemResult{Index: i, Status: BatchItemSkipped, Code: 200}
+		if form.ID != "" {
+			err = errors.New("batch only supports new transactions")
+			item.Code = 400
+		} else if prepared[i], err = prepareTransaction(ledgerConfig, form); err == nil {
+			item.UUID = prepared[i].UUID
+			if index, ok := uuids[item.UUID]; ok {
+				err = errors.New("duplicate uuid with transaction " + strconv.Itoa(index))
+				item.Code = 400
+			}
+			uuids[item.UUID] = i
+		} else {
+			item.Code = transactionErrorCode(err)
+		}
+		if err != nil {
+			prepared[i] = nil
+			item.Status, item.Message = BatchItemFailed, err.Error()
+			result.Failed++
+		}
+		result.Items[i] = item
+	}
+	if result.Failed == len(result.Items) || (result.Failed > 0 && !batchForm.ContinueOnError) {
+		skipIdempotencyRecord(c)
+		OK(c, result)
+		return
+	}
+
+	if err = writePreparedTransactions(ledgerConfig, prepared); err != nil {
+		script.LogError(ledgerConfig.Mail, "Failed to write batch transactions, "+err.Error())
+		InternalError(c, err.Error())
+		return
+	}
+	for i := range result.Items {
+		if prepared[i] != nil {
+			result.Items[i].Status = BatchItemCreated
+			result.Created++
+		}
+	}
+	OK(c, result)
+}
+
+// writePreparedTransactions 按月份文件一次性追加交易和汇率，任何一步失败时将修改过的文件截断到写入前的长度（新建的文件删除）。
+// 调用方需持有账本的写锁
+func writePreparedTransactions(ledgerConfig *script.Config, prepared []*preparedTransaction) (err error) {
+	monthTexts := make(map[string]string)
+	priceLines := make([]string, 0)
+	reloadCurrency := false
+	for _, p := range prepared {
+		if p == nil {
+			continue
+		}
+		monthTexts[p.Month] += p.Text
+		priceLines = append(priceLines, p.PriceLines...)
+		reloadCurrency = reloadCurrency || p.ReloadCurrency
+	}
+	months := make([]string, 0, len(monthTexts))
+	for month := range monthTexts {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	// 记录会修改的文件的长度，-1 表示文件不存在
+	paths := []string{script.GetLedgerMonthsFilePath(ledgerConfig.DataPath), script.GetLedgerPriceFilePath(ledgerConfig.DataPath)}
+	for _, month := range months {
+		paths = append(paths, script.GetLedgerMonthFilePath(ledgerConfig.DataPath, month))
+	}
+	sizes := make(map[string]int64)
+	for _, path := range paths {
+		info, e := os.Stat(path)
+		if e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		sizes[path] = -1
+		if e == nil {
+			sizes[path] = info.Size()
+		}
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, path := range paths {
+			var e error
+			if sizes[path] < 0 {
+				e = os.Remove(path)
+			} else {
+				e = os.Truncate(path, sizes[path])
+			}
+			script.InvalidateQueryCache(path)
+			if e != nil && !os.IsNotExist(e) {
+				script.LogError(ledgerConfig.Mail, "Failed to restore "+filepath.Base(path)+", "+e.Error())
+			}
+		}
+	}()
+
+	for _, priceLine := range priceLines {
+		if err = script.AppendFileInNewLine(script.GetLedgerPriceFilePath(ledgerConfig.DataPath), priceLine); err != nil {
+			return err
+		}
+	}
+	for _, month := range months {
+		if err = CreateMonthBeanFileIfNotExist(ledgerConfig.DataPath, month); err != nil {
+			return err
+		}
+		// 每个交易的文本以换行开头，AppendFileInNewLine 会再添加一个换行
+		if err = script.AppendFileInNewLine(script.GetLedgerMonthFilePath(ledgerConfig.DataPath, month), monthTexts[month]); err != nil {
+			return err
+		}
+	}
+	if reloadCurrency {
+		if e := script.LoadLedgerCurrencyMap(ledgerConfig); e != nil {
+			script.LogError(ledgerConfig.Mail, "Failed to reload currency, "+e.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+type BulkReplaceAccount struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type BulkSetMeta struct {
+	Key string `json:"key"`
+	// Value 为 null 时删除该元数据
+	Value interface{} `json:"value"`
+}
+
+// BulkEditOperation 批量修改的操作，可以同时设置多个
+type BulkEditOperation struct {
+	ReplaceAccount *BulkReplaceAccount `json:"replaceAccount,omitempty"`
+	AddTags        []string            `json:"addTags,omitempty"`
+	RemoveTags     []string            `json:"removeTags,omitempty"`
+	Payee          *string             `json:"payee,omitempty"`
+	Meta           *BulkSetMeta        `json:"meta,omitempty"`
+}
+
+// BulkEditForm 按交易 id（或 uuid）和/或搜索语法 q 选择交易，DryRun 为 true 时只返回修改前后的原文
+type BulkEditForm struct {
+	IDs       []string          `json:"ids"`
+	Query     string            `json:"q"`
+	Operation BulkEditOperation `json:"operation"`
+	DryRun    bool              `json:"dryRun"`
+}
+
+type BulkEditChange struct {
+	Id string `json:"id"`
+	// FilePath 相对账本目录的文件路径
+	FilePath  string `json:"filePath"`
+	StartLine int    `json:"startLine"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+}
+
+type BulkEditResult struct {
+	DryRun  bool `json:"dryRun"`
+	Matched int  `json:"matched"`
+	// Backup 修改前备份的目录（相对账本目录），DryRun 时为空
+	Backup  string           `json:"backup,omitempty"`
+	Changes []BulkEditChange `json:"changes"`
+}
+
+func (operation BulkEditOperation) check() error {
+	if operation.ReplaceAccount == nil && len(operation.AddTags) == 0 && len(operation.RemoveTags) == 0 && operation.Payee == nil && operation.Meta == nil {
+		return errors.New("operation must not be empty")
+	}
+	if operation.ReplaceAccount != nil {
+		if err := script.CheckAccount(operation.ReplaceAccount.From); err != nil {
+			return err
+		}
+		if err := script.CheckAccount(operation.ReplaceAccount.To); err != nil {
+			return err
+		}
+	}
+	for _, tag := range append(append([]string{}, operation.AddTags...), operation.RemoveTags...) {
+		if err := script.CheckTag(tag); err != nil {
+			return err
+		}
+	}
+	if operation.Meta != nil {
+		if operation.Meta.Key == script.TransactionUUIDKey {
+			return errors.New("uuid metadata cannot be bulk edited")
+		}
+		if _, err := script.SetEntryMeta([]string{""}, operation.Meta.Key, operation.Meta.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply 修改指令原文（第一行为交易首行），返回修改后的原文
+func (operation BulkEditOperation) apply(lines []string) ([]string, error) {
+	result := append([]string{}, lines...)
+	if operation.ReplaceAccount != nil {
+		script.ReplaceEntryAccount(result, operation.ReplaceAccount.From, operation.ReplaceAccount.To)
+	}
+	for _, tag := range operation.RemoveTags {
+		result[0] = script.RemoveHeaderTag(result[0], tag)
+	}
+	for _, tag := range operation.AddTags {
+		result[0] = script.AddHeaderTag(result[0], tag)
+	}
+	if operation.Payee != nil {
+		result[0] = script.SetHeaderPayee(result[0], *operation.Payee)
+	}
+	if operation.Meta != nil {
+		return script.SetEntryMeta(result, operation.Meta.Key, operation.Meta.Value)
+	}
+	return result, nil
+}
+
+// BulkEditTransactions 批量修改交易的账户、tag、payee 和元数据，修改前将涉及的文件备份到同一个目录
+func BulkEditTransactions(c *gin.Context) {
+	var form BulkEditForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if err := form.Operation.check(); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	condition, err := bulkEditCondition(form)
+	if err != nil {
+		var syntaxErr *script.SearchSyntaxError
+		if errors.As(err, &syntaxErr) {
+			SearchSyntaxError(c, syntaxErr)
+		} else if errors.Is(err, errBulkEditNoFilter) {
+			BadRequest(c, err.Error())
+		} else {
+			QueryError(c, err)
+		}
+		return
+	}
+	if !form.DryRun {
+		// 从读取到写回期间不能有其他写入，否则会被覆盖
+		lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	rows, err := queryTransactionUUIDs(ledgerConfig, condition)
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+
+	// 按文件分组，同一文件从后往前修改，前面的行号不受影响
+	fileRows := make(map[string][]transactionUUIDRow)
+	for _, row := range rows {
+		filePath := filepath.Clean(row.FileName)
+		fileRows[filePath] = append(fileRows[filePath], row)
+	}
+	filePaths := make([]string, 0, len(fileRows))
+	for filePath := range fileRows {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	result := BulkEditResult{DryRun: form.DryRun, Matched: len(rows), Changes: make([]BulkEditChange, 0)}
+	fileLines := make(map[string][]string)
+	for _, filePath := range filePaths {
+		lines, err := script.ReadLines(filePath)
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		entries := fileRows[filePath]
+		sort.Slice(entries, func(i, j int) bool {
+			a, _ := strconv.Atoi(entries[i].LineNo)
+			b, _ := strconv.Atoi(entries[j].LineNo)
+			return a > b
+		})
+		changes := make([]BulkEditChange, 0)
+		for _, row := range entries {
+			lineNo, _ := strconv.Atoi(row.LineNo)
+			// 文件在账本加载后被修改（首行不再是该交易）时不做任何修改
+			start, end, err := script.FindEntryLineRange(lines, lineNo)
+			if err != nil || !strings.HasPrefix(lines[lineNo-1], row.Date) || !script.IsTransactionHeader(lines[lineNo-1]) {
+				QueryError(c, fmt.Errorf("%w: %s:%d", script.ErrEntryChanged, filePath, lineNo))
+				return
+			}
+			before := lines[start-1 : end]
+			after, err := form.Operation.apply(before)
+			if err != nil {
+				BadRequest(c, err.Error())
+				return
+			}
+			if strings.Join(before, "\n") == strings.Join(after, "\n") {
+				continue
+			}
+			relPath, _ := filepath.Rel(filepath.Clean(ledgerConfig.DataPath), filePath)
+			changes = append(changes, BulkEditChange{Id: row.Id, FilePath: filepath.ToSlash(relPath), StartLine: start, Before: strings.Join(before, "\n"), After: strings.Join(after, "\n")})
+			lines = append(lines[:start-1], append(after, lines[end:]...)...)
+		}
+		if len(changes) > 0 {
+			fileLines[filePath] = lines
+		}
+		// 按行号正序返回
+		for i := len(changes) - 1; i >= 0; i-- {
+			result.Changes = append(result.Changes, changes[i])
+		}
+	}
+	if form.DryRun || len(fileLines) == 0 {
+		OK(c, result)
+		return
+	}
+
+	backup := "bak/" + time.Now().Format("20060102150405") + "_bulk_edit"
+	for filePath := range fileLines {
+		relPath, _ := filepath.Rel(filepath.Clean(ledgerConfig.DataPath), filePath)
+		target := filepath.Join(ledgerConfig.DataPath, backup, strings.ReplaceAll(filepath.ToSlash(relPath), "/", "_"))
+		if err = script.CopyFile(filePath, target); err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+	}
+	result.Backup = backup
+	for _, filePath := range filePaths {
+		if lines, ok := fileLines[filePath]; ok {
+			if err = script.WriteToFile(filePath, lines); err != nil {
+				InternalError(c, err.Error())
+				return
+			}
+		}
+	}
+	OK(c, result)
+}
+
+var errBulkEditNoFilter = errors.New("ids or q must not be blank")
+
+// bulkEditCondition 交易 id（或 uuid）和搜索条件同时设置时需同时满足，不包括 pad 生成的交易
+func bulkEditCondition(form BulkEditForm) (script.BQLCondition, error) {
+	conditions := make([]script.BQLCondition, 0, 2)
+	if len(form.IDs) > 0 {
+		idConditions := make([]script.BQLCondition, 0, len(form.IDs))
+		for _, id := range form.IDs {
+			idConditions = append(idConditions, script.TransactionIdCondition(id))
+		}
+		conditions = append(conditions, script.Or(idConditions...))
+	}
+	if strings.TrimSpace(form.Query) != "" {
+		condition, err := script.ParseSearchQuery(form.Query)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 0 {
+		return nil, errBulkEditNoFilter
+	}
+	// pad 生成的交易没有对应的交易原文
+	conditions = append(conditions, script.Compare("flag", "!=", "P"))
+	return script.And(conditions...), nil
+}
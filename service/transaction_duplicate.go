@@ -0,0 +1,483 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	DuplicateActionDelete = "delete"
+	DuplicateActionLink   = "link"
+	DuplicateActionIgnore = "ignore"
+	// DuplicateLinkPrefix 标记为非重复（相关联）的两笔交易共用的 link 前缀，有相同 link 的交易不再作为重复候选
+	DuplicateLinkPrefix = "related-"
+)
+
+const (
+	defaultDuplicateDays     = 3
+	maxDuplicateDays         = 31
+	defaultDuplicateMinScore = 0.7
+	defaultDuplicateLimit    = 50
+)
+
+// 忽略列表的读写锁
+var duplicateMutex sync.Mutex
+
+type duplicatePosting struct {
+	Id        string   `bql:"id"`
+	FileName  string   `bql:"filename"`
+	LineNo    string   `bql:"lineno"`
+	Date      string   `bql:"date"`
+	Payee     string   `bql:"payee"`
+	Narration string   `bql:"narration"`
+	Tags      []string `bql:"tags"`
+	Links     []string `bql:"links"`
+	Account   string   `bql:"account"`
+	Number    string   `bql:"number"`
+	Currency  string   `bql:"currency"`
+	UUID      string   `bql:"uuid"`
+}
+
+// duplicateTransaction 用于比较的交易，Key 为交易的 uuid（没有 uuid 时为交易 id），Amount 为各币种正数金额之和（按币种排序拼接）
+type duplicateTransaction struct {
+	Key       string
+	Date      time.Time
+	Payee     string
+	Narration string
+	Links     []string
+	Accounts  map[string]bool
+	Amount    string
+	Group     TransactionGroup
+}
+
+// DuplicateCandidate 可能重复的两笔交易，Score 为 0~1 的置信度
+type DuplicateCandidate struct {
+	Score        float64            `json:"score"`
+	DateDiff     int                `json:"dateDiff"`
+	Transactions []TransactionGroup `json:"transactions"`
+}
+
+// DuplicateIgnore 忽略的交易对，IDs 为交易的 uuid（没有 uuid 时为交易 id），按字典序排列
+type DuplicateIgnore struct {
+	IDs       []string `json:"ids"`
+	IgnoredAt string   `json:"ignoredAt"`
+}
+
+type DuplicateResolveForm struct {
+	IDs    []string `binding:"required" json:"ids"`
+	Action string   `binding:"required" json:"action"`
+	// DeleteId Action 为 delete 时删除的交易，必须是 IDs 之一
+	DeleteId string `json:"deleteId"`
+}
+
+// QueryDuplicateTransactions 查找可能重复的交易：金额相同且日期相差不超过 days 天，按日期、账户和 payee 的相似度计算置信度，
+// 不返回已忽略或已有相同 link 的交易对
+func QueryDuplicateTransactions(c *gin.Context) {
+	var err error
+	days := defaultDuplicateDays
+	if c.Query("days") != "" {
+		days, err = strconv.Atoi(c.Query("days"))
+		if err != nil || days < 0 || days > maxDuplicateDays {
+			BadRequest(c, fmt.Sprintf("Param 'days' must be between 0 and %d.", maxDuplicateDays))
+			return
+		}
+	}
+	limit := defaultDuplicateLimit
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > script.MaxPageSize/2 {
+			BadRequest(c, fmt.Sprintf("Param 'limit' must be between 1 and %d.", script.MaxPageSize/2))
+			return
+		}
+	}
+	minScore := defaultDuplicateMinScore
+	if c.Query("minScore") != "" {
+		minScore, err = strconv.ParseFloat(c.Query("minScore"), 64)
+		if err != nil || minScore < 0 || minScore > 1 {
+			BadRequest(c, "Param 'minScore' must be between 0 and 1.")
+			return
+		}
+	}
+
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	transactions, err := queryDuplicateTransactions(ledgerConfig)
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+	ignores, err := getLedgerDuplicateIgnores(script.GetLedgerDuplicateIgnoreFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	ignored := make(map[string]bool)
+	for _, ignore := range ignores {
+		ignored[strings.Join(ignore.IDs, ",")] = true
+	}
+
+	type pair struct {
+		a, b     *duplicateTransaction
+		score    float64
+		dateDiff int
+	}
+	pairs := make([]pair, 0)
+	for i := range transactions {
+		for j := i + 1; j < len(transactions); j++ {
+			a, b := &transactions[i], &transactions[j]
+			dateDiff := int(b.Date.Sub(a.Date).Hours() / 24)
+			if dateDiff > days {
+				break
+			}
+			if a.Amount == "" || a.Amount != b.Amount || shareLink(a.Links, b.Links) || ignored[duplicatePairKey(a.Key, b.Key)] {
+				continue
+			}
+			score := duplicateScore(a, b, dateDiff, days)
+			if score >= minScore {
+				pairs = append(pairs, pair{a: a, b: b, score: score, dateDiff: dateDiff})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].score > pairs[j].score
+	})
+	if len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+
+	result := make([]DuplicateCandidate, 0, len(pairs))
+	for _, p := range pairs {
+		result = append(result, DuplicateCandidate{
+			Score:        math.Round(p.score*100) / 100,
+			DateDiff:     p.dateDiff,
+			Transactions: []TransactionGroup{p.a.Group, p.b.Group},
+		})
+	}
+	OK(c, result)
+}
+
+// ResolveDuplicateTransactions 处理一对重复候选：delete 删除其中一笔，link 为两笔交易添加相同的 link，ignore 加入忽略列表
+func ResolveDuplicateTransactions(c *gin.Context) {
+	var form DuplicateResolveForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	if len(form.IDs) != 2 || form.IDs[0] == form.IDs[1] {
+		BadRequest(c, "Param 'ids' must contain two different transactions.")
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	if form.Action == DuplicateActionDelete || form.Action == DuplicateActionLink {
+		// 从定位交易到写回期间不能有其他写入，否则会被覆盖
+		lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	switch form.Action {
+	case DuplicateActionDelete:
+		if form.DeleteId != form.IDs[0] && form.DeleteId != form.IDs[1] {
+			BadRequest(c, "Param 'deleteId' must be one of 'ids'.")
+			return
+		}
+		location, err := locateTransaction(ledgerConfig, form.DeleteId)
+		if err != nil {
+			QueryError(c, err)
+			return
+		}
+		if err = script.WriteToFile(location.FilePath, location.RemoveEntry()); err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		OK(c, form.DeleteId)
+	case DuplicateActionLink:
+		link := DuplicateLinkPrefix + strings.ReplaceAll(script.NewUUID(), "-", "")[:12]
+		for _, id := range form.IDs {
+			err := updateTransactionHeader(ledgerConfig, id, func(header string) string {
+				return script.AddHeaderLink(header, link)
+			})
+			if err != nil {
+				QueryError(c, err)
+				return
+			}
+		}
+		OK(c, link)
+	case DuplicateActionIgnore:
+		keys, err := duplicateTransactionKeys(ledgerConfig, form.IDs)
+		if err != nil {
+			QueryError(c, err)
+			return
+		}
+		duplicateMutex.Lock()
+		defer duplicateMutex.Unlock()
+		filePath := script.GetLedgerDuplicateIgnoreFilePath(ledgerConfig.DataPath)
+		ignores, err := getLedgerDuplicateIgnores(filePath)
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		key := duplicatePairKey(keys[0], keys[1])
+		for _, ignore := range ignores {
+			if strings.Join(ignore.IDs, ",") == key {
+				OK(c, ignore)
+				return
+			}
+		}
+		ignore := DuplicateIgnore{IDs: strings.Split(key, ","), IgnoredAt: time.Now().Format("2006-01-02 15:04:05")}
+		if err = writeLedgerDuplicateIgnores(filePath, append(ignores, ignore)); err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		OK(c, ignore)
+	default:
+		BadRequest(c, fmt.Sprintf("Param 'action' must be one of %s, %s, %s.", DuplicateActionDelete, DuplicateActionLink, DuplicateActionIgnore))
+	}
+}
+
+func QueryDuplicateIgnores(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	ignores, err := getLedgerDuplicateIgnores(script.GetLedgerDuplicateIgnoreFilePath(ledgerConfig.DataPath))
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	OK(c, ignores)
+}
+
+// DeleteDuplicateIgnore 取消忽略，id 传两次，为忽略列表中记录的 uuid 或交易 id
+func DeleteDuplicateIgnore(c *gin.Context) {
+	ids := c.QueryArray("id")
+	if len(ids) != 2 {
+		BadRequest(c, "Param 'id' must be passed twice.")
+		return
+	}
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	duplicateMutex.Lock()
+	defer duplicateMutex.Unlock()
+	filePath := script.GetLedgerDuplicateIgnoreFilePath(ledgerConfig.DataPath)
+	ignores, err := getLedgerDuplicateIgnores(filePath)
+	if err != nil {
+		InternalError(c, err.Error())
+		return
+	}
+	key := duplicatePairKey(ids[0], ids[1])
+	for i, ignore := range ignores {
+		if strings.Join(ignore.IDs, ",") == key {
+			if err = writeLedgerDuplicateIgnores(filePath, append(ignores[:i], ignores[i+1:]...)); err != nil {
+				InternalError(c, err.Error())
+				return
+			}
+			OK(c, ignore)
+			return
+		}
+	}
+	BadRequest(c, "Ignored pair "+key+" not found")
+}
+
+// queryDuplicateTransactions 查询账本中所有交易并按日期排序。内容相同的交易 id 相同，按交易所在的文件和行号区分交易，
+// 返回的交易 id 为 uuid（没有 uuid 时为交易 id），用于定位其中的一笔
+func queryDuplicateTransactions(ledgerConfig *script.Config) ([]duplicateTransaction, error) {
+	postings := make([]duplicatePosting, 0)
+	query := script.NewBQLQuery().Select("id").Select("filename").Select("lineno").Select("date").Select("payee").
+		Select("narration").Select("tags").Select("links").Select("account").Select("number").Select("currency").SelectAs("uuid", "entry_meta(?)", script.TransactionUUIDKey)
+	if err := script.BQLQueryListByCustomSelect(ledgerConfig, query, nil, &postings); err != nil {
+		return nil, err
+	}
+
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
+	transactions := make([]duplicateTransaction, 0)
+	amounts := make([]map[string]decimal.Decimal, 0)
+	indexes := make(map[string]int)
+	for _, posting := range postings {
+		location := posting.FileName + ":" + posting.LineNo
+		index, ok := indexes[location]
+		if !ok {
+			date, err := time.Parse("2006-01-02", posting.Date)
+			if err != nil {
+				return nil, err
+			}
+			key := posting.UUID
+			if key == "" {
+				key = posting.Id
+			}
+			index = len(transactions)
+			indexes[location] = index
+			transactions = append(transactions, duplicateTransaction{
+				Key: key, Date: date, Payee: posting.Payee, Narration: posting.Narration,
+				Links: posting.Links, Accounts: make(map[string]bool),
+				Group: TransactionGroup{
+					Id: key, Date: posting.Date, Payee: posting.Payee, Desc: posting.Narration,
+					Tags: posting.Tags, Links: posting.Links, Entries: make([]TransactionGroupEntry, 0),
+				},
+			})
+			amounts = append(amounts, make(map[string]decimal.Decimal))
+		}
+		transactions[index].Accounts[posting.Account] = true
+		transactions[index].Group.Entries = append(transactions[index].Group.Entries, TransactionGroupEntry{
+			Account:        posting.Account,
+			Number:         precisions.FormatString(posting.Number, posting.Currency),
+			Currency:       posting.Currency,
+			CurrencySymbol: script.GetCommoditySymbol(ledgerConfig.Id, posting.Currency),
+		})
+		number, err := decimal.NewFromString(posting.Number)
+		if err == nil && number.IsPositive() {
+			amounts[index][posting.Currency] = amounts[index][posting.Currency].Add(number)
+		}
+	}
+	for i := range transactions {
+		parts := make([]string, 0, len(amounts[i]))
+		for currency, number := range amounts[i] {
+			parts = append(parts, number.String()+" "+currency)
+		}
+		sort.Strings(parts)
+		transactions[i].Amount = strings.Join(parts, ",")
+	}
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Date.Before(transactions[j].Date)
+	})
+	return transactions, nil
+}
+
+// duplicateScore 金额相同占 0.4，日期越近、账户重合越多、payee（都为空时比较摘要）越相似得分越高，各占 0.2
+func duplicateScore(a *duplicateTransaction, b *duplicateTransaction, dateDiff int, days int) float64 {
+	dateScore := 1 - float64(dateDiff)/float64(days+1)
+	common := 0
+	for account := range a.Accounts {
+		if b.Accounts[account] {
+			common++
+		}
+	}
+	accountScore := float64(common) / float64(len(a.Accounts)+len(b.Accounts)-common)
+	textA, textB := a.Payee, b.Payee
+	if textA == "" && textB == "" {
+		textA, textB = a.Narration, b.Narration
+	}
+	return 0.4 + 0.2*dateScore + 0.2*accountScore + 0.2*textSimilarity(textA, textB)
+}
+
+// textSimilarity 忽略大小写和空白后相同为 1，包含关系至少为 0.8，其余按字符二元组的 Dice 系数计算
+func textSimilarity(a string, b string) float64 {
+	a, b = normalizeText(a), normalizeText(b)
+	if a == b {
+		return 1
+	}
+	if a == "" || b == "" {
+		return 0
+	}
+	bigrams := func(s string) map[string]int {
+		runes := []rune(s)
+		result := make(map[string]int)
+		if len(runes) == 1 {
+			result[s]++
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			result[string(runes[i:i+2])]++
+		}
+		return result
+	}
+	bigramsA, bigramsB := bigrams(a), bigrams(b)
+	total, common := 0, 0
+	for bigram, count := range bigramsA {
+		total += count
+		if n := bigramsB[bigram]; n < count {
+			common += n
+		} else {
+			common += count
+		}
+	}
+	for _, count := range bigramsB {
+		total += count
+	}
+	score := 2 * float64(common) / float64(total)
+	if (strings.Contains(a, b) || strings.Contains(b, a)) && score < 0.8 {
+		score = 0.8
+	}
+	return score
+}
+
+func normalizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+func shareLink(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func duplicatePairKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "," + b
+}
+
+// duplicateTransactionKeys 交易的 uuid，没有 uuid 时为交易 id
+func duplicateTransactionKeys(ledgerConfig *script.Config, ids []string) ([]string, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		rows, err := queryTransactionUUIDs(ledgerConfig, script.TransactionIdCondition(id))
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, errors.New("no transaction found")
+		}
+		if rows[0].UUID != "" {
+			keys = append(keys, rows[0].UUID)
+		} else {
+			keys = append(keys, rows[0].Id)
+		}
+	}
+	return keys, nil
+}
+
+func getLedgerDuplicateIgnores(filePath string) ([]DuplicateIgnore, error) {
+	result := make([]DuplicateIgnore, 0)
+	if script.FileIfExist(filePath) {
+		bytes, err := script.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(bytes, &result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func writeLedgerDuplicateIgnores(filePath string, ignores []DuplicateIgnore) error {
+	if !script.FileIfExist(filePath) {
+		err := script.CreateFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	bytes, err := json.Marshal(ignores)
+	if err != nil {
+		return err
+	}
+	return script.WriteFile(filePath, string(bytes))
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/beancount-gs/script"
+	"github.com/gin-gonic/gin"
+)
+
+type transactionUUIDRow struct {
+	Id       string `bql:"id"`
+	FileName string `bql:"filename"`
+	LineNo   string `bql:"lineno"`
+	Date     string `bql:"date"`
+	UUID     string `bql:"uuid"`
+}
+
+func queryTransactionUUIDs(ledgerConfig *script.Config, condition script.BQLCondition) ([]transactionUUIDRow, error) {
+	rows := make([]transactionUUIDRow, 0)
+	query := script.NewBQLQuery().Distinct().Select("id").Select("filename").Select("lineno").Select("date").
+		SelectAs("uuid", "entry_meta(?)", script.TransactionUUIDKey).Where(condition)
+	err := script.BQLQueryListByCustomSelect(ledgerConfig, query, nil, &rows)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// resolveTransactionId 将交易的 uuid 转换为 beancount 的交易 id（内容的 hash），不是 uuid 或找不到对应的交易时原样返回。
+// 内容相同的交易 id 相同，只用于按内容输出交易，定位和修改交易使用 script.TransactionIdCondition
+func resolveTransactionId(ledgerConfig *script.Config, transactionId string) (string, error) {
+	if !script.IsUUID(transactionId) {
+		return transactionId, nil
+	}
+	rows, err := queryTransactionUUIDs(ledgerConfig, script.TransactionIdCondition(transactionId))
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 {
+		return transactionId, nil
+	}
+	return rows[0].Id, nil
+}
+
+// transactionUUID 更新交易时沿用原交易的 uuid，其次使用表单元数据中的 uuid，都没有时生成新的 uuid
+func transactionUUID(ledgerConfig *script.Config, transactionForm TransactionForm) (string, error) {
+	if transactionForm.ID != "" {
+		rows, err := queryTransactionUUIDs(ledgerConfig, script.TransactionIdCondition(transactionForm.ID))
+		if err != nil {
+			return "", err
+		}
+		if len(rows) > 0 && rows[0].UUID != "" {
+			return rows[0].UUID, nil
+		}
+	}
+	if value, ok := transactionForm.Meta[script.TransactionUUIDKey]; ok && value != nil {
+		uuid, ok := value.(string)
+		if !ok || !script.IsUUID(uuid) {
+			return "", fmt.Errorf("%w: uuid %v", script.ErrInvalidMeta, value)
+		}
+		return uuid, nil
+	}
+	return script.NewUUID(), nil
+}
+
+// BackfillTransactionUUIDs 为账本中没有 uuid 的交易补充 uuid 元数据，返回补充的交易数量
+func BackfillTransactionUUIDs(c *gin.Context) {
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	// 从查询到写回期间不能有其他写入，否则会被覆盖
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	// pad 生成的交易没有元数据，行号指向 pad 指令
+	rows, err := queryTransactionUUIDs(ledgerConfig, script.Compare("flag", "!=", "P"))
+	if err != nil {
+		QueryError(c, err)
+		return
+	}
+	// 文件 -> 需要补充 uuid 的交易首行行号
+	fileLines := make(map[string][]int)
+	for _, row := range rows {
+		if row.UUID != "" {
+			continue
+		}
+		lineNo, err := strconv.Atoi(row.LineNo)
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		filePath := filepath.Clean(row.FileName)
+		fileLines[filePath] = append(fileLines[filePath], lineNo)
+	}
+
+	count := 0
+	for filePath, lineNos := range fileLines {
+		lines, err := script.ReadLines(filePath)
+		if err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		// 从后往前插入，前面的行号不受影响
+		sort.Sort(sort.Reverse(sort.IntSlice(lineNos)))
+		inserted := 0
+		for _, lineNo := range lineNos {
+			if _, _, err = script.FindEntryLineRange(lines, lineNo); err != nil {
+				InternalError(c, filePath+": "+err.Error())
+				return
+			}
+			if !script.IsTransactionHeader(lines[lineNo-1]) {
+				continue
+			}
+			metaLine := fmt.Sprintf("  %s: %s", script.TransactionUUIDKey, script.FormatBeanString(script.NewUUID()))
+			lines, err = script.InsertLines(lines, lineNo+1, []string{metaLine})
+			if err != nil {
+				InternalError(c, err.Error())
+				return
+			}
+			inserted++
+		}
+		if inserted == 0 {
+			continue
+		}
+		if err = script.WriteToFile(filePath, lines); err != nil {
+			InternalError(c, err.Error())
+			return
+		}
+		count += inserted
+	}
+	OK(c, count)
+}
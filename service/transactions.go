@@ -10,6 +10,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/shopspring/decimal"
 	"io"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +21,7 @@ type Transaction struct {
 	Id                 string   `bql:"id" json:"id"`
 	Account            string   `bql:"account" json:"account"`
 	Date               string   `bql:"date" json:"date"`
+	Flag               string   `bql:"flag" json:"flag"`
 	Payee              string   `bql:"payee" json:"payee"`
 	Narration          string   `bql:"narration" json:"desc"`
 	Number             string   `bql:"number" json:"number"`
@@ -29,9 +32,12 @@ type Transaction struct {
 	CostCurrency       string   `bql:"cost_currency" json:"costCurrency"`
 	Price              string   `bql:"price" json:"price"`
 	Tags               []string `bql:"tags" json:"tags"`
+	Links              []string `bql:"links" json:"links"`
 	CurrencySymbol     string   `json:"currencySymbol,omitempty"`
 	CostCurrencySymbol string   `json:"costCurrencySymbol,omitempty"`
 	IsAnotherCurrency  bool     `json:"isAnotherCurrency,omitempty"`
+	// Meta 通过 meta 参数指定的元数据
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
 type RawTransaction struct {
@@ -78,9 +84,12 @@ func QueryTransactionDetailById(c *gin.Context) {
 		if transactionForm.ID == "" {
 			transactionForm.ID = transaction.Id
 			transactionForm.Date = transaction.Date
+			transactionForm.Flag = transaction.Flag
 			transactionForm.Payee = transaction.Payee
 			transactionForm.Desc = transaction.Narration
 			transactionForm.Narration = transaction.Narration
+			transactionForm.Tags = transaction.Tags
+			transactionForm.Links = transaction.Links
 		}
 		transactionEntryForm := TransactionEntryForm{
 			Account: transaction.Account,
@@ -96,38 +105,123 @@ func QueryTransactionDetailById(c *gin.Context) {
 		}
 		transactionForm.Entries = append(transactionForm.Entries, transactionEntryForm)
 	}
+	// 元数据、成本和价格从交易原文中读取
+	var entry *script.Entry
+	rawText, _, err := transactionRawText(ledgerConfig, queryParams.ID)
+	if err == nil {
+		entry, err = script.ParseTransactionText(rawText)
+	}
+	if err == nil {
+		transactionForm.Meta = script.MetaToJSON(entry.Meta)
+		if len(entry.Postings) == len(transactionForm.Entries) {
+			for i, posting := range entry.Postings {
+				transactionForm.Entries[i].Meta = script.MetaToJSON(posting.Meta)
+				transactionForm.Entries[i].Cost = newTransactionCostForm(posting.CostSpec)
+				transactionForm.Entries[i].PriceAnnotation = newTransactionPriceForm(posting.Price)
+			}
+		}
+	}
+	if err != nil {
+		script.LogError(ledgerConfig.Mail, "Failed to read transaction metadata, "+err.Error())
+	}
 	OK(c, transactionForm)
 }
 
+// QueryTransactionRawTextById 返回交易在源文件中的原文，X-Entry-Checksum 为原文的校验值，修改或删除时传入以检查原文是否被修改
 func QueryTransactionRawTextById(c *gin.Context) {
 	queryParams := script.GetQueryParams(c)
 	if queryParams.ID == "" {
 		BadRequest(c, "Param 'id' must not be blank.")
+		return
 	}
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
-	result, err := script.BQLPrint(ledgerConfig, queryParams.ID)
+	result, checksum, err := transactionRawText(ledgerConfig, queryParams.ID)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
+	if checksum != "" {
+		c.Header("X-Entry-Checksum", checksum)
+	}
 	OK(c, result)
 }
 
+// transactionRawText 交易在源文件中的原文和校验值，源文件不在本地磁盘上（如内存中的账本）时返回 beancount 输出的交易，校验值为空
+func transactionRawText(ledgerConfig *script.Config, transactionId string) (string, string, error) {
+	location, err := locateTransaction(ledgerConfig, transactionId)
+	if err == nil {
+		return strings.Join(location.EntryLines(), "\n"), location.Checksum(), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	transactionId, err = resolveTransactionId(ledgerConfig, transactionId)
+	if err != nil {
+		return "", "", err
+	}
+	result, err := script.BQLPrint(ledgerConfig, transactionId)
+	return result, "", err
+}
+
 func QueryTransactions(c *gin.Context) {
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
-	queryParams := script.GetQueryParams(c)
-	// 倒序查询
-	queryParams.OrderBy = "date desc"
+	queryParams, err := script.ParseQueryParams(c)
+	if err != nil {
+		BadRequest(c, err.Error())
+		return
+	}
+	// 传入 limit 或 cursor 时分页返回，否则返回全部结果
+	paged := c.Query("limit") != "" || c.Query("cursor") != ""
+	limit := script.DefaultPageSize
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > script.MaxPageSize {
+			BadRequest(c, fmt.Sprintf("Param 'limit' must be between 1 and %d.", script.MaxPageSize))
+			return
+		}
+	}
+	var cursor *script.PageCursor
+	if c.Query("cursor") != "" {
+		decoded, e := script.DecodePageCursor(c.Query("cursor"))
+		if e != nil {
+			BadRequest(c, e.Error())
+			return
+		}
+		cursor = &decoded
+	}
+	// 倒序查询，同一天的交易按 id 排序保证分页稳定
+	queryParams.OrderBy = "date desc, id desc"
 	transactions := make([]Transaction, 0)
-	err := script.BQLQueryList(ledgerConfig, &queryParams, &transactions)
+	// meta=receipt,location 同时返回指定的元数据
+	if c.Query("meta") != "" {
+		var metas []map[string]string
+		metas, err = script.BQLQueryListWithMeta(ledgerConfig, &queryParams, &transactions, strings.Split(c.Query("meta"), ","))
+		if errors.Is(err, script.ErrInvalidMeta) {
+			BadRequest(c, err.Error())
+			return
+		}
+		for i := 0; err == nil && i < len(transactions) && i < len(metas); i++ {
+			if len(metas[i]) > 0 {
+				transactions[i].Meta = metas[i]
+			}
+		}
+	} else {
+		err = script.BQLQueryList(ledgerConfig, &queryParams, &transactions)
+	}
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
+	var page *TransactionPage
+	if paged {
+		page = pageTransactions(transactions, cursor, limit)
+		transactions = page.Items
+	}
 
 	currencyMap := script.GetLedgerCurrencyMap(ledgerConfig.Id)
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
 
-	// 格式化金额
+	// 格式化金额，按商品的小数位数输出
 	for i := 0; i < len(transactions); i++ {
 		_, ok := currencyMap[transactions[i].Currency]
 		if ok {
@@ -137,31 +231,105 @@ func QueryTransactions(c *gin.Context) {
 		symbol := script.GetCommoditySymbol(ledgerConfig.Id, transactions[i].Currency)
 		transactions[i].CurrencySymbol = symbol
 		transactions[i].CostCurrencySymbol = symbol
+		if transactions[i].Number != "" {
+			transactions[i].Number = precisions.FormatString(transactions[i].Number, transactions[i].Currency)
+		}
+		if transactions[i].CostPrice != "" {
+			transactions[i].CostPrice = precisions.FormatString(transactions[i].CostPrice, transactions[i].CostCurrency)
+		}
 		if transactions[i].Price != "" {
-			transactions[i].Price = strings.Fields(transactions[i].Price)[0]
+			transactions[i].Price = formatAmountNumber(precisions, transactions[i].Price)
 		}
 		if transactions[i].Balance != "" {
-			transactions[i].Balance = strings.Fields(transactions[i].Balance)[0]
+			transactions[i].Balance = formatAmountNumber(precisions, transactions[i].Balance)
 		}
 	}
+	if page != nil {
+		OK(c, page)
+		return
+	}
 	OK(c, transactions)
 }
 
+// formatAmountNumber 取出 "100 CNY" 形式金额中的数值，按币种的小数位数输出
+func formatAmountNumber(precisions script.CommodityPrecisions, amount string) string {
+	fields := strings.Fields(amount)
+	if len(fields) == 0 {
+		return amount
+	}
+	if len(fields) < 2 {
+		return fields[0]
+	}
+	return precisions.FormatString(fields[0], fields[1])
+}
+
+type TransactionPage struct {
+	Items      []Transaction `json:"items"`
+	Total      int           `json:"total"`
+	HasMore    bool          `json:"hasMore"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// pageTransactions 从游标之后取 limit 条过账，transactions 需按 date、id 倒序排列
+func pageTransactions(transactions []Transaction, cursor *script.PageCursor, limit int) *TransactionPage {
+	start := 0
+	if cursor != nil {
+		skipped := 0
+		for start < len(transactions) {
+			t := transactions[start]
+			if t.Date == cursor.Date && t.Id == cursor.Id {
+				// 跳过游标所在交易已返回的过账
+				if skipped >= cursor.Offset {
+					break
+				}
+				skipped++
+			} else if cursor.After(t.Date, t.Id) {
+				break
+			}
+			start++
+		}
+	}
+	end := start + limit
+	if end > len(transactions) {
+		end = len(transactions)
+	}
+	page := &TransactionPage{Items: transactions[start:end], Total: len(transactions), HasMore: end < len(transactions)}
+	if page.HasMore {
+		last := transactions[end-1]
+		next := script.PageCursor{Date: last.Date, Id: last.Id}
+		// 统计最后一个交易在本页及之前已返回的过账数
+		for i := end - 1; i >= 0 && transactions[i].Date == last.Date && transactions[i].Id == last.Id; i-- {
+			next.Offset++
+		}
+		page.NextCursor = next.Encode()
+	}
+	return page
+}
+
 type TransactionForm struct {
-	ID             string                 `form:"id" json:"id"`
-	Date           string                 `form:"date" binding:"required" json:"date"`
+	ID   string `form:"id" json:"id"`
+	Date string `form:"date" binding:"required" json:"date"`
+	// Flag 交易标记，* 为已确认（默认），! 为待确认
+	Flag           string                 `form:"flag" json:"flag,omitempty"`
 	Payee          string                 `form:"payee" json:"payee,omitempty"`
 	Desc           string                 `form:"desc" binding:"required" json:"desc"`
 	Narration      string                 `form:"narration" json:"narration,omitempty"`
 	Tags           []string               `form:"tags" json:"tags,omitempty"`
+	Links          []string               `form:"links" json:"links,omitempty"`
 	DivideDateList []string               `form:"divideDateList" json:"divideDateList,omitempty"`
 	Entries        []TransactionEntryForm `form:"entries" json:"entries"`
-	RawText        string                 `json:"rawText,omitempty"`
+	// InstallmentFees 分期时添加到每一期的手续费/利息过账（不拆分，需自身平衡）
+	InstallmentFees []TransactionEntryForm `form:"installmentFees" json:"installmentFees,omitempty"`
+	RawText         string                 `json:"rawText,omitempty"`
+	// Meta 交易的元数据，字符串、数字和布尔值分别写为对应类型，YYYY-MM-DD 格式的字符串写为日期
+	Meta map[string]interface{} `form:"meta" json:"meta,omitempty"`
 }
 
 type UpdateRawTextTransactionForm struct {
 	ID      string `form:"id" binding:"required" json:"id"`
 	RawText string `form:"rawText" json:"rawText,omitempty" binding:"required"`
+	// Checksum 查询原文时返回的校验值，不为空时原文被修改过则拒绝修改
+	Checksum string `form:"checksum" json:"checksum,omitempty"`
 }
 
 type TransactionEntryForm struct {
@@ -171,41 +339,101 @@ type TransactionEntryForm struct {
 	Price             decimal.Decimal `form:"price" json:"price,omitempty"`
 	PriceCurrency     string          `form:"priceCurrency" json:"priceCurrency,omitempty"`
 	IsAnotherCurrency bool            `form:"isAnotherCurrency" json:"isAnotherCurrency,omitempty"`
+	// Cost 成本，所有字段为空时输出 {}，按持仓匹配成本（减仓）。设置 Cost 或 PriceAnnotation 后不再使用 Price 字段
+	Cost *TransactionCostForm `json:"cost,omitempty"`
+	// PriceAnnotation 价格 @，Total 为 true 时为总价 @@
+	PriceAnnotation *TransactionPriceForm `json:"priceAnnotation,omitempty"`
+	// Meta 过账的元数据
+	Meta map[string]interface{} `form:"meta" json:"meta,omitempty"`
 }
 
-func sum(entries []TransactionEntryForm, openingBalances string) decimal.Decimal {
-	sumVal := decimal.NewFromInt(0)
-	for _, entry := range entries {
-		if entry.Account == openingBalances {
-			return decimal.NewFromInt(0)
-		}
-		pVal, _ := entry.Price.Float64()
-		if pVal == 0 {
-			sumVal = entry.Number.Add(sumVal)
-		} else {
-			sumVal = entry.Number.Mul(entry.Price).Add(sumVal)
-		}
+// TransactionCostForm 过账的成本，Number 为单位成本，Total 为总成本 {{}}，Label 为持仓批次的标签
+type TransactionCostForm struct {
+	Number   *decimal.Decimal `json:"number,omitempty"`
+	Total    *decimal.Decimal `json:"total,omitempty"`
+	Currency string           `json:"currency,omitempty"`
+	Date     string           `json:"date,omitempty"`
+	Label    string           `json:"label,omitempty"`
+}
+
+type TransactionPriceForm struct {
+	Number   decimal.Decimal `json:"number"`
+	Currency string          `json:"currency"`
+	Total    bool            `json:"total,omitempty"`
+}
+
+// transactionBalanceTolerance 交易每个币种允许的误差
+var transactionBalanceTolerance = decimal.New(1, -1)
+
+func newTransactionCostForm(spec *script.CostSpec) *TransactionCostForm {
+	if spec == nil {
+		return nil
 	}
-	return sumVal
+	return &TransactionCostForm{Number: spec.Number, Total: spec.NumberTotal, Currency: spec.Currency, Date: spec.Date, Label: spec.Label}
 }
 
-func AddBatchTransactions(c *gin.Context) {
-	var addTransactionForms []TransactionForm
-	if err := c.ShouldBindJSON(&addTransactionForms); err != nil {
-		BadRequest(c, err.Error())
-		return
+func newTransactionPriceForm(spec *script.PriceSpec) *TransactionPriceForm {
+	if spec == nil || spec.Number == nil {
+		return nil
 	}
-	result := make([]string, 0)
-	ledgerConfig := script.GetLedgerConfigFromContext(c)
-	for _, form := range addTransactionForms {
-		err := saveTransaction(nil, form, ledgerConfig)
-		if err == nil {
-			result = append(result, form.Date+form.Payee+form.Desc)
-		} else {
-			script.LogError(ledgerConfig.Mail, err.Error())
+	return &TransactionPriceForm{Number: *spec.Number, Currency: spec.Currency, Total: spec.Total}
+}
+
+// posting 将表单转换为过账，第二个返回值为 true 表示使用 Price 字段的旧格式（以记账货币计的成本或价格，同时需要记录汇率）
+func (entry TransactionEntryForm) posting(ledgerConfig *script.Config, date string, currencyMap map[string]script.LedgerCurrency) (script.Posting, bool, error) {
+	posting := script.Posting{Account: entry.Account}
+	// 平衡账户不填写金额，由 beancount 自动补全
+	if entry.Account == ledgerConfig.OpeningBalances {
+		return posting, false, nil
+	}
+	if err := script.CheckCurrency(entry.Currency); err != nil {
+		return posting, false, err
+	}
+	number := entry.Number
+	posting.Number = &number
+	posting.Currency = entry.Currency
+
+	if entry.Cost != nil || entry.PriceAnnotation != nil {
+		if entry.Cost != nil {
+			posting.CostSpec = &script.CostSpec{
+				Number:      entry.Cost.Number,
+				NumberTotal: entry.Cost.Total,
+				Currency:    entry.Cost.Currency,
+				Date:        entry.Cost.Date,
+				Label:       entry.Cost.Label,
+			}
+			if err := posting.CostSpec.Check(); err != nil {
+				return posting, false, err
+			}
+		}
+		if entry.PriceAnnotation != nil {
+			price := entry.PriceAnnotation.Number
+			posting.Price = &script.PriceSpec{Number: &price, Currency: entry.PriceAnnotation.Currency, Total: entry.PriceAnnotation.Total}
+			if err := posting.Price.Check(); err != nil {
+				return posting, false, err
+			}
 		}
+		return posting, false, nil
 	}
-	OK(c, result)
+
+	// 旧格式：非记账货币且汇率值大于 0 时进行汇率转换
+	if entry.Currency == ledgerConfig.OperatingCurrency || !entry.Price.IsPositive() {
+		return posting, false, nil
+	}
+	price := entry.Price
+	if _, isCurrency := currencyMap[entry.Currency]; isCurrency {
+		// 外币种格式：Assets:Fixed:三顿半咖啡 -1.00 SATURN_BIRD {5.61 CNY}
+		// fix issue #66 https://github.com/BaoXuebin/beancount-gs/issues/66
+		posting.CostSpec = &script.CostSpec{Number: &price, Currency: ledgerConfig.OperatingCurrency}
+	} else if entry.Number.IsPositive() {
+		// 根据 number 的正负来判断是买入还是卖出，买入：{351.729 CNY, 2021-09-29}
+		posting.CostSpec = &script.CostSpec{Number: &price, Currency: ledgerConfig.OperatingCurrency, Date: date}
+	} else {
+		// 卖出：{} @ 359.019 CNY
+		posting.CostSpec = &script.CostSpec{}
+		posting.Price = &script.PriceSpec{Number: &price, Currency: ledgerConfig.OperatingCurrency}
+	}
+	return posting, true, nil
 }
 
 func AddTransactions(c *gin.Context) {
@@ -216,123 +444,244 @@ func AddTransactions(c *gin.Context) {
 	}
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
 	// 判断是否分期
-	var err error
-	var divideCount = len(addTransactionForm.DivideDateList)
-	if divideCount <= 0 {
-		err = saveTransaction(c, addTransactionForm, ledgerConfig)
-	} else {
-		for idx, entry := range addTransactionForm.Entries {
-			// 保留 3 位小数
-			addTransactionForm.Entries[idx].Number = entry.Number.Div(decimal.NewFromInt(int64(divideCount))).Round(3)
-		}
-		for _, date := range addTransactionForm.DivideDateList {
-			addTransactionForm.Date = date
-			err = saveTransaction(c, addTransactionForm, ledgerConfig)
-			if err != nil {
-				break
-			}
+	if len(addTransactionForm.DivideDateList) <= 0 {
+		if err := saveTransaction(c, addTransactionForm, ledgerConfig); err != nil {
+			script.LogError(ledgerConfig.Mail, err.Error())
+			return
 		}
+		OK(c, nil)
+		return
 	}
-
+	forms, link, err := installmentForms(ledgerConfig, addTransactionForm)
 	if err != nil {
 		script.LogError(ledgerConfig.Mail, err.Error())
+		if errors.Is(err, script.ErrTransactionNotBalance) {
+			TransactionNotBalance(c)
+		} else {
+			BadRequest(c, err.Error())
+		}
+		return
+	}
+	// 所有分期一次性写入，任何一期失败时都不写入
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	prepared := make([]*preparedTransaction, len(forms))
+	for i, form := range forms {
+		if prepared[i], err = prepareTransaction(ledgerConfig, form); err != nil {
+			script.LogError(ledgerConfig.Mail, err.Error())
+			respondTransactionError(c, err)
+			return
+		}
+	}
+	if err = writePreparedTransactions(ledgerConfig, prepared); err != nil {
+		script.LogError(ledgerConfig.Mail, err.Error())
+		InternalError(c, err.Error())
 		return
 	}
-	OK(c, nil)
+	// 返回分期的 link，用于查询和取消剩余的分期
+	OK(c, link)
 }
 
-func saveTransaction(c *gin.Context, addTransactionForm TransactionForm, ledgerConfig *script.Config) error {
-	// 账户是否平衡
-	sumVal := sum(addTransactionForm.Entries, ledgerConfig.OpeningBalances)
-	val, _ := decimal.NewFromString("0.1")
-	if sumVal.Abs().GreaterThan(val) {
-		if c != nil {
-			TransactionNotBalance(c)
+// transactionPostings 将表单的分录转换为过账并校验是否平衡，不平衡时返回 script.ErrTransactionNotBalance
+func transactionPostings(ledgerConfig *script.Config, form TransactionForm) ([]script.Posting, []bool, error) {
+	currencyMap := script.GetLedgerCurrencyMap(ledgerConfig.Id)
+	postings := make([]script.Posting, len(form.Entries))
+	legacyPrices := make([]bool, len(form.Entries))
+	for i, entry := range form.Entries {
+		var err error
+		postings[i], legacyPrices[i], err = entry.posting(ledgerConfig, form.Date, currencyMap)
+		if err != nil {
+			return nil, nil, err
 		}
-		return errors.New("transaction not balance")
 	}
+	if err := script.CheckPostingsBalance(postings, transactionBalanceTolerance); err != nil {
+		return nil, nil, err
+	}
+	return postings, legacyPrices, nil
+}
+
+// errInvalidTransactionDate 交易日期不是 YYYY-MM-DD 格式
+var errInvalidTransactionDate = errors.New("invalid transaction date")
 
+// isTransactionFormError 表单内容错误（非服务端错误）
+func isTransactionFormError(err error) bool {
+	for _, target := range []error{script.ErrInvalidPosting, script.ErrInvalidMeta, script.ErrInvalidFlag, script.ErrInvalidLink, errInvalidTransactionDate} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionErrorCode 保存交易失败的错误码，与接口返回的 code 一致
+func transactionErrorCode(err error) int {
+	switch {
+	case errors.Is(err, script.ErrTransactionNotBalance):
+		return 1001
+	case errors.Is(err, script.ErrQueryTimeout):
+		return 1009
+	case errors.Is(err, script.ErrEntryChanged):
+		return 1011
+	case isTransactionFormError(err):
+		return 400
+	}
+	return 500
+}
+
+func respondTransactionError(c *gin.Context, err error) {
+	switch transactionErrorCode(err) {
+	case 1001:
+		TransactionNotBalance(c)
+	case 400:
+		BadRequest(c, err.Error())
+	default:
+		QueryError(c, err)
+	}
+}
+
+// preparedTransaction 校验通过、待写入月份文件的交易
+type preparedTransaction struct {
+	// Text 交易的文本，以换行开头
+	Text  string
+	Month string
+	UUID  string
+	// PriceLines 旧格式汇率转换需要同时记录的汇率
+	PriceLines []string
+	// ReloadCurrency 记录了外币汇率，写入后需要刷新币种缓存
+	ReloadCurrency bool
+}
+
+// prepareTransaction 校验表单（过账、平衡、元数据、标记、link、日期）并生成交易的文本，不写入文件
+func prepareTransaction(ledgerConfig *script.Config, addTransactionForm TransactionForm) (*preparedTransaction, error) {
+	currencyMap := script.GetLedgerCurrencyMap(ledgerConfig.Id)
+	precisions := script.GetCommodityPrecisions(ledgerConfig)
+	postings, legacyPrices, err := transactionPostings(ledgerConfig, addTransactionForm)
+	if err != nil {
+		return nil, err
+	}
+	// 记账的日期
+	month, err := time.Parse("2006-01-02", addTransactionForm.Date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidTransactionDate, addTransactionForm.Date)
+	}
+	// 交易的 uuid 保存在元数据中，不修改表单中的元数据（分期时每期使用不同的 uuid）
+	uuid, err := transactionUUID(ledgerConfig, addTransactionForm)
+	if err != nil {
+		return nil, err
+	}
+	transactionMeta := map[string]interface{}{script.TransactionUUIDKey: uuid}
+	for key, value := range addTransactionForm.Meta {
+		if key != script.TransactionUUIDKey {
+			transactionMeta[key] = value
+		}
+	}
+	// 元数据：交易的元数据在过账之前，过账的元数据紧跟在过账之后
+	transactionMetaLines, err := script.FormatMetaLines(transactionMeta, "  ")
+	if err != nil {
+		return nil, err
+	}
+	if addTransactionForm.Flag == "" {
+		addTransactionForm.Flag = script.FlagCleared
+	}
+	if err = script.CheckFlag(addTransactionForm.Flag); err != nil {
+		return nil, err
+	}
+	for _, link := range addTransactionForm.Links {
+		if err = script.CheckLink(link); err != nil {
+			return nil, err
+		}
+	}
+	entryMetaLines := make([][]string, len(addTransactionForm.Entries))
+	for i, entry := range addTransactionForm.Entries {
+		entryMetaLines[i], err = script.FormatMetaLines(entry.Meta, "    ")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prepared := &preparedTransaction{Month: month.Format("2006-01"), UUID: uuid}
 	// 2021-09-29 * "支付宝" "黄金补仓X元" #Invest
-	line := fmt.Sprintf("\r\n%s * \"%s\" \"%s\"", addTransactionForm.Date, addTransactionForm.Payee, addTransactionForm.Desc)
+	line := fmt.Sprintf("\r\n%s %s \"%s\" \"%s\"", addTransactionForm.Date, addTransactionForm.Flag, addTransactionForm.Payee, addTransactionForm.Desc)
 	if len(addTransactionForm.Tags) > 0 {
 		for _, tag := range addTransactionForm.Tags {
 			line += "#" + tag + " "
 		}
 	}
+	for _, link := range addTransactionForm.Links {
+		line += " ^" + link
+	}
 
-	currencyMap := script.GetLedgerCurrencyMap(ledgerConfig.Id)
+	for _, metaLine := range transactionMetaLines {
+		line += "\r\n" + metaLine
+	}
 
 	var autoBalance bool
-	for _, entry := range addTransactionForm.Entries {
+	postingMeta := ""
+	for i, entry := range addTransactionForm.Entries {
+		// 上一条过账的元数据
+		line += postingMeta
+		postingMeta = ""
+		for _, metaLine := range entryMetaLines[i] {
+			postingMeta += "\r\n" + metaLine
+		}
 		if entry.Account == ledgerConfig.OpeningBalances {
 			autoBalance = false
-			line += fmt.Sprintf("\r\n %s", entry.Account)
-		} else {
-			line += fmt.Sprintf("\r\n %s %s %s", entry.Account, entry.Number.Round(2).StringFixedBank(2), entry.Currency)
-		}
-		zero := decimal.NewFromInt(0)
-		// 判断是否涉及多币种的转换
-		if entry.Currency != ledgerConfig.OperatingCurrency && entry.Account != ledgerConfig.OpeningBalances {
-			// 汇率值小于等于0，则不进行汇率转换
-			if entry.Price.LessThanOrEqual(zero) {
-				continue
-			}
-
-			currency, isCurrency := currencyMap[entry.Currency]
-			currencyPrice := entry.Price
-			if currencyPrice.Equal(zero) {
-				currencyPrice, _ = decimal.NewFromString(currency.Price)
-			}
-			// 货币跳过汇率转换
-			if !isCurrency {
-				// 根据 number 的正负来判断是买入还是卖出
-				if entry.Number.GreaterThan(zero) {
-					// {351.729 CNY, 2021-09-29}
-					line += fmt.Sprintf(" {%s %s, %s}", entry.Price, ledgerConfig.OperatingCurrency, addTransactionForm.Date)
-				} else {
-					// {} @ 359.019 CNY
-					line += fmt.Sprintf(" {} @ %s %s", entry.Price, ledgerConfig.OperatingCurrency)
-				}
-			} else {
-				// 外币种格式：Assets:Fixed:三顿半咖啡 -1.00 SATURN_BIRD {5.61 CNY}
-				// fix issue #66 https://github.com/BaoXuebin/beancount-gs/issues/66
-				line += fmt.Sprintf(" {%s %s}", currencyPrice, ledgerConfig.OperatingCurrency)
-			}
-
-			priceLine := fmt.Sprintf("%s price %s %s %s", addTransactionForm.Date, entry.Currency, entry.Price, ledgerConfig.OperatingCurrency)
-			err := script.AppendFileInNewLine(script.GetLedgerPriceFilePath(ledgerConfig.DataPath), priceLine)
-			if err != nil {
-				if c != nil {
-					InternalError(c, err.Error())
-				}
-				return errors.New("internal error")
-			}
-			// 刷新币种汇率
-			if isCurrency {
-				err = script.LoadLedgerCurrencyMap(ledgerConfig)
-				if err != nil {
-					InternalError(c, err.Error())
-					return errors.New("internal error")
-				}
-			}
 		}
+		line += "\r\n " + script.FormatPosting(postings[i], precisions)
+		if !legacyPrices[i] {
+			continue
+		}
+
+		// 旧格式的汇率转换同时记录汇率
+		_, isCurrency := currencyMap[entry.Currency]
+		prepared.PriceLines = append(prepared.PriceLines, fmt.Sprintf("%s price %s %s %s", addTransactionForm.Date, entry.Currency, precisions.Format(entry.Price, ledgerConfig.OperatingCurrency), ledgerConfig.OperatingCurrency))
+		prepared.ReloadCurrency = prepared.ReloadCurrency || isCurrency
 	}
 
+	line += postingMeta
 	// 平衡小数点误差
 	if autoBalance {
 		line += "\r\n " + ledgerConfig.OpeningBalances
 	}
-	// 记账的日期
-	month, err := time.Parse("2006-01-02", addTransactionForm.Date)
+	prepared.Text = line
+	return prepared, nil
+}
+
+// writeTransactionPrices 记录旧格式汇率转换的汇率，并刷新币种汇率
+func writeTransactionPrices(ledgerConfig *script.Config, prepared *preparedTransaction) error {
+	for _, priceLine := range prepared.PriceLines {
+		if err := script.AppendFileInNewLine(script.GetLedgerPriceFilePath(ledgerConfig.DataPath), priceLine); err != nil {
+			return err
+		}
+	}
+	if prepared.ReloadCurrency {
+		return script.LoadLedgerCurrencyMap(ledgerConfig)
+	}
+	return nil
+}
+
+func saveTransaction(c *gin.Context, addTransactionForm TransactionForm, ledgerConfig *script.Config) error {
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	prepared, err := prepareTransaction(ledgerConfig, addTransactionForm)
 	if err != nil {
+		if c != nil {
+			respondTransactionError(c, err)
+		}
+		return err
+	}
+	if err = writeTransactionPrices(ledgerConfig, prepared); err != nil {
 		if c != nil {
 			InternalError(c, err.Error())
 		}
 		return errors.New("internal error")
 	}
+	line := prepared.Text
 
 	// 交易的月份信息
-	monthStr := month.Format("2006-01")
+	monthStr := prepared.Month
 	err = CreateMonthBeanFileIfNotExist(ledgerConfig.DataPath, monthStr)
 	if err != nil {
 		if c != nil {
@@ -343,34 +692,38 @@ func saveTransaction(c *gin.Context, addTransactionForm TransactionForm, ledgerC
 
 	beanFilePath := script.GetLedgerMonthFilePath(ledgerConfig.DataPath, monthStr)
 	if addTransactionForm.ID != "" { // 更新交易
-		result, e := script.BQLPrint(ledgerConfig, addTransactionForm.ID)
+		// 按交易实际所在的文件和行号定位原交易，日期变更到其它月份时原交易不在新月份的文件中
+		location, e := locateTransaction(ledgerConfig, addTransactionForm.ID)
 		if e != nil {
-			InternalError(c, e.Error())
-			return errors.New(e.Error())
-		}
-		// 使用 \r\t 分割多行文本片段，并清理每一行的空白
-		oldLines := filterEmptyStrings(strings.Split(result, "\n"))
-		startLine, endLine, e := script.FindConsecutiveMultilineTextInFile(beanFilePath, oldLines)
-		if e != nil {
-			InternalError(c, e.Error())
-			return errors.New(e.Error())
-		}
-		lines, e := script.RemoveLines(beanFilePath, startLine, endLine)
-		if e != nil {
-			InternalError(c, e.Error())
-			return errors.New(e.Error())
+			if c != nil {
+				QueryError(c, e)
+			}
+			return e
 		}
-		newLines := filterEmptyStrings(strings.Split(line, "\n"))
-		newLines = append(newLines, "")
-		lines, e = script.InsertLines(lines, startLine, newLines)
-		if e != nil {
-			InternalError(c, e.Error())
-			return errors.New(e.Error())
+		oldFilePath, startLine := location.FilePath, location.StartLine
+		lines := location.RemoveEntry()
+		if oldFilePath == filepath.Clean(beanFilePath) {
+			newLines := filterEmptyStrings(strings.Split(line, "\n"))
+			newLines = append(newLines, "")
+			lines, e = script.InsertLines(lines, startLine, newLines)
+			if e == nil {
+				e = script.WriteToFile(beanFilePath, lines)
+			}
+		} else {
+			// 先写入新月份的文件，再从原文件中删除，并去掉删除后多余的空行
+			e = script.AppendFileInNewLine(beanFilePath, line)
+			if e == nil {
+				if startLine <= len(lines) && script.CleanString(lines[startLine-1]) == "" && (startLine == 1 || script.CleanString(lines[startLine-2]) == "") {
+					lines = append(lines[:startLine-1], lines[startLine:]...)
+				}
+				e = script.WriteToFile(oldFilePath, lines)
+			}
 		}
-		e = script.WriteToFile(beanFilePath, lines)
 		if e != nil {
-			InternalError(c, e.Error())
-			return errors.New(e.Error())
+			if c != nil {
+				InternalError(c, e.Error())
+			}
+			return e
 		}
 	} else { // 新增交易
 		err = script.AppendFileInNewLine(beanFilePath, line)
@@ -403,39 +756,26 @@ func UpdateTransactionRawTextById(c *gin.Context) {
 		return
 	}
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	// 从读取原文到写回期间不能有其他写入，否则会被覆盖
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
 
-	beanFilePath, err := getBeanFilePathByTransactionId(rawTextUpdateTransactionForm.ID, ledgerConfig)
-	if err != nil {
-		InternalError(c, err.Error())
-		return
-	}
-
-	result, e := script.BQLPrint(ledgerConfig, rawTextUpdateTransactionForm.ID)
-	if e != nil {
-		InternalError(c, e.Error())
-		return
-	}
-
-	oldLines := filterEmptyStrings(strings.Split(result, "\n"))
-	startLine, endLine, err := script.FindConsecutiveMultilineTextInFile(beanFilePath, oldLines)
+	location, err := locateTransactionWithChecksum(ledgerConfig, rawTextUpdateTransactionForm.ID, rawTextUpdateTransactionForm.Checksum)
 	if err != nil {
-		InternalError(c, err.Error())
-		return
-	}
-	lines, e := script.RemoveLines(beanFilePath, startLine, endLine)
-	if e != nil {
-		InternalError(c, e.Error())
+		QueryError(c, err)
 		return
 	}
+	lines := location.RemoveEntry()
 	newLines := filterEmptyStrings(strings.Split(rawTextUpdateTransactionForm.RawText, "\n"))
 	if len(newLines) > 0 {
-		lines, e = script.InsertLines(lines, startLine, newLines)
-		if e != nil {
-			InternalError(c, e.Error())
+		lines, err = script.InsertLines(lines, location.StartLine, newLines)
+		if err != nil {
+			InternalError(c, err.Error())
 			return
 		}
 	}
-	err = script.WriteToFile(beanFilePath, lines)
+	err = script.WriteToFile(location.FilePath, lines)
 	if err != nil {
 		InternalError(c, err.Error())
 		return
@@ -443,6 +783,7 @@ func UpdateTransactionRawTextById(c *gin.Context) {
 	OK(c, true)
 }
 
+// DeleteTransactionById 删除交易，可选参数 checksum 为查询原文时返回的校验值
 func DeleteTransactionById(c *gin.Context) {
 	queryParams := script.GetQueryParams(c)
 	if queryParams.ID == "" {
@@ -450,55 +791,134 @@ func DeleteTransactionById(c *gin.Context) {
 		return
 	}
 	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
 
-	result, e := script.BQLPrint(ledgerConfig, queryParams.ID)
-	if e != nil {
-		InternalError(c, e.Error())
+	location, err := locateTransactionWithChecksum(ledgerConfig, queryParams.ID, c.Query("checksum"))
+	if err != nil {
+		QueryError(c, err)
 		return
 	}
-
-	beanFilePath, err := getBeanFilePathByTransactionId(queryParams.ID, ledgerConfig)
+	err = script.WriteToFile(location.FilePath, location.RemoveEntry())
 	if err != nil {
 		InternalError(c, err.Error())
 		return
 	}
+	OK(c, true)
+}
 
-	oldLines := filterEmptyStrings(strings.Split(result, "\n"))
-	startLine, endLine, err := script.FindConsecutiveMultilineTextInFile(beanFilePath, oldLines)
-	if err != nil {
-		InternalError(c, err.Error())
+type ClearTransactionsForm struct {
+	IDs []string `form:"ids" binding:"required" json:"ids"`
+}
+
+// ClearTransactions 将待确认（!）的交易批量标记为已确认（*），只修改交易首行的标记
+func ClearTransactions(c *gin.Context) {
+	var clearForm ClearTransactionsForm
+	if err := c.ShouldBindJSON(&clearForm); err != nil {
+		BadRequest(c, err.Error())
 		return
 	}
-	lines, e := script.RemoveLines(beanFilePath, startLine, endLine)
-	if e != nil {
-		InternalError(c, e.Error())
-		return
+	ledgerConfig := script.GetLedgerConfigFromContext(c)
+	lock := script.LedgerWriteLock(ledgerConfig.DataPath)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range clearForm.IDs {
+		err := updateTransactionHeader(ledgerConfig, id, func(header string) string {
+			return script.SetHeaderFlag(header, script.FlagCleared)
+		})
+		if err != nil {
+			QueryError(c, err)
+			return
+		}
 	}
-	err = script.WriteToFile(beanFilePath, lines)
+	OK(c, clearForm.IDs)
+}
+
+type transactionSource struct {
+	Date     string `bql:"date"`
+	FileName string `bql:"filename"`
+	LineNo   string `bql:"lineno"`
+}
+
+// transactionLocation 交易在源文件中的位置，Lines 为读取时文件的全部内容，行号从 1 开始
+type transactionLocation struct {
+	FilePath  string
+	Lines     []string
+	StartLine int
+	EndLine   int
+}
+
+// EntryLines 交易的原文
+func (location *transactionLocation) EntryLines() []string {
+	return location.Lines[location.StartLine-1 : location.EndLine]
+}
+
+func (location *transactionLocation) Checksum() string {
+	return script.EntryChecksum(location.EntryLines())
+}
+
+// RemoveEntry 删除交易原文后的文件内容，不修改 Lines
+func (location *transactionLocation) RemoveEntry() []string {
+	lines := make([]string, 0, len(location.Lines))
+	lines = append(lines, location.Lines[:location.StartLine-1]...)
+	return append(lines, location.Lines[location.EndLine:]...)
+}
+
+// locateTransaction 按 beancount 记录的 filename 和 lineno 定位交易，交易可以在账本包含的任意文件中。
+// transactionId 为 uuid 时定位该 uuid 的交易；内容相同的交易 hash id 相同，按 hash id 定位时为其中第一笔
+// 文件在账本加载后被修改（首行不再是该交易）时返回 ErrEntryChanged
+func locateTransaction(ledgerConfig *script.Config, transactionId string) (*transactionLocation, error) {
+	queryParams := script.QueryParams{ID: transactionId, Where: true}
+	sources := make([]transactionSource, 0)
+	err := script.BQLQueryList(ledgerConfig, &queryParams, &sources)
 	if err != nil {
-		InternalError(c, err.Error())
-		return
+		return nil, err
 	}
-	OK(c, true)
+	if len(sources) == 0 {
+		return nil, errors.New("no transaction found")
+	}
+	lineNo, err := strconv.Atoi(sources[0].LineNo)
+	if err != nil {
+		return nil, err
+	}
+	location := &transactionLocation{FilePath: filepath.Clean(sources[0].FileName)}
+	location.Lines, err = script.ReadLines(location.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	location.StartLine, location.EndLine, err = script.FindEntryLineRange(location.Lines, lineNo)
+	if err != nil || !strings.HasPrefix(location.Lines[lineNo-1], sources[0].Date) {
+		return nil, fmt.Errorf("%w: %s:%d", script.ErrEntryChanged, location.FilePath, lineNo)
+	}
+	return location, nil
 }
 
-func getBeanFilePathByTransactionId(transactionId string, ledgerConfig *script.Config) (string, error) {
-	queryParams := script.QueryParams{ID: transactionId, Where: true}
-	transactions := make([]Transaction, 0)
-	err := script.BQLQueryList(ledgerConfig, &queryParams, &transactions)
+// locateTransactionWithChecksum checksum 不为空时，交易原文的校验值必须与 checksum 一致
+func locateTransactionWithChecksum(ledgerConfig *script.Config, transactionId string, checksum string) (*transactionLocation, error) {
+	location, err := locateTransaction(ledgerConfig, transactionId)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if len(transactions) == 0 {
-		return "", errors.New("no transaction found")
+	if checksum != "" && checksum != location.Checksum() {
+		return nil, fmt.Errorf("%w: %s:%d", script.ErrEntryChanged, location.FilePath, location.StartLine)
 	}
-	month, err := script.GetMonth(transactions[0].Date)
+	return location, nil
+}
+
+// updateTransactionHeader 修改交易首行并写回文件，调用方需持有账本的写锁 script.LedgerWriteLock
+func updateTransactionHeader(ledgerConfig *script.Config, transactionId string, update func(header string) string) error {
+	location, err := locateTransaction(ledgerConfig, transactionId)
 	if err != nil {
-		return "", err
+		return err
+	}
+	lines := location.Lines
+	header := update(lines[location.StartLine-1])
+	if header == lines[location.StartLine-1] {
+		return nil
 	}
-	// 交易记录所在文件位置
-	beanFilePath := script.GetLedgerMonthFilePath(ledgerConfig.DataPath, month)
-	return beanFilePath, nil
+	lines[location.StartLine-1] = header
+	return script.WriteToFile(location.FilePath, lines)
 }
 
 type transactionPayee struct {
@@ -511,7 +931,7 @@ func QueryTransactionPayees(c *gin.Context) {
 	queryParams := script.QueryParams{Where: false, OrderBy: "date desc", Limit: 100}
 	err := script.BQLQueryList(ledgerConfig, &queryParams, &payeeList)
 	if err != nil {
-		InternalError(c, err.Error())
+		QueryError(c, err)
 		return
 	}
 	result := make([]string, 0)
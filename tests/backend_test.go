@@ -0,0 +1,288 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"testing"
+	"testing/fstest"
+
+	"github.com/beancount-gs/script"
+	"github.com/beancount-gs/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type apiResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// newFixtureRouter 使用内存文件系统中的账本注册路由，不依赖 bean-query
+func newFixtureRouter(files fstest.MapFS) (*gin.Engine, *script.Config) {
+	script.RegisterQueryBackend("fixture", &script.MemoryBackend{Files: files})
+	ledgerConfig := &script.Config{Id: "fixture", Mail: "fixture", DataPath: "/data/fixture", OperatingCurrency: "CNY", QueryBackend: "fixture"}
+
+	r, authorized := newTestRouter(ledgerConfig)
+	{
+		authorized.GET("/transaction/search", service.SearchTransactions)
+		authorized.GET("/transaction", service.QueryTransactions)
+		authorized.GET("/transaction/raw", service.QueryTransactionRawTextById)
+		authorized.GET("/ledger/check", service.CheckLedger)
+		authorized.POST("/query", service.QueryBQL)
+	}
+	return r, ledgerConfig
+}
+
+// newTestRouter 创建使用 ledgerConfig 的路由，authorized 下的接口无需登录
+func newTestRouter(ledgerConfig *script.Config) (*gin.Engine, *gin.RouterGroup) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	authorized := r.Group("/api/auth/")
+	authorized.Use(func(c *gin.Context) {
+		c.Set("LedgerConfig", ledgerConfig)
+		c.Next()
+	})
+	return r, authorized
+}
+
+func fixtureFiles() fstest.MapFS {
+	return fstest.MapFS{
+		"index.bean":         {Data: []byte(testIndexBean)},
+		"month/2021-01.bean": {Data: []byte(testMonthBean)},
+	}
+}
+
+func doGet(t *testing.T, r *gin.Engine, url string) apiResponse {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp apiResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func doPost(t *testing.T, r *gin.Engine, url string, body interface{}) *httptest.ResponseRecorder {
+	return doPostWithHeader(t, r, url, body, nil)
+}
+
+func doPostWithHeader(t *testing.T, r *gin.Engine, url string, body interface{}, header map[string]string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return w
+}
+
+func doDelete(t *testing.T, r *gin.Engine, url string) apiResponse {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return decodeResponse(t, w)
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) apiResponse {
+	var resp apiResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestMemoryBackendTransactions(t *testing.T) {
+	r, _ := newFixtureRouter(fixtureFiles())
+
+	resp := doGet(t, r, "/api/auth/transaction?account=Expenses:Food")
+	assert.Equal(t, 200, resp.Code)
+	var transactions []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+	// 倒序
+	assert.Equal(t, "2021-02-01", transactions[0]["date"])
+	assert.Equal(t, "午饭", transactions[1]["desc"])
+
+	resp = doGet(t, r, "/api/auth/transaction/raw?id="+transactions[1]["id"].(string))
+	assert.Equal(t, 200, resp.Code)
+	var raw string
+	assert.NoError(t, json.Unmarshal(resp.Data, &raw))
+	assert.Equal(t, "2021-01-02 * \"超市\" \"午饭\" #food ^lunch\n  Expenses:Food  25.50 CNY\n  Assets:Bank:招商银行", raw)
+}
+
+func TestMemoryBackendSpecialCharacters(t *testing.T) {
+	files := fixtureFiles()
+	files["month/2021-01.bean"] = &fstest.MapFile{Data: []byte(`2021-01-03 * "A\\B, Inc." "line1
+line2, with \\ backslash"
+  Expenses:Food  10.00 CNY
+  Assets:Bank:招商银行
+`)}
+	r, _ := newFixtureRouter(files)
+
+	resp := doGet(t, r, "/api/auth/transaction?type=Expenses")
+	assert.Equal(t, 200, resp.Code)
+	var transactions []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 1, len(transactions))
+	assert.Equal(t, "A\\B, Inc.", transactions[0]["payee"])
+	assert.Equal(t, "line1\nline2, with \\ backslash", transactions[0]["desc"])
+}
+
+func TestMemoryBackendCheck(t *testing.T) {
+	files := fixtureFiles()
+	files["month/2021-01.bean"] = &fstest.MapFile{Data: []byte(testMonthBean + "\n2021-03-01 * \"未开户\"\n  Expenses:Unknown  1.00 CNY\n  Assets:Bank:招商银行\n")}
+	r, _ := newFixtureRouter(files)
+
+	resp := doGet(t, r, "/api/auth/ledger/check")
+	assert.Equal(t, 200, resp.Code)
+	var errors []string
+	assert.NoError(t, json.Unmarshal(resp.Data, &errors))
+	assert.Equal(t, 1, len(errors))
+	assert.Contains(t, errors[0], "Expenses:Unknown")
+}
+
+// recordingBackend 记录调用的回退后端，checkErr 为校验返回的错误
+type recordingBackend struct {
+	calls    []string
+	checkErr error
+}
+
+func (b *recordingBackend) List(ledgerConfig *script.Config, bql string) (string, error) {
+	b.calls = append(b.calls, "list")
+	return "id\n", nil
+}
+
+func (b *recordingBackend) Print(ledgerConfig *script.Config, transactionId string) (string, error) {
+	b.calls = append(b.calls, "print")
+	return "", nil
+}
+
+func (b *recordingBackend) Prices(ledgerConfig *script.Config) ([]script.CommodityPrice, error) {
+	return nil, nil
+}
+
+func (b *recordingBackend) Check(ledgerConfig *script.Config) ([]string, error) {
+	b.calls = append(b.calls, "check")
+	return []string{"fallback"}, b.checkErr
+}
+
+func TestMemoryBackendFallback(t *testing.T) {
+	ledgerConfig := &script.Config{Id: "fallback", Mail: "fallback", DataPath: "/data/fallback"}
+	fallback := &recordingBackend{}
+	backend := &script.MemoryBackend{Files: fixtureFiles(), Fallback: fallback}
+
+	// 账本可以在内存中加载时，涉及 id 的查询不回退，避免混用两个后端的 id
+	_, err := backend.List(ledgerConfig, "SELECT account FROM OPEN ON 2021-01-01")
+	assert.NoError(t, err)
+	_, err = backend.List(ledgerConfig, "SELECT id FROM OPEN ON 2021-01-01")
+	assert.ErrorIs(t, err, script.ErrUnsupportedSyntax)
+	_, err = backend.Print(ledgerConfig, "0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list"}, fallback.calls)
+
+	// 账本包含不支持的语法时所有查询都回退
+	files := fixtureFiles()
+	files["index.bean"] = &fstest.MapFile{Data: []byte("plugin \"beancount.plugins.auto\"\n" + testIndexBean)}
+	backend.Files = files
+	_, err = backend.List(ledgerConfig, "SELECT id, date")
+	assert.NoError(t, err)
+	_, err = backend.Print(ledgerConfig, "0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list", "list", "print"}, fallback.calls)
+}
+
+func TestTransactionFilters(t *testing.T) {
+	r, _ := newFixtureRouter(fixtureFiles())
+	count := func(query string) int {
+		resp := doGet(t, r, "/api/auth/transaction?"+query)
+		assert.Equal(t, 200, resp.Code, query)
+		var transactions []map[string]interface{}
+		assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+		return len(transactions)
+	}
+
+	assert.Equal(t, 1, count("account=Expenses:Food&from=2021-01-01&to=2021-01-31"))
+	assert.Equal(t, 1, count("account=Expenses:Food&minAmount=0"))
+	assert.Equal(t, 1, count("type=Expenses&maxAmount=-10.5"))
+	assert.Equal(t, 4, count("account=Expenses:Food&account=Assets:Stock"))
+	assert.Equal(t, 2, count("narration=午"))
+	assert.Equal(t, 5, count("payee=券商"))
+	assert.Equal(t, 2, count("currency=AAPL"))
+	// 特殊字符按字面量匹配
+	assert.Equal(t, 0, count("payee="+url.QueryEscape("超市' OR payee ~ '")))
+
+	resp := doGet(t, r, "/api/auth/transaction?from=2021-13-01")
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestTransactionPagination(t *testing.T) {
+	r, _ := newFixtureRouter(fixtureFiles())
+
+	resp := doGet(t, r, "/api/auth/transaction")
+	var all []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp.Data, &all))
+	assert.Equal(t, 7, len(all))
+
+	type page struct {
+		Items      []map[string]interface{} `json:"items"`
+		Total      int                      `json:"total"`
+		HasMore    bool                     `json:"hasMore"`
+		NextCursor string                   `json:"nextCursor"`
+	}
+	// 每页 2 条，同一交易的过账跨页时不丢失、不重复
+	walked := make([]map[string]interface{}, 0)
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		resp = doGet(t, r, "/api/auth/transaction?limit=2&cursor="+cursor)
+		assert.Equal(t, 200, resp.Code)
+		var p page
+		assert.NoError(t, json.Unmarshal(resp.Data, &p))
+		assert.Equal(t, 7, p.Total)
+		walked = append(walked, p.Items...)
+		if !p.HasMore {
+			break
+		}
+		cursor = p.NextCursor
+	}
+	assert.Equal(t, all, walked)
+
+	resp = doGet(t, r, "/api/auth/transaction?cursor=bad")
+	assert.Equal(t, 400, resp.Code)
+	resp = doGet(t, r, "/api/auth/transaction?limit=0")
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestMemoryBackendFallbackCheck(t *testing.T) {
+	ledgerConfig := &script.Config{Id: "fallback-check", Mail: "fallback-check", DataPath: "/data/fallback-check"}
+	fallback := &recordingBackend{}
+	files := fixtureFiles()
+	files["month/2021-01.bean"] = &fstest.MapFile{Data: []byte(testMonthBean + "\n2021-03-01 * \"未开户\"\n  Expenses:Unknown  1.00 CNY\n  Assets:Bank:招商银行\n")}
+
+	// 只有配置 FallbackCheck 时才使用回退后端校验
+	result, err := (&script.MemoryBackend{Files: files, Fallback: fallback}).Check(ledgerConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(result))
+	assert.Empty(t, fallback.calls)
+
+	backend := &script.MemoryBackend{Files: files, Fallback: fallback, FallbackCheck: true}
+	result, err = backend.Check(ledgerConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fallback"}, result)
+
+	// bean-check 不可用时使用原生校验
+	fallback.checkErr = exec.ErrNotFound
+	result, err = backend.Check(ledgerConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(result))
+	assert.Contains(t, result[0], "Expenses:Unknown")
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBQLQueryBuild(t *testing.T) {
+	queryParams := script.QueryParams{Year: 2021, Tag: "food", AccountLike: "Expenses:Food", OrderBy: "date desc", Limit: 10}
+	bql, err := script.NewBQLQuery().
+		Select("date").
+		SelectAs("total", "sum(convert(value(position), ?))", "CNY").
+		WithParams(&queryParams).
+		Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT date AS date, sum(convert(value(position), 'CNY')) AS total WHERE year = 2021 AND 'food' IN tags AND account ~ '^Expenses:Food' ORDER BY date desc LIMIT 10`, bql)
+}
+
+func TestBQLQueryQuoting(t *testing.T) {
+	// 包含单引号的值使用双引号，无法改写查询
+	bql, err := script.NewBQLQuery().Select("id").Where(script.Eq("account", "Assets:X' OR account ~ '")).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT id AS id WHERE account = "Assets:X' OR account ~ '"`, bql)
+
+	_, err = script.NewBQLQuery().Select("id").Where(script.Eq("payee", `a'b"c`)).Build()
+	assert.True(t, errors.Is(err, script.ErrInvalidBQLValue))
+
+	_, err = script.NewBQLQuery().Select("id").Where(script.Eq("account = '' OR id", "x")).Build()
+	assert.True(t, errors.Is(err, script.ErrInvalidBQLValue))
+
+	// 元数据 key 同样转义
+	bql, err = script.NewBQLQuery().Select("id").Where(script.EntryMetaEq("uu'id", "x")).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT id AS id WHERE entry_meta("uu'id") = 'x'`, bql)
+
+	_, err = script.NewBQLQuery().Select("id").OrderBy("date; DROP").Build()
+	assert.True(t, errors.Is(err, script.ErrInvalidBQLValue))
+
+	_, err = script.NewBQLQuery().SelectAs("a, id", "id").Build()
+	assert.True(t, errors.Is(err, script.ErrInvalidBQLValue))
+
+	// 正则元字符按字面量匹配
+	bql, err = script.NewBQLQuery().Select("id").Where(script.HasPrefix("account", "Assets:(A)")).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT id AS id WHERE account ~ '^Assets:\(A\)'`, bql)
+}
+
+func TestBQLQueryGrouping(t *testing.T) {
+	bql, err := script.NewBQLQuery().Distinct().Select("payee").Where(
+		script.Eq("year", 2021),
+		script.Or(script.Eq("account", "A"), script.Not(script.Contains("tags", "t"))),
+		script.In("id", []string{"a1", "b2"}),
+	).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT DISTINCT payee AS payee WHERE year = 2021 AND (account = 'A' OR NOT 't' IN tags) AND id ~ '^(a1|b2)$'`, bql)
+
+	bql, err = script.NewBQLQuery().Select("id").Where(script.In("id", []string{})).Build()
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT id AS id WHERE FALSE`, bql)
+}
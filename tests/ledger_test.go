@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIndexBean = `option "operating_currency" "CNY"
+include "month/*.bean"
+
+2021-01-01 open Assets:Bank:招商银行 CNY
+2021-01-01 open Assets:Stock
+2021-01-01 open Expenses:Food
+2021-01-01 open Equity:OpeningBalances
+`
+
+const testMonthBean = `2021-01-02 * "超市" "午饭" #food ^lunch
+  Expenses:Food  25.50 CNY
+  Assets:Bank:招商银行
+
+2021-01-05 * "券商" "买入"
+  Assets:Stock  10 AAPL {100.00 CNY}
+  Assets:Bank:招商银行  -1000.00 CNY
+
+2021-01-10 price AAPL 120.00 CNY
+
+2021-02-01 * "券商" "卖出"
+  Assets:Stock  -4 AAPL {} @ 120.00 CNY
+  Assets:Bank:招商银行  480.00 CNY
+  Expenses:Food
+`
+
+// writePaddingMonthBean 在测试账本中添加 pad 指令，pad 生成标记为 P 的交易
+func writePaddingMonthBean(t *testing.T, ledgerConfig *script.Config) {
+	padBean := "\n2021-01-03 pad Assets:Bank:招商银行 Equity:OpeningBalances\n\n2021-01-04 balance Assets:Bank:招商银行 100.00 CNY\n"
+	monthFile := filepath.Join(ledgerConfig.DataPath, "month", "2021-01.bean")
+	assert.NoError(t, ioutil.WriteFile(monthFile, []byte(testMonthBean+padBean), 0644))
+}
+
+func writeTestLedger(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "beancount-gs")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "month"), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.bean"), []byte(testIndexBean), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "month", "2021-01.bean"), []byte(testMonthBean), 0644))
+	return dir
+}
+
+func TestParseBeanContent(t *testing.T) {
+	entries, _, err := script.ParseBeanContent("test.bean", testMonthBean)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "超市", entries[0].Payee)
+	assert.Equal(t, []string{"food"}, entries[0].Tags)
+	assert.Equal(t, []string{"lunch"}, entries[0].Links)
+	assert.Equal(t, 1, entries[0].StartLineNo)
+
+	_, _, err = script.ParseBeanContent("test.bean", "plugin \"beancount.plugins.auto\"\n")
+	assert.True(t, errors.Is(err, script.ErrUnsupportedSyntax))
+}
+
+func TestLedgerQuery(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+
+	ledger, err := script.LoadLedger(filepath.Join(dir, "index.bean"))
+	assert.NoError(t, err)
+	assert.Empty(t, ledger.Errors)
+
+	output, err := ledger.QueryText("SELECT account, sum(position) AS total WHERE account ~ '招商' GROUP BY account")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "Assets:Bank:招商银行  -545.50 CNY", lines[2])
+
+	// 卖出按 FIFO 匹配成本，剩余 6 股
+	output, err = ledger.QueryText("SELECT sum(units(position)) WHERE account = 'Assets:Stock'")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "6 AAPL")
+
+	output, err = ledger.QueryText("SELECT '\\', narration, '\\' WHERE 'food' IN tags ORDER BY date DESC LIMIT 1")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "\\  午饭  \\")
+
+	output, err = ledger.QueryText("SELECT value(position) WHERE account = 'Assets:Stock' AND month = 1")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "1200.00 CNY")
+
+	_, err = ledger.QueryText("SELECT account FROM OPEN ON 2021-01-01")
+	assert.True(t, errors.Is(err, script.ErrUnsupportedSyntax))
+}
@@ -0,0 +1,29 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunBeanCommandTimeout(t *testing.T) {
+	ledgerConfig := &script.Config{Id: "timeout", QueryTimeout: 1}
+	start := time.Now()
+	_, err := script.RunBeanCommand(ledgerConfig, nil, "sleep", "5")
+	assert.True(t, errors.Is(err, script.ErrQueryTimeout))
+	assert.True(t, time.Since(start) < 3*time.Second)
+
+	// 请求取消后子进程被终止
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = script.RunBeanCommand(ledgerConfig.WithContext(ctx), nil, "sleep", "5")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	output, err := script.RunBeanCommand(ledgerConfig, nil, "echo", "ok")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok\n", string(output))
+}
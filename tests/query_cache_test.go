@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheTestRow struct {
+	Narration string `bql:"narration" json:"narration"`
+}
+
+func TestQueryCacheInvalidation(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+	ledgerConfig := &script.Config{Id: "cache", DataPath: dir, QueryBackend: script.QueryBackendMemory}
+	queryParams := script.QueryParams{AccountLike: "Expenses"}
+
+	query := func() []cacheTestRow {
+		rows := make([]cacheTestRow, 0)
+		assert.NoError(t, script.BQLQueryList(ledgerConfig, &queryParams, &rows))
+		return rows
+	}
+
+	assert.Equal(t, 2, len(query()))
+	assert.Equal(t, 2, len(query()))
+	stats := script.GetQueryCacheStats(ledgerConfig)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	// 通过 script 写入文件后缓存失效
+	monthFile := filepath.Join(dir, "month", "2021-01.bean")
+	assert.NoError(t, script.AppendFileInNewLine(monthFile, "2021-01-20 * \"超市\" \"晚饭\"\n  Expenses:Food  30.00 CNY\n  Assets:Bank:招商银行\n"))
+	assert.Equal(t, 3, len(query()))
+
+	// 外部修改文件后缓存失效
+	content, err := ioutil.ReadFile(monthFile)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(monthFile, append(content, []byte("\n2021-01-21 * \"超市\" \"夜宵\"\n  Expenses:Food  5.00 CNY\n  Assets:Bank:招商银行\n")...), 0644))
+	assert.Equal(t, 4, len(query()))
+
+	stats = script.GetQueryCacheStats(ledgerConfig)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(3), stats.Misses)
+}
+
+func TestCachedLedger(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+	ledgerConfig := &script.Config{Id: "cached-ledger", DataPath: dir}
+
+	ledger, err := script.LoadCachedLedger(ledgerConfig)
+	assert.NoError(t, err)
+	cached, err := script.LoadCachedLedger(ledgerConfig)
+	assert.NoError(t, err)
+	assert.Same(t, ledger, cached)
+
+	// 写入后重新解析
+	monthFile := filepath.Join(dir, "month", "2021-01.bean")
+	assert.NoError(t, script.AppendFileInNewLine(monthFile, "2021-01-20 * \"超市\" \"晚饭\"\n  Expenses:Food  30.00 CNY\n  Assets:Bank:招商银行\n"))
+	cached, err = script.LoadCachedLedger(ledgerConfig)
+	assert.NoError(t, err)
+	assert.NotSame(t, ledger, cached)
+	assert.Equal(t, len(ledger.Entries)+1, len(cached.Entries))
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/beancount-gs/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckReadOnlyBQL(t *testing.T) {
+	assert.NoError(t, script.CheckReadOnlyBQL("select date, account where payee = 'a;b';"))
+	assert.NoError(t, script.CheckReadOnlyBQL("BALANCES WHERE year = 2021"))
+	assert.NoError(t, script.CheckReadOnlyBQL("journal 'Assets'"))
+	assert.True(t, errors.Is(script.CheckReadOnlyBQL("PRINT"), script.ErrReadOnlyBQL))
+	assert.True(t, errors.Is(script.CheckReadOnlyBQL(".run query"), script.ErrReadOnlyBQL))
+	assert.True(t, errors.Is(script.CheckReadOnlyBQL("SELECT date; PRINT"), script.ErrReadOnlyBQL))
+}
+
+func TestQueryConsole(t *testing.T) {
+	r, _ := newFixtureRouter(fixtureFiles())
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/query", map[string]interface{}{
+		"bql": "SELECT date, year, number, payee WHERE account = 'Expenses:Food' ORDER BY date",
+	}))
+	assert.Equal(t, 200, resp.Code)
+	var table script.QueryTable
+	assert.NoError(t, json.Unmarshal(resp.Data, &table))
+	assert.Equal(t, []script.QueryColumn{{Name: "date", Type: "date"}, {Name: "year", Type: "integer"}, {Name: "number", Type: "number"}, {Name: "payee", Type: "string"}}, table.Columns)
+	assert.Equal(t, 2, len(table.Rows))
+	assert.Equal(t, []interface{}{"2021-01-02", float64(2021), 25.5, "超市"}, table.Rows[0])
+	assert.False(t, table.Truncated)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/query", map[string]interface{}{"bql": "BALANCES", "limit": 1}))
+	assert.NoError(t, json.Unmarshal(resp.Data, &table))
+	assert.Equal(t, "account", table.Columns[0].Name)
+	assert.Equal(t, 1, len(table.Rows))
+	assert.True(t, table.Truncated)
+
+	w := doPost(t, r, "/api/auth/query", map[string]interface{}{"bql": "JOURNAL 'Expenses:Food'", "format": "csv"})
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "date,flag,description,position,balance\n2021-01-02,*,超市 | 午饭,25.50 CNY,25.50 CNY\n"))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/query", map[string]interface{}{"bql": "PRINT"}))
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestBindBQLParams(t *testing.T) {
+	bql := "SELECT payee WHERE year = :year AND account ~ 'Expenses:Food' AND payee = :payee AND number > :min"
+	assert.Equal(t, []string{"year", "payee", "min"}, script.BQLParams(bql))
+	bound, err := script.BindBQLParams(bql, map[string]interface{}{"year": float64(2021), "payee": "O'Neil", "min": 1.5})
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT payee WHERE year = 2021 AND account ~ 'Expenses:Food' AND payee = "O'Neil" AND number > 1.5`, bound)
+
+	_, err = script.BindBQLParams(bql, map[string]interface{}{"year": 2021})
+	assert.True(t, errors.Is(err, script.ErrInvalidBQLValue))
+}
+
+func TestSavedQueries(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+	queryBean := "2021-01-01 query \"food\" \"SELECT payee, number WHERE account = 'Expenses:Food' AND year = :year\"\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.bean"), []byte(testIndexBean+queryBean), 0644))
+	ledgerConfig := &script.Config{Id: "saved", DataPath: dir, QueryBackend: script.QueryBackendMemory}
+
+	r, authorized := newTestRouter(ledgerConfig)
+	{
+		authorized.GET("/query/saved", service.QuerySavedQueries)
+		authorized.POST("/query/saved", service.SaveQuery)
+		authorized.DELETE("/query/saved", service.DeleteSavedQuery)
+		authorized.POST("/query/saved/run", service.RunSavedQuery)
+	}
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/query/saved", map[string]interface{}{
+		"name": "monthly", "bql": "SELECT month, sum(number) AS total WHERE year = :year GROUP BY month ORDER BY month",
+	}))
+	assert.Equal(t, 200, resp.Code)
+	var saved service.SavedQuery
+	assert.NoError(t, json.Unmarshal(resp.Data, &saved))
+	assert.Equal(t, []string{"year"}, saved.Params)
+	assert.FileExists(t, filepath.Join(dir, ".beancount-gs", "saved_queries.json"))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/query/saved", map[string]interface{}{"name": "monthly", "bql": "SELECT date"}))
+	assert.Equal(t, 400, resp.Code)
+
+	resp = doGet(t, r, "/api/auth/query/saved")
+	var queries []service.SavedQuery
+	assert.NoError(t, json.Unmarshal(resp.Data, &queries))
+	assert.Equal(t, 2, len(queries))
+	assert.Equal(t, service.SavedQuerySourceLedger, queries[1].Source)
+	assert.Equal(t, "food", queries[1].Name)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/query/saved/run", map[string]interface{}{"name": "food", "params": map[string]interface{}{"year": 2021}}))
+	assert.Equal(t, 200, resp.Code)
+	var table script.QueryTable
+	assert.NoError(t, json.Unmarshal(resp.Data, &table))
+	assert.Equal(t, 2, len(table.Rows))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/query/saved/run", map[string]interface{}{"id": saved.Id}))
+	assert.Equal(t, 400, resp.Code)
+
+	assert.Equal(t, 200, doDelete(t, r, "/api/auth/query/saved?id="+saved.Id).Code)
+	resp = doGet(t, r, "/api/auth/query/saved")
+	assert.NoError(t, json.Unmarshal(resp.Data, &queries))
+	assert.Equal(t, 1, len(queries))
+}
+
+func TestLedgerQueryDirectives(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+	// plugin 指令无法解析时，其他 query 指令仍然返回，无法解析的 query 指令返回错误
+	queryBean := "plugin \"beancount.plugins.auto\"\n" +
+		"2021-01-01 query \"food\" \"SELECT payee WHERE account = 'Expenses:Food'\"\n" +
+		"2021-01-02 query \"broken\"\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.bean"), []byte(testIndexBean+queryBean), 0644))
+	ledgerConfig := &script.Config{Id: "directives", DataPath: dir}
+
+	entries, errs := script.LedgerQueryDirectives(ledgerConfig)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "food", entries[0].Name)
+	assert.Equal(t, strings.Count(testIndexBean, "\n")+2, entries[0].StartLineNo)
+	assert.Equal(t, 1, len(errs))
+	var parseErr *script.ParseError
+	assert.True(t, errors.As(errs[0], &parseErr))
+	assert.Equal(t, strings.Count(testIndexBean, "\n")+3, parseErr.LineNo)
+}
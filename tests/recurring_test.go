@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/beancount-gs/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleOccurrences(t *testing.T) {
+	// 每月 31 日，小月为月末
+	monthly := script.Schedule{DayOfMonth: 31, StartDate: "2021-01-15", EndDate: "2021-04-30"}
+	dates, err := monthly.Occurrences("", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2021-01-31", "2021-02-28", "2021-03-31", "2021-04-30"}, dates)
+
+	quarterly := script.Schedule{DayOfMonth: 10, Interval: 3, StartDate: "2021-01-15"}
+	dates, err = quarterly.Occurrences("2021-04-10", "", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2021-07-10", "2021-10-10", "2022-01-10"}, dates)
+
+	// 每周一和每月 1 日（日和周都指定时满足其一）
+	cron := script.Schedule{Cron: "0 9 1 * 1", StartDate: "2021-02-01"}
+	dates, err = cron.Occurrences("", "2021-02-15", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2021-02-01", "2021-02-08", "2021-02-15"}, dates)
+
+	// 每月 1 日起每 7 天
+	dates, err = script.Schedule{Cron: "0 0 1/7 * *", StartDate: "2021-02-01"}.Occurrences("", "2021-03-08", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2021-02-01", "2021-02-08", "2021-02-15", "2021-02-22", "2021-03-01", "2021-03-08"}, dates)
+
+	_, err = script.Schedule{Cron: "0 9 1 13 *", StartDate: "2021-02-01"}.Occurrences("", "2021-03-01", 0)
+	assert.ErrorIs(t, err, script.ErrInvalidSchedule)
+	_, err = script.Schedule{DayOfMonth: 1, StartDate: "2021-02-01"}.Occurrences("", "", 0)
+	assert.ErrorIs(t, err, script.ErrInvalidSchedule)
+}
+
+func TestRecurringRules(t *testing.T) {
+	dir := writeTestLedger(t)
+	defer os.RemoveAll(dir)
+	ledgerConfig := &script.Config{Id: "recurring", Mail: "recurring", DataPath: dir, OperatingCurrency: "CNY", QueryBackend: script.QueryBackendMemory}
+	r, authorized := newTestRouter(ledgerConfig)
+	authorized.GET("/transaction/recurring", service.QueryRecurringRules)
+	authorized.POST("/transaction/recurring", service.SaveRecurringRule)
+	authorized.DELETE("/transaction/recurring", service.DeleteRecurringRule)
+	authorized.POST("/transaction/recurring/pause", service.PauseRecurringRule)
+	authorized.POST("/transaction/recurring/skip", service.SkipRecurringRule)
+	authorized.GET("/transaction/recurring/preview", service.PreviewRecurringRule)
+	authorized.POST("/transaction/recurring/run", service.RunRecurringRules)
+
+	rule := map[string]interface{}{
+		"name":     "房租",
+		"schedule": map[string]interface{}{"dayOfMonth": 5, "startDate": "2021-01-01", "endDate": "2021-04-30"},
+		"transaction": map[string]interface{}{
+			"payee": "房东", "desc": "房租",
+			"entries": []map[string]interface{}{
+				{"account": "Expenses:Food", "number": "3000", "currency": "CNY"},
+				{"account": "Assets:Bank:招商银行", "number": "-2000", "currency": "CNY"},
+			},
+		},
+	}
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring", rule))
+	assert.Equal(t, 1001, resp.Code)
+
+	rule["transaction"].(map[string]interface{})["entries"].([]map[string]interface{})[1]["number"] = "-3000"
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring", rule))
+	assert.Equal(t, 200, resp.Code)
+	var saved service.RecurringRule
+	assert.NoError(t, json.Unmarshal(resp.Data, &saved))
+	assert.NotEmpty(t, saved.Id)
+
+	resp = doGet(t, r, "/api/auth/transaction/recurring/preview?id="+saved.Id+"&count=3")
+	var occurrences []service.RecurringOccurrence
+	assert.NoError(t, json.Unmarshal(resp.Data, &occurrences))
+	assert.Equal(t, []service.RecurringOccurrence{{Date: "2021-01-05"}, {Date: "2021-02-05"}, {Date: "2021-03-05"}}, occurrences)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/skip", map[string]interface{}{"id": saved.Id, "date": "2021-02-06"}))
+	assert.Equal(t, 400, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/skip", map[string]interface{}{"id": saved.Id, "date": "2021-02-05"}))
+	assert.Equal(t, 200, resp.Code)
+
+	// 结束日期已过，生成除跳过日期外的所有交易
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/run", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "3", string(resp.Data))
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-05 * \"房东\" \"房租\"\r\n  recurring: \""+saved.Id+"\"")
+	assert.FileExists(t, dir+"/month/2021-03.bean")
+	assert.FileExists(t, dir+"/month/2021-04.bean")
+	_, err := os.Stat(dir + "/month/2021-02.bean")
+	assert.True(t, err != nil || !strings.Contains(readMonthFile(t, ledgerConfig, "2021-02"), "房租"))
+
+	// 再次执行不会重复生成
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/run", nil))
+	assert.Equal(t, "0", string(resp.Data))
+	resp = doGet(t, r, "/api/auth/transaction/recurring")
+	var rules []service.RecurringRule
+	assert.NoError(t, json.Unmarshal(resp.Data, &rules))
+	assert.Equal(t, "2021-04-05", rules[0].LastDate)
+	assert.Empty(t, rules[0].Skipped)
+
+	// 修改规则保留已处理到的日期，暂停后不生成
+	rule["id"] = saved.Id
+	rule["schedule"] = map[string]interface{}{"dayOfMonth": 5, "startDate": "2021-01-01", "endDate": "2021-06-30"}
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring", rule))
+	assert.Equal(t, 200, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/pause", map[string]interface{}{"id": saved.Id, "paused": true}))
+	assert.Equal(t, 200, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/run", nil))
+	assert.Equal(t, "0", string(resp.Data))
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/pause", map[string]interface{}{"id": saved.Id, "paused": false}))
+	assert.Equal(t, 200, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/recurring/run", nil))
+	assert.Equal(t, "0", string(resp.Data))
+
+	resp = doDelete(t, r, "/api/auth/transaction/recurring?id="+saved.Id)
+	assert.Equal(t, 200, resp.Code)
+	resp = doGet(t, r, "/api/auth/transaction/recurring")
+	assert.Equal(t, "[]", string(resp.Data))
+}
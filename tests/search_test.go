@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/beancount-gs/script"
+	"github.com/beancount-gs/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	build := func(q string) string {
+		cond, err := script.ParseSearchQuery(q)
+		assert.NoError(t, err)
+		bql, err := script.NewBQLQuery().Select("id").Where(cond).Build()
+		assert.NoError(t, err)
+		return bql
+	}
+	assert.Equal(t, `SELECT id AS id WHERE payee ~ '星巴克' AND 'trip' IN tags AND abs(number) > 30 AND date >= 2024-05-01 AND date < 2024-06-01`,
+		build("payee:星巴克 tag:trip amount>30 2024-05"))
+	assert.Equal(t, `SELECT id AS id WHERE account ~ '^Expenses:.*:Food$' AND NOT '^x' IN links AND (payee ~ 'a b' OR narration ~ 'a b')`,
+		build(`account:Expenses:*:Food -link:^^x "a b"`))
+	assert.Equal(t, `SELECT id AS id WHERE date >= 2024-03-15 AND date < 2024-04-15`, build("2024-03-15..2024-04-14"))
+	assert.Equal(t, `SELECT id AS id WHERE date < 2025-01-01`, build("date<=2024"))
+	assert.Equal(t, `SELECT id AS id`, build("  "))
+
+	for q, pos := range map[string]int{
+		"tag:trip foo:bar":    9,
+		"amount>abc":          7,
+		`payee:"unterminated`: 6,
+		"date:2024-13":        5,
+		"payee>3":             0,
+	} {
+		_, err := script.ParseSearchQuery(q)
+		var syntaxErr *script.SearchSyntaxError
+		assert.True(t, errors.As(err, &syntaxErr), q)
+		assert.True(t, errors.Is(err, script.ErrSearchSyntax), q)
+		assert.Equal(t, pos, syntaxErr.Pos, q)
+	}
+}
+
+func TestSearchTransactions(t *testing.T) {
+	r, _ := newFixtureRouter(fixtureFiles())
+
+	resp := doGet(t, r, "/api/auth/transaction/search?q="+url.QueryEscape("券商 amount>100 2021-01"))
+	assert.Equal(t, 200, resp.Code)
+	var result service.TransactionGroupResult
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 1, result.Total)
+	assert.Equal(t, "买入", result.Items[0].Desc)
+	// 返回交易的所有过账
+	assert.Equal(t, 2, len(result.Items[0].Entries))
+
+	resp = doGet(t, r, "/api/auth/transaction/search?limit=1&q="+url.QueryEscape("account:Expenses:Food"))
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 2, result.Total)
+	assert.True(t, result.HasMore)
+	assert.Equal(t, "2021-02-01", result.Items[0].Date)
+	assert.Equal(t, 3, len(result.Items[0].Entries))
+
+	resp = doGet(t, r, "/api/auth/transaction/search?q="+url.QueryEscape("星巴克 amount>>3"))
+	assert.Equal(t, 1010, resp.Code)
+	var data map[string]int
+	assert.NoError(t, json.Unmarshal(resp.Data, &data))
+	assert.Equal(t, 11, data["position"])
+}
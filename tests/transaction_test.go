@@ -0,0 +1,973 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beancount-gs/script"
+	"github.com/beancount-gs/service"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTransactionRouter 使用临时目录中的账本注册交易相关的路由
+func newTransactionRouter(t *testing.T) (*gin.Engine, *script.Config) {
+	dir := writeTestLedger(t)
+	ledgerConfig := &script.Config{Id: "transaction", Mail: "transaction", DataPath: dir, OperatingCurrency: "CNY", QueryBackend: script.QueryBackendMemory}
+	r, authorized := newTestRouter(ledgerConfig)
+	{
+		authorized.GET("/transaction", service.QueryTransactions)
+		authorized.POST("/transaction", service.IdempotencyHandler(), service.AddTransactions)
+		authorized.GET("/transaction/detail", service.QueryTransactionDetailById)
+		authorized.GET("/transaction/raw", service.QueryTransactionRawTextById)
+		authorized.POST("/transaction/raw", service.UpdateTransactionRawTextById)
+		authorized.GET("/transaction/link", service.QueryTransactionsByLink)
+		authorized.POST("/transaction/link", service.AddTransactionLink)
+		authorized.DELETE("/transaction/link", service.DeleteTransactionLink)
+		authorized.POST("/transaction/batch", service.IdempotencyHandler(), service.AddBatchTransactions)
+		authorized.POST("/transaction/bulk", service.BulkEditTransactions)
+		authorized.POST("/transaction/clear", service.ClearTransactions)
+		authorized.GET("/transaction/duplicate", service.QueryDuplicateTransactions)
+		authorized.POST("/transaction/duplicate", service.ResolveDuplicateTransactions)
+		authorized.GET("/transaction/duplicate/ignore", service.QueryDuplicateIgnores)
+		authorized.DELETE("/transaction/duplicate/ignore", service.DeleteDuplicateIgnore)
+		authorized.POST("/transaction/uuid", service.BackfillTransactionUUIDs)
+		authorized.DELETE("/transaction", service.DeleteTransactionById)
+		authorized.GET("/transaction/installment", service.QueryInstallment)
+		authorized.DELETE("/transaction/installment", service.CancelInstallment)
+		authorized.GET("/commodity/precision", service.QueryCommodityPrecisions)
+		authorized.POST("/commodity/precision", service.UpdateCommodityPrecision)
+	}
+	return r, ledgerConfig
+}
+
+func TestTransactionMeta(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-20", "payee": "超市", "desc": "晚饭",
+		"meta": map[string]interface{}{"receipt": `C:\receipts\"1".jpg`, "paid": true, "count": 2, "due": "2021-02-01"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "30", "currency": "CNY", "meta": map[string]interface{}{"location": "上海"}},
+			{"account": "Assets:Bank:招商银行", "number": "-30", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "\n  count: 2\r\n  due: 2021-02-01\r\n  paid: TRUE\r\n  receipt: \"C:\\\\receipts\\\\\\\"1\\\".jpg\"\r\n  uuid: \"")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "\"\r\n Expenses:Food 30.00 CNY\r\n    location: \"上海\"\r\n Assets:Bank")
+
+	resp = doGet(t, r, "/api/auth/transaction?payee=超市&meta=receipt,location")
+	var transactions []service.Transaction
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 4, len(transactions))
+	assert.Equal(t, map[string]string{"receipt": `C:\receipts\"1".jpg`, "location": "上海"}, transactions[0].Meta)
+	assert.Equal(t, map[string]string{"receipt": `C:\receipts\"1".jpg`}, transactions[1].Meta)
+
+	resp = doGet(t, r, "/api/auth/transaction/detail?id="+transactions[0].Id)
+	var form service.TransactionForm
+	assert.NoError(t, json.Unmarshal(resp.Data, &form))
+	assert.True(t, script.IsUUID(form.Meta["uuid"].(string)))
+	delete(form.Meta, "uuid")
+	assert.Equal(t, map[string]interface{}{"receipt": `C:\receipts\"1".jpg`, "paid": true, "count": float64(2), "due": "2021-02-01"}, form.Meta)
+	assert.Equal(t, map[string]interface{}{"location": "上海"}, form.Entries[0].Meta)
+	assert.Nil(t, form.Entries[1].Meta)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-21", "desc": "x", "meta": map[string]interface{}{"Bad Key": "x"},
+		"entries": []map[string]interface{}{{"account": "Expenses:Food", "number": "1", "currency": "CNY"}, {"account": "Assets:Bank:招商银行", "number": "-1", "currency": "CNY"}},
+	}))
+	assert.Equal(t, 400, resp.Code)
+	assert.False(t, strings.Contains(readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-21"))
+}
+
+func readMonthFile(t *testing.T, ledgerConfig *script.Config, month string) string {
+	content, err := ioutil.ReadFile(filepath.Join(ledgerConfig.DataPath, "month", month+".bean"))
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestTransactionLinks(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-25", "payee": "超市", "desc": "退款", "tags": []string{"food"}, "links": []string{"refund-1"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "-25.5", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "25.5", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), `2021-01-25 * "超市" "退款"#food  ^refund-1`)
+
+	// 为原交易添加相同的 link
+	var groups []service.TransactionGroup
+	resp = doGet(t, r, "/api/auth/transaction/link?link=lunch")
+	assert.NoError(t, json.Unmarshal(resp.Data, &groups))
+	assert.Equal(t, 1, len(groups))
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/link", map[string]interface{}{"ids": []string{groups[0].Id}, "link": "refund-1"}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), `2021-01-02 * "超市" "午饭" #food ^lunch ^refund-1`)
+
+	resp = doGet(t, r, "/api/auth/transaction/link?link=refund-1")
+	assert.NoError(t, json.Unmarshal(resp.Data, &groups))
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "退款", groups[0].Desc)
+	assert.Equal(t, []string{"lunch", "refund-1"}, groups[1].Links)
+
+	resp = doGet(t, r, "/api/auth/transaction/detail?id="+groups[0].Id)
+	var form service.TransactionForm
+	assert.NoError(t, json.Unmarshal(resp.Data, &form))
+	assert.Equal(t, []string{"refund-1"}, form.Links)
+	assert.Equal(t, []string{"food"}, form.Tags)
+
+	resp = doDelete(t, r, "/api/auth/transaction/link?link=lunch&id="+groups[1].Id)
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), `2021-01-02 * "超市" "午饭" #food ^refund-1`+"\n")
+
+	resp = doGet(t, r, "/api/auth/transaction/link?link="+url.QueryEscape("a b"))
+	assert.Equal(t, 400, resp.Code)
+
+	// 内容相同的两笔交易分别返回，按 uuid 只修改其中一笔
+	duplicate := map[string]interface{}{
+		"date": "2021-01-26", "payee": "超市", "desc": "重复", "links": []string{"dup"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "8", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-8", "currency": "CNY"},
+		},
+	}
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", duplicate)).Code)
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", duplicate)).Code)
+	resp = doGet(t, r, "/api/auth/transaction/link?link=dup")
+	assert.NoError(t, json.Unmarshal(resp.Data, &groups))
+	assert.Equal(t, 2, len(groups))
+	assert.True(t, script.IsUUID(groups[1].Id))
+	assert.Equal(t, 2, len(groups[1].Entries))
+	for i, group := range groups {
+		link := fmt.Sprintf("dup-%d", i)
+		resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/link", map[string]interface{}{"ids": []string{group.Id}, "link": link}))
+		assert.Equal(t, 200, resp.Code)
+		var linked []service.TransactionGroup
+		resp = doGet(t, r, "/api/auth/transaction/link?link="+link)
+		assert.NoError(t, json.Unmarshal(resp.Data, &linked))
+		assert.Equal(t, 1, len(linked))
+		assert.Equal(t, group.Id, linked[0].Id)
+	}
+}
+
+func TestPendingTransactions(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-28", "flag": "!", "payee": "超市", "desc": "预授权",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "12", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-12", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), `2021-01-28 ! "超市" "预授权"`)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-28", "flag": "?", "payee": "超市", "desc": "预授权",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "12", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-12", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 400, resp.Code)
+
+	var transactions []service.Transaction
+	resp = doGet(t, r, "/api/auth/transaction?pending=true")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+	assert.Equal(t, "!", transactions[0].Flag)
+	assert.Equal(t, "预授权", transactions[0].Narration)
+
+	resp = doGet(t, r, "/api/auth/transaction/detail?id="+transactions[0].Id)
+	var form service.TransactionForm
+	assert.NoError(t, json.Unmarshal(resp.Data, &form))
+	assert.Equal(t, "!", form.Flag)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/clear", map[string]interface{}{"ids": []string{transactions[0].Id}}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-28 * \"超市\" \"预授权\"\n  uuid: ")
+
+	resp = doGet(t, r, "/api/auth/transaction?pending=true")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 0, len(transactions))
+	resp = doGet(t, r, "/api/auth/transaction?flag=*&narration=预授权")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+	assert.Equal(t, "*", transactions[0].Flag)
+}
+
+func TestMoveTransactionToAnotherMonth(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	var transactions []service.Transaction
+	resp := doGet(t, r, "/api/auth/transaction?narration=午饭")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"id": transactions[0].Id, "date": "2021-03-15", "payee": "超市", "desc": "午饭", "tags": []string{"food"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "25.5", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-25.5", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.NotContains(t, january, "午饭")
+	assert.True(t, strings.HasPrefix(january, `2021-01-05 * "券商" "买入"`))
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-03"), `2021-03-15 * "超市" "午饭"#food`)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "months"), `include "./2021-03.bean"`)
+
+	// 同一月份内修改时原位置替换
+	resp = doGet(t, r, "/api/auth/transaction?narration=午饭")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+	assert.Equal(t, "2021-03-15", transactions[0].Date)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"id": transactions[0].Id, "date": "2021-03-16", "payee": "超市", "desc": "晚饭",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "25.5", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-25.5", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	march := readMonthFile(t, ledgerConfig, "2021-03")
+	assert.NotContains(t, march, "午饭")
+	assert.Equal(t, 1, strings.Count(march, `2021-03-16 * "超市" "晚饭"`))
+}
+
+func TestTransactionUUID(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	// pad 生成的交易不补充 uuid
+	writePaddingMonthBean(t, ledgerConfig)
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction/uuid", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "3", string(resp.Data))
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-02 * \"超市\" \"午饭\" #food ^lunch\n  uuid: \"")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-03 pad Assets:Bank:招商银行 Equity:OpeningBalances\n\n")
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/uuid", nil))
+	assert.Equal(t, "0", string(resp.Data))
+
+	var transactions []service.Transaction
+	resp = doGet(t, r, "/api/auth/transaction?narration=午饭&meta=uuid")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	uuid := transactions[0].Meta["uuid"]
+	assert.True(t, script.IsUUID(uuid))
+
+	// 编辑后交易的 hash id 变化，uuid 不变
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"id": uuid, "date": "2021-01-02", "payee": "超市", "desc": "晚饭",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "25.5", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-25.5", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), uuid))
+
+	resp = doGet(t, r, "/api/auth/transaction/detail?id="+uuid)
+	var form service.TransactionForm
+	assert.NoError(t, json.Unmarshal(resp.Data, &form))
+	assert.Equal(t, "晚饭", form.Desc)
+	assert.NotEqual(t, transactions[0].Id, form.ID)
+	assert.Equal(t, uuid, form.Meta["uuid"])
+
+	resp = doGet(t, r, "/api/auth/transaction/raw?id="+uuid)
+	assert.Contains(t, string(resp.Data), "晚饭")
+
+	resp = doDelete(t, r, "/api/auth/transaction?id="+uuid)
+	assert.Equal(t, 200, resp.Code)
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), uuid)
+
+	// 内容相同的交易 hash id 相同，按 uuid 删除的是该 uuid 的交易
+	duplicate := map[string]interface{}{
+		"date": "2021-01-25", "payee": "超市", "desc": "重复",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "8", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-8", "currency": "CNY"},
+		},
+	}
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", duplicate)).Code)
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", duplicate)).Code)
+	resp = doGet(t, r, "/api/auth/transaction?narration=重复&meta=uuid")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	uuids := make(map[string]bool)
+	for _, transaction := range transactions {
+		assert.Equal(t, transactions[0].Id, transaction.Id)
+		uuids[transaction.Meta["uuid"]] = true
+	}
+	assert.Equal(t, 2, len(uuids))
+	// 删除后写入的交易，先写入的交易仍然存在
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	var kept, deleted string
+	for uuid := range uuids {
+		if deleted == "" || strings.Index(january, uuid) > strings.Index(january, deleted) {
+			kept, deleted = deleted, uuid
+		} else {
+			kept = uuid
+		}
+	}
+	assert.Equal(t, 200, doDelete(t, r, "/api/auth/transaction?id="+deleted).Code)
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), deleted)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), kept)
+}
+
+func TestRawTransactionBySourceLocation(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+	history := "; 历史账单\n2020-12-31 * \"房东\" \"房租\"   ; 十二月\n  ; 押一付三\n  Expenses:Food      3000 CNY\n  Assets:Bank:招商银行\n\n2020-12-31 * \"房东\" \"押金\"\n  Expenses:Food  100 CNY\n  Assets:Bank:招商银行\n"
+	historyPath := filepath.Join(ledgerConfig.DataPath, "history.bean")
+	assert.NoError(t, ioutil.WriteFile(historyPath, []byte(history), 0644))
+	index, err := ioutil.ReadFile(filepath.Join(ledgerConfig.DataPath, "index.bean"))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ledgerConfig.DataPath, "index.bean"), append(index, []byte("include \"history.bean\"\n")...), 0644))
+
+	var transactions []service.Transaction
+	resp := doGet(t, r, "/api/auth/transaction?narration=房租")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	assert.Equal(t, 2, len(transactions))
+
+	// 原文与源文件一致，包含注释和对齐
+	req, err := http.NewRequest(http.MethodGet, "/api/auth/transaction/raw?id="+transactions[0].Id, nil)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var raw string
+	assert.NoError(t, json.Unmarshal(decodeResponse(t, w).Data, &raw))
+	assert.Equal(t, "2020-12-31 * \"房东\" \"房租\"   ; 十二月\n  ; 押一付三\n  Expenses:Food      3000 CNY\n  Assets:Bank:招商银行", raw)
+	checksum := w.Header().Get("X-Entry-Checksum")
+	assert.NotEmpty(t, checksum)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/raw", map[string]interface{}{
+		"id": transactions[0].Id, "checksum": "outdated", "rawText": "2020-12-31 * \"房东\" \"房租\"\n  Expenses:Food  1 CNY\n  Assets:Bank:招商银行",
+	}))
+	assert.Equal(t, 1011, resp.Code)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/raw", map[string]interface{}{
+		"id": transactions[0].Id, "checksum": checksum, "rawText": "2020-12-31 * \"房东\" \"一月房租\"\n  Expenses:Food  3100 CNY\n  Assets:Bank:招商银行",
+	}))
+	assert.Equal(t, 200, resp.Code)
+	content, err := ioutil.ReadFile(historyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "; 历史账单\n2020-12-31 * \"房东\" \"一月房租\"\n  Expenses:Food  3100 CNY\n  Assets:Bank:招商银行\n\n2020-12-31 * \"房东\" \"押金\"\n  Expenses:Food  100 CNY\n  Assets:Bank:招商银行\n", string(content))
+
+	resp = doGet(t, r, "/api/auth/transaction?narration=押金")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	resp = doDelete(t, r, "/api/auth/transaction?id="+transactions[0].Id)
+	assert.Equal(t, 200, resp.Code)
+	content, err = ioutil.ReadFile(historyPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "押金")
+	assert.Contains(t, string(content), "一月房租")
+}
+
+func TestTransactionCostAndPrice(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	total := decimal.RequireFromString("1000")
+	assert.Equal(t, `{{1000.00 USD, 2024-01-02, "lot \"a\""}}`, script.CostSpec{NumberTotal: &total, Currency: "USD", Date: "2024-01-02", Label: `lot "a"`}.String())
+	assert.Equal(t, "{}", script.CostSpec{}.String())
+	assert.Equal(t, "0.125", script.CommodityPrecisions{}.Format(decimal.RequireFromString("0.125"), "CNY"))
+	assert.Equal(t, "3.00", script.CommodityPrecisions{}.Format(decimal.RequireFromString("3"), "CNY"))
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-20", "payee": "券商", "desc": "加仓",
+		"entries": []map[string]interface{}{
+			{"account": "Assets:Stock", "number": "5", "currency": "AAPL", "cost": map[string]interface{}{"number": "110.125", "currency": "CNY", "label": "lot-2"}},
+			{"account": "Assets:Stock", "number": "2", "currency": "AAPL", "cost": map[string]interface{}{"total": "250", "currency": "CNY"}, "priceAnnotation": map[string]interface{}{"number": "240", "currency": "CNY", "total": true}},
+			{"account": "Assets:Bank:招商银行", "number": "-800.625", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	content := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.Contains(t, content, " Assets:Stock 5 AAPL {110.125 CNY, \"lot-2\"}\r\n Assets:Stock 2 AAPL {{250.00 CNY}} @@ 240.00 CNY\r\n Assets:Bank:招商银行 -800.625 CNY")
+
+	// 按成本计算权重：5 * 110.125 + 250 != 800
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-21", "payee": "券商", "desc": "加仓",
+		"entries": []map[string]interface{}{
+			{"account": "Assets:Stock", "number": "5", "currency": "AAPL", "cost": map[string]interface{}{"number": "110.125", "currency": "CNY"}},
+			{"account": "Assets:Stock", "number": "2", "currency": "AAPL", "cost": map[string]interface{}{"total": "250", "currency": "CNY"}},
+			{"account": "Assets:Bank:招商银行", "number": "-800", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 1001, resp.Code)
+
+	for _, cost := range []map[string]interface{}{
+		{"number": "1", "total": "2", "currency": "CNY"},
+		{"number": "1"},
+		{"number": "1", "currency": "cny"},
+		{"date": "2021/01/01"},
+	} {
+		resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+			"date": "2021-01-21", "payee": "券商", "desc": "无效成本",
+			"entries": []map[string]interface{}{
+				{"account": "Assets:Stock", "number": "1", "currency": "AAPL", "cost": cost},
+				{"account": "Assets:Bank:招商银行", "number": "-1", "currency": "CNY"},
+			},
+		}))
+		assert.Equal(t, 400, resp.Code)
+	}
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-21")
+
+	// 减仓：按标签匹配持仓，按价格计算权重
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-22", "payee": "券商", "desc": "减仓",
+		"entries": []map[string]interface{}{
+			{"account": "Assets:Stock", "number": "-5", "currency": "AAPL", "cost": map[string]interface{}{"label": "lot-2"}, "priceAnnotation": map[string]interface{}{"number": "110.125", "currency": "CNY"}},
+			{"account": "Assets:Bank:招商银行", "number": "550.625", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), " Assets:Stock -5 AAPL {\"lot-2\"} @ 110.125 CNY\r\n")
+
+	// 旧格式：price 为以记账货币计的成本，同时记录汇率
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-23", "payee": "券商", "desc": "定投",
+		"entries": []map[string]interface{}{
+			{"account": "Assets:Stock", "number": "1", "currency": "AAPL", "price": "100"},
+			{"account": "Assets:Bank:招商银行", "number": "-100", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), " Assets:Stock 1 AAPL {100.00 CNY, 2021-01-23}\r\n")
+
+	var transactions []service.Transaction
+	resp = doGet(t, r, "/api/auth/transaction?narration=加仓")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	resp = doGet(t, r, "/api/auth/transaction/detail?id="+transactions[0].Id)
+	var form service.TransactionForm
+	assert.NoError(t, json.Unmarshal(resp.Data, &form))
+	assert.Equal(t, 3, len(form.Entries))
+	assert.Equal(t, "lot-2", form.Entries[0].Cost.Label)
+	assert.Equal(t, "110.125", form.Entries[0].Cost.Number.String())
+	assert.Equal(t, "250", form.Entries[1].Cost.Total.String())
+	assert.True(t, form.Entries[1].PriceAnnotation.Total)
+	assert.Nil(t, form.Entries[2].Cost)
+}
+
+func TestCheckPostingsBalance(t *testing.T) {
+	amount := func(number string) *decimal.Decimal {
+		d := decimal.RequireFromString(number)
+		return &d
+	}
+	tolerance := decimal.RequireFromString("0.005")
+	// 没有数量的过账补全其币种的差额，其他币种仍然校验
+	assert.NoError(t, script.CheckPostingsBalance([]script.Posting{
+		{Number: amount("10"), Currency: "CNY"}, {Number: amount("5"), Currency: "USD"}, {Currency: ""},
+	}, tolerance))
+	err := script.CheckPostingsBalance([]script.Posting{
+		{Number: amount("10"), Currency: "CNY"}, {Number: amount("5"), Currency: "USD"}, {Currency: "CNY"},
+	}, tolerance)
+	assert.True(t, errors.Is(err, script.ErrTransactionNotBalance))
+	err = script.CheckPostingsBalance([]script.Posting{
+		{Number: amount("10"), Currency: "CNY"}, {}, {},
+	}, tolerance)
+	assert.True(t, errors.Is(err, script.ErrInvalidPosting))
+}
+
+func TestCommodityPrecision(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	precisions := script.CommodityPrecisions{"JPY": 0, "BTC": 8}
+	assert.Equal(t, "1500", precisions.Format(decimal.RequireFromString("1500.00"), "JPY"))
+	assert.Equal(t, "0.00150000", precisions.Format(decimal.RequireFromString("0.0015"), "BTC"))
+	assert.Equal(t, "12.345", precisions.Format(decimal.RequireFromString("12.3450"), "CNY"))
+	assert.Equal(t, "12.30", precisions.Format(decimal.RequireFromString("12.3"), "CNY"))
+
+	// 账本中 AAPL 为整数，CNY 为 2 位小数
+	inferred := script.GetCommodityPrecisions(ledgerConfig)
+	assert.Equal(t, int32(0), inferred.Places("AAPL"))
+	assert.Equal(t, int32(2), inferred.Places("CNY"))
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/commodity/precision", map[string]interface{}{"currency": "BTC", "precision": 8}))
+	assert.Equal(t, 200, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/commodity/precision", map[string]interface{}{"currency": "JPY", "precision": 19}))
+	assert.Equal(t, 400, resp.Code)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-25", "payee": "交易所", "desc": "买币",
+		"entries": []map[string]interface{}{
+			{"account": "Assets:Stock", "number": "0.0015", "currency": "BTC", "cost": map[string]interface{}{"number": "40000", "currency": "CNY"}},
+			{"account": "Assets:Bank:招商银行", "number": "-60", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), " Assets:Stock 0.00150000 BTC {40000.00 CNY}\r\n Assets:Bank:招商银行 -60.00 CNY")
+
+	var transactions []service.Transaction
+	resp = doGet(t, r, "/api/auth/transaction?narration=买币")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	numbers := make([]string, 0)
+	for _, transaction := range transactions {
+		numbers = append(numbers, transaction.Number)
+	}
+	assert.ElementsMatch(t, []string{"0.00150000", "-60.00"}, numbers)
+
+	resp = doGet(t, r, "/api/auth/commodity/precision")
+	var result []service.CommodityPrecision
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Contains(t, result, service.CommodityPrecision{Currency: "BTC", Precision: 8, Configured: true})
+	assert.Contains(t, result, service.CommodityPrecision{Currency: "AAPL", Precision: 0})
+
+	// 删除设置后恢复为推断的位数
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/commodity/precision", map[string]interface{}{"currency": "BTC"}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, int32(8), script.GetCommodityPrecisions(ledgerConfig).Places("BTC"))
+}
+
+func TestInstallmentTransactions(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-20", "payee": "商城", "desc": "手机分期", "divideDateList": []string{"2021-01-20", "2099-02-20", "2099-03-20"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "1000", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-1000", "currency": "CNY"},
+		},
+		"installmentFees": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "5", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-5", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	var link string
+	assert.NoError(t, json.Unmarshal(resp.Data, &link))
+	assert.True(t, strings.HasPrefix(link, service.InstallmentLinkPrefix))
+
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.Contains(t, january, "\"手机分期\" ^"+link+"\r\n  installment: \"1/3\"")
+	assert.Contains(t, january, " Expenses:Food 333.33 CNY\r\n Assets:Bank:招商银行 -333.33 CNY\r\n Expenses:Food 5.00 CNY\r\n Assets:Bank:招商银行 -5.00 CNY")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2099-02"), " Expenses:Food 333.34 CNY\r\n Assets:Bank:招商银行 -333.34 CNY")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2099-03"), " Expenses:Food 333.33 CNY\r\n Assets:Bank:招商银行 -333.33 CNY")
+
+	resp = doGet(t, r, "/api/auth/transaction/installment?link="+link)
+	var plan service.InstallmentPlan
+	assert.NoError(t, json.Unmarshal(resp.Data, &plan))
+	assert.Equal(t, 3, plan.Total)
+	assert.Equal(t, 2, plan.Remaining)
+	total := decimal.Zero
+	for _, item := range plan.Items {
+		for _, entry := range item.Entries {
+			if entry.Account == "Expenses:Food" {
+				total = total.Add(decimal.RequireFromString(entry.Number))
+			}
+		}
+	}
+	assert.Equal(t, "1015", total.String())
+
+	resp = doGet(t, r, "/api/auth/transaction/installment?link=lunch")
+	assert.Equal(t, 400, resp.Code)
+
+	// 其中一期在查询后被修改（查询缓存未失效）时不删除任何一期
+	february := filepath.Join(ledgerConfig.DataPath, "month", "2099-02.bean")
+	info, err := os.Stat(february)
+	assert.NoError(t, err)
+	original := readMonthFile(t, ledgerConfig, "2099-02")
+	assert.NoError(t, ioutil.WriteFile(february, []byte(strings.Replace(original, "2099-02-20", "2099-02-21", 1)), 0644))
+	assert.NoError(t, os.Chtimes(february, info.ModTime(), info.ModTime()))
+	resp = doDelete(t, r, "/api/auth/transaction/installment?link="+link)
+	assert.Equal(t, 1011, resp.Code)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2099-03"), "手机分期")
+	assert.NoError(t, ioutil.WriteFile(february, []byte(original), 0644))
+	assert.NoError(t, os.Chtimes(february, info.ModTime(), info.ModTime()))
+
+	// 取消后只保留已到期的一期
+	resp = doDelete(t, r, "/api/auth/transaction/installment?link="+link)
+	assert.Equal(t, 200, resp.Code)
+	var deleted []string
+	assert.NoError(t, json.Unmarshal(resp.Data, &deleted))
+	assert.Equal(t, 2, len(deleted))
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2099-02"), "手机分期")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "手机分期")
+
+	// 不平衡的分期不写入任何一期
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-20", "payee": "商城", "desc": "电脑分期", "divideDateList": []string{"2021-01-20", "2021-01-21"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "1000", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-900", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 1001, resp.Code)
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), "电脑分期")
+
+	// 某一期写入失败时已写入的分期也会恢复
+	assert.NoError(t, os.MkdirAll(filepath.Join(ledgerConfig.DataPath, "month", "2099-06.bean"), os.ModePerm))
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction", map[string]interface{}{
+		"date": "2021-01-20", "payee": "商城", "desc": "电脑分期", "divideDateList": []string{"2021-01-20", "2099-05-20", "2099-06-20"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "900", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-900", "currency": "CNY"},
+		},
+	}))
+	assert.Equal(t, 500, resp.Code)
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), "电脑分期")
+	assert.NoFileExists(t, filepath.Join(ledgerConfig.DataPath, "month", "2099-05.bean"))
+}
+
+func TestBatchTransactions(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+
+	valid := func(date string, desc string) map[string]interface{} {
+		return map[string]interface{}{
+			"date": date, "payee": "导入", "desc": desc,
+			"entries": []map[string]interface{}{
+				{"account": "Expenses:Food", "number": "12", "currency": "CNY"},
+				{"account": "Assets:Bank:招商银行", "number": "-12", "currency": "CNY"},
+			},
+		}
+	}
+	unbalanced := valid("2021-01-26", "不平衡")
+	unbalanced["entries"].([]map[string]interface{})[1]["number"] = "-10"
+	invalidDate := valid("2021/01/27", "日期错误")
+	transactions := []map[string]interface{}{valid("2021-01-25", "早饭"), unbalanced, valid("2021-04-01", "午饭"), invalidDate}
+
+	// 默认全部成功才写入
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction/batch", map[string]interface{}{"transactions": transactions}))
+	assert.Equal(t, 200, resp.Code)
+	var result service.BatchTransactionResult
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 0, result.Created)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, service.BatchItemSkipped, result.Items[0].Status)
+	assert.Equal(t, service.BatchItemFailed, result.Items[1].Status)
+	assert.Equal(t, 1001, result.Items[1].Code)
+	assert.Equal(t, 400, result.Items[3].Code)
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), "早饭")
+	assert.NoFileExists(t, filepath.Join(ledgerConfig.DataPath, "month", "2021-04.bean"))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/batch", map[string]interface{}{"transactions": transactions, "continueOnError": true}))
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, service.BatchItemCreated, result.Items[2].Status)
+	assert.True(t, script.IsUUID(result.Items[2].UUID))
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-01"), "\"导入\" \"早饭\"")
+	assert.NotContains(t, readMonthFile(t, ledgerConfig, "2021-01"), "不平衡")
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "2021-04"), result.Items[2].UUID)
+	assert.Contains(t, readMonthFile(t, ledgerConfig, "months"), `include "./2021-04.bean"`)
+
+	// 数组请求体保持旧接口的行为
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/batch", []map[string]interface{}{valid("2021-01-28", "晚饭"), unbalanced}))
+	var legacy []string
+	assert.NoError(t, json.Unmarshal(resp.Data, &legacy))
+	assert.Equal(t, []string{"2021-01-28导入晚饭"}, legacy)
+
+	// 写入失败时截断已追加的内容，删除新建的文件
+	january, months := readMonthFile(t, ledgerConfig, "2021-01"), readMonthFile(t, ledgerConfig, "months")
+	assert.NoError(t, os.MkdirAll(filepath.Join(ledgerConfig.DataPath, "month", "2021-06.bean"), os.ModePerm))
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/batch", map[string]interface{}{"transactions": []map[string]interface{}{
+		valid("2021-01-29", "回滚"), valid("2021-05-01", "回滚"), valid("2021-06-01", "回滚"),
+	}}))
+	assert.Equal(t, 500, resp.Code)
+	assert.Equal(t, january, readMonthFile(t, ledgerConfig, "2021-01"))
+	assert.Equal(t, months, readMonthFile(t, ledgerConfig, "months"))
+	assert.NoFileExists(t, filepath.Join(ledgerConfig.DataPath, "month", "2021-05.bean"))
+}
+
+func TestBulkEditTransactions(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+	original := readMonthFile(t, ledgerConfig, "2021-01")
+
+	form := map[string]interface{}{
+		"q": "account:Expenses:Food",
+		"operation": map[string]interface{}{
+			"replaceAccount": map[string]interface{}{"from": "Expenses:Food", "to": "Expenses:Food:Dining"},
+			"addTags":        []string{"reviewed"},
+			"removeTags":     []string{"food"},
+			"payee":          "餐厅",
+			"meta":           map[string]interface{}{"key": "category", "value": "dining"},
+		},
+		"dryRun": true,
+	}
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", form))
+	assert.Equal(t, 200, resp.Code)
+	var result service.BulkEditResult
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 2, result.Matched)
+	assert.Equal(t, 2, len(result.Changes))
+	assert.Equal(t, "month/2021-01.bean", result.Changes[0].FilePath)
+	assert.Equal(t, "2021-01-02 * \"超市\" \"午饭\" #food ^lunch\n  Expenses:Food  25.50 CNY\n  Assets:Bank:招商银行", result.Changes[0].Before)
+	assert.Equal(t, "2021-01-02 * \"餐厅\" \"午饭\" ^lunch #reviewed\n  category: \"dining\"\n  Expenses:Food:Dining  25.50 CNY\n  Assets:Bank:招商银行", result.Changes[0].After)
+	assert.Empty(t, result.Backup)
+	assert.Equal(t, original, readMonthFile(t, ledgerConfig, "2021-01"))
+
+	form["dryRun"] = false
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", form))
+	assert.Equal(t, 200, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.NotEmpty(t, result.Backup)
+	backup, err := ioutil.ReadFile(filepath.Join(ledgerConfig.DataPath, result.Backup, "month_2021-01.bean"))
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(backup))
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.Contains(t, january, "2021-02-01 * \"餐厅\" \"卖出\" #reviewed\n  category: \"dining\"\n")
+	assert.Contains(t, january, "  Expenses:Food:Dining\n")
+	assert.NotContains(t, january, "#food")
+
+	// 按 id 选择，删除元数据
+	var transactions []service.Transaction
+	resp = doGet(t, r, "/api/auth/transaction?narration=午饭")
+	assert.NoError(t, json.Unmarshal(resp.Data, &transactions))
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", map[string]interface{}{
+		"ids":       []string{transactions[0].Id},
+		"operation": map[string]interface{}{"meta": map[string]interface{}{"key": "category", "value": nil}},
+	}))
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 1, len(result.Changes))
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "category:"))
+
+	// 文件在查询后被修改（大小和修改时间不变，查询缓存未失效），首行不再是该交易时不修改
+	dryRun := map[string]interface{}{"q": "午饭", "operation": map[string]interface{}{"addTags": []string{"a"}}, "dryRun": true}
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", dryRun)).Code)
+	monthFile := filepath.Join(ledgerConfig.DataPath, "month", "2021-01.bean")
+	info, err := os.Stat(monthFile)
+	assert.NoError(t, err)
+	changed := strings.Replace(readMonthFile(t, ledgerConfig, "2021-01"), "2021-01-02 *", "2021-01-03 *", 1)
+	assert.NoError(t, ioutil.WriteFile(monthFile, []byte(changed), 0644))
+	assert.NoError(t, os.Chtimes(monthFile, info.ModTime(), info.ModTime()))
+	dryRun["dryRun"] = false
+	assert.Equal(t, 1011, decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", dryRun)).Code)
+	assert.Equal(t, changed, readMonthFile(t, ledgerConfig, "2021-01"))
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", map[string]interface{}{"q": "午饭", "operation": map[string]interface{}{}}))
+	assert.Equal(t, 400, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", map[string]interface{}{"operation": map[string]interface{}{"addTags": []string{"a"}}}))
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestBulkEditSkipsPadding(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+	writePaddingMonthBean(t, ledgerConfig)
+
+	// pad 生成的交易（标记 P）的行号指向 pad 指令，不能被修改
+	resp := decodeResponse(t, doPost(t, r, "/api/auth/transaction/bulk", map[string]interface{}{
+		"q":         "account:Assets:Bank:招商银行",
+		"operation": map[string]interface{}{"addTags": []string{"t"}, "payee": "X"},
+	}))
+	assert.Equal(t, 200, resp.Code)
+	var result service.BulkEditResult
+	assert.NoError(t, json.Unmarshal(resp.Data, &result))
+	assert.Equal(t, 3, len(result.Changes))
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.Contains(t, january, "\n2021-01-03 pad Assets:Bank:招商银行 Equity:OpeningBalances\n")
+	assert.Equal(t, 200, doGet(t, r, "/api/auth/transaction").Code)
+}
+
+func TestDuplicateTransactions(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+	for _, form := range []map[string]interface{}{
+		{"date": "2021-01-03", "payee": "超市", "desc": "午饭"},
+		{"date": "2021-01-20", "payee": "星巴克", "desc": "咖啡"},
+		{"date": "2021-01-21", "payee": "Starbucks", "desc": "咖啡"},
+	} {
+		number := "25.50"
+		if form["desc"] == "咖啡" {
+			number = "30"
+		}
+		form["entries"] = []map[string]interface{}{
+			{"account": "Expenses:Food", "number": number, "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-" + number, "currency": "CNY"},
+		}
+		assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", form)).Code)
+	}
+
+	var candidates []service.DuplicateCandidate
+	resp := doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 2, len(candidates))
+	assert.Equal(t, 0.95, candidates[0].Score)
+	assert.Equal(t, 1, candidates[0].DateDiff)
+	assert.Equal(t, "2021-01-02", candidates[0].Transactions[0].Date)
+	assert.Equal(t, "2021-01-03", candidates[0].Transactions[1].Date)
+	assert.Equal(t, 0.75, candidates[1].Score)
+	lunch := []string{candidates[0].Transactions[0].Id, candidates[0].Transactions[1].Id}
+	coffee := []string{candidates[1].Transactions[0].Id, candidates[1].Transactions[1].Id}
+
+	resp = doGet(t, r, "/api/auth/transaction/duplicate?minScore=0.8")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 1, len(candidates))
+	resp = doGet(t, r, "/api/auth/transaction/duplicate?days=0")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 0, len(candidates))
+
+	// 忽略的交易对按 uuid 记录在账本中
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/duplicate", map[string]interface{}{"ids": lunch, "action": "ignore"}))
+	assert.Equal(t, 200, resp.Code)
+	var ignores []service.DuplicateIgnore
+	resp = doGet(t, r, "/api/auth/transaction/duplicate/ignore")
+	assert.NoError(t, json.Unmarshal(resp.Data, &ignores))
+	assert.Equal(t, 1, len(ignores))
+	assert.Contains(t, ignores[0].IDs, lunch[0])
+	assert.Contains(t, ignores[0].IDs, lunch[1])
+	assert.True(t, script.IsUUID(lunch[1]))
+	resp = doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, coffee[0], candidates[0].Transactions[0].Id)
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/duplicate", map[string]interface{}{"ids": coffee, "action": "link"}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 2, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "^"+service.DuplicateLinkPrefix))
+	resp = doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 0, len(candidates))
+
+	resp = doDelete(t, r, "/api/auth/transaction/duplicate/ignore?id="+ignores[0].IDs[1]+"&id="+ignores[0].IDs[0])
+	assert.Equal(t, 200, resp.Code)
+	resp = doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 1, len(candidates))
+	lunch = []string{candidates[0].Transactions[0].Id, candidates[0].Transactions[1].Id}
+
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/duplicate", map[string]interface{}{"ids": lunch, "action": "delete", "deleteId": "x"}))
+	assert.Equal(t, 400, resp.Code)
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/duplicate", map[string]interface{}{"ids": lunch, "action": "delete", "deleteId": lunch[1]}))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"午饭\""))
+	resp = doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 0, len(candidates))
+
+	// 重复提交的交易内容相同（hash id 相同），按 uuid 区分
+	form := map[string]interface{}{
+		"date": "2021-01-25", "payee": "便利店", "desc": "早饭",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "12", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-12", "currency": "CNY"},
+		},
+	}
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", form)).Code)
+	assert.Equal(t, 200, decodeResponse(t, doPost(t, r, "/api/auth/transaction", form)).Code)
+	resp = doGet(t, r, "/api/auth/transaction/duplicate")
+	assert.NoError(t, json.Unmarshal(resp.Data, &candidates))
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, 1.0, candidates[0].Score)
+	assert.Equal(t, 2, len(candidates[0].Transactions[1].Entries))
+	breakfast := []string{candidates[0].Transactions[0].Id, candidates[0].Transactions[1].Id}
+	resp = decodeResponse(t, doPost(t, r, "/api/auth/transaction/duplicate", map[string]interface{}{"ids": breakfast, "action": "delete", "deleteId": breakfast[1]}))
+	assert.Equal(t, 200, resp.Code)
+	january := readMonthFile(t, ledgerConfig, "2021-01")
+	assert.Contains(t, january, breakfast[0])
+	assert.NotContains(t, january, breakfast[1])
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	r, ledgerConfig := newTransactionRouter(t)
+	defer os.RemoveAll(ledgerConfig.DataPath)
+	form := map[string]interface{}{
+		"date": "2021-01-20", "payee": "超市", "desc": "晚饭",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "30", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-30", "currency": "CNY"},
+		},
+	}
+	header := map[string]string{service.IdempotencyKeyHeader: "add-1"}
+
+	w := doPostWithHeader(t, r, "/api/auth/transaction", form, header)
+	first := decodeResponse(t, w)
+	assert.Equal(t, 200, first.Code)
+	assert.Empty(t, w.Header().Get(service.IdempotencyReplayedHeader))
+	w = doPostWithHeader(t, r, "/api/auth/transaction", form, header)
+	assert.Equal(t, "true", w.Header().Get(service.IdempotencyReplayedHeader))
+	assert.Equal(t, first.Data, decodeResponse(t, w).Data)
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"晚饭\""))
+
+	// 相同的 Key 用于不同的请求
+	form["desc"] = "夜宵"
+	assert.Equal(t, 1012, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction", form, header)).Code)
+	assert.Equal(t, 1012, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction/batch", []interface{}{form}, header)).Code)
+
+	// 失败的请求不保存，修正后可以用相同的 Key 重试
+	form["entries"].([]map[string]interface{})[1]["number"] = "-20"
+	header[service.IdempotencyKeyHeader] = "add-2"
+	assert.Equal(t, 1001, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction", form, header)).Code)
+	form["entries"].([]map[string]interface{})[1]["number"] = "-30"
+	assert.Equal(t, 200, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction", form, header)).Code)
+	assert.Equal(t, 200, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction", form, header)).Code)
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"夜宵\""))
+
+	// 批量和分期
+	header[service.IdempotencyKeyHeader] = "batch-1"
+	batch := map[string]interface{}{"transactions": []interface{}{map[string]interface{}{
+		"date": "2021-01-21", "desc": "早饭",
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "8", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-8", "currency": "CNY"},
+		},
+	}}}
+	// 没有写入任何交易的批量结果不保存
+	entries := batch["transactions"].([]interface{})[0].(map[string]interface{})["entries"].([]map[string]interface{})
+	entries[1]["number"] = "-6"
+	resp := decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction/batch", batch, header))
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, string(resp.Data), `"failed":1`)
+	entries[1]["number"] = "-8"
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction/batch", batch, header)).Code)
+	}
+	assert.Equal(t, 1, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"早饭\""))
+
+	header[service.IdempotencyKeyHeader] = "installment-1"
+	installment := map[string]interface{}{
+		"date": "2021-01-22", "desc": "分期", "divideDateList": []string{"2021-01-22", "2021-01-23"},
+		"entries": []map[string]interface{}{
+			{"account": "Expenses:Food", "number": "100", "currency": "CNY"},
+			{"account": "Assets:Bank:招商银行", "number": "-100", "currency": "CNY"},
+		},
+	}
+	var links [2]string
+	for i := range links {
+		resp := decodeResponse(t, doPostWithHeader(t, r, "/api/auth/transaction", installment, header))
+		assert.NoError(t, json.Unmarshal(resp.Data, &links[i]))
+	}
+	assert.Equal(t, links[0], links[1])
+	assert.Equal(t, 2, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"分期\""))
+
+	// 超过保留时间的 Key 不再生效，保存新记录时清理
+	filePath := script.GetLedgerIdempotencyFilePath(ledgerConfig.DataPath)
+	content, err := ioutil.ReadFile(filePath)
+	assert.NoError(t, err)
+	var records []service.IdempotencyRecord
+	assert.NoError(t, json.Unmarshal(content, &records))
+	assert.Equal(t, 4, len(records))
+	records[0].CreatedAt = time.Now().Add(-25 * time.Hour).Format(time.RFC3339)
+	content, err = json.Marshal(records)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filePath, content, 0644))
+	form["desc"] = "晚饭"
+	header[service.IdempotencyKeyHeader] = "add-1"
+	w = doPostWithHeader(t, r, "/api/auth/transaction", form, header)
+	assert.Equal(t, 200, decodeResponse(t, w).Code)
+	assert.Empty(t, w.Header().Get(service.IdempotencyReplayedHeader))
+	assert.Equal(t, 2, strings.Count(readMonthFile(t, ledgerConfig, "2021-01"), "\"晚饭\""))
+}